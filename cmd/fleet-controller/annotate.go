@@ -0,0 +1,356 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/model"
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+)
+
+func init() {
+	annotateCmd.PersistentFlags().String("server", "http://localhost:8075", "The provisioning server whose API will be queried.")
+	annotateCmd.PersistentFlags().Bool("dry-run", true, "Whether the fleet controller will perform actions or just print the annotation changes that would be made.")
+	annotateCmd.PersistentFlags().Bool("unlock", false, "Whether the fleet controller will unlock installations to annotate them or not.")
+	annotateCmd.PersistentFlags().Int64("max-updating", 25, "The maximum number of installations that can be currently updating before annotating more.")
+	annotateCmd.PersistentFlags().StringSlice("add", nil, "An annotation to add to the installations. Can be repeated.")
+	annotateCmd.PersistentFlags().StringSlice("remove", nil, "An annotation to remove from the installations. Can be repeated.")
+	addExecutorFlags(annotateCmd, 3*time.Second, 0)
+	addTargetFlags(annotateCmd)
+	addSelectorFlag(annotateCmd)
+
+	// Installation filters
+	annotateCmd.PersistentFlags().String("owner", "", "The owner ID value to filter installations by.")
+	annotateCmd.PersistentFlags().String("group", "", "The group ID value to filter installations by.")
+}
+
+type annotateAction struct {
+	installation *cmodel.InstallationDTO
+	add          []string
+	remove       []string
+}
+
+var annotateCmd = &cobra.Command{
+	Use:   "annotate",
+	Short: "Add or remove annotations on installations",
+	RunE: forEachProvisioner(func(command *cobra.Command, args []string, settings *provisionerSettings) error {
+		command.SilenceUsage = true
+		ctx, cancel := newRunContext(command)
+		defer cancel()
+
+		productionLogs, _ := command.Flags().GetBool("production-logs")
+		logger := setupLogger("annotate", productionLogs, settings.name)
+
+		logger.Info("Starting installation annotation")
+
+		start := time.Now()
+
+		serverAddress := settings.server
+		dryrun, _ := command.Flags().GetBool("dry-run")
+		unlock, _ := command.Flags().GetBool("unlock")
+		add, _ := command.Flags().GetStringSlice("add")
+		remove, _ := command.Flags().GetStringSlice("remove")
+		owner, _ := command.Flags().GetString("owner")
+		group, _ := command.Flags().GetString("group")
+
+		if len(serverAddress) == 0 {
+			return errors.New("server value must be defined")
+		}
+		err := validateAnnotationChanges(add, remove)
+		if err != nil {
+			return err
+		}
+
+		targets, err := newInstallationTargets(command)
+		if err != nil {
+			return err
+		}
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+		runJournal, err := newJournal(command, "annotate", settings.name)
+		if err != nil {
+			return err
+		}
+
+		notifier, err := newProvisionerNotifier(command, settings)
+		if err != nil {
+			return err
+		}
+
+		summary := newRunSummary("Annotation Report", "annotate", dryrun)
+		summary.AddFilter("Add", strings.Join(add, ", "))
+		summary.AddFilter("Remove", strings.Join(remove, ", "))
+		summary.AddFilter("Group ID", group)
+		summary.AddFilter("Owner ID", owner)
+		summary.AddFilter("Selector", sel)
+		targets.addFilters(summary)
+
+		client := newProvisionerClient(settings)
+
+		var installations []*cmodel.InstallationDTO
+		if targets.enabled() {
+			logger.Infof("Obtaining %d selected installations", len(targets.ids))
+			var missing []string
+			installations, missing, err = targets.getInstallations(ctx, client)
+			if err != nil {
+				return err
+			}
+			for _, id := range missing {
+				logger.WithField("installation", id).Warn("Could not find installation")
+				summary.AddError(id, errors.New("installation not found"))
+			}
+		} else {
+			logger.WithFields(log.Fields{
+				"owner-filter": owner,
+				"group-filter": group,
+			}).Info("Obtaining current installations")
+			installations, err = client.GetInstallations(&cmodel.GetInstallationsRequest{
+				OwnerID:                     owner,
+				GroupID:                     group,
+				IncludeGroupConfig:          false,
+				IncludeGroupConfigOverrides: false,
+				Paging: cmodel.Paging{
+					Page:           0,
+					PerPage:        cmodel.AllPerPage,
+					IncludeDeleted: false,
+				},
+			})
+			if err != nil {
+				return errors.Wrap(err, "failed to get installations")
+			}
+		}
+		installations = sel.Filter(installations)
+
+		logger.Infof("Calculating annotation changes on %d installations", len(installations))
+		var errorSkipCount, unchangedCount int
+		var actions []*annotateAction
+		for _, installation := range installations {
+			logger := logger.WithField("installation", installation.ID)
+
+			action := planAnnotations(installation, add, remove)
+			if len(action.add) == 0 && len(action.remove) == 0 {
+				logger.Debug("Installation annotations are already up to date")
+				unchangedCount++
+				continue
+			}
+			if installation.APISecurityLock && !unlock {
+				err = errors.New("installation is locked and fleet controller is not set to perform unlocks")
+				logger.WithError(err).Warn("Skipping installation annotation")
+				summary.AddError(installation.ID, err)
+				errorSkipCount++
+				continue
+			}
+
+			logger.WithFields(log.Fields{
+				"add":    strings.Join(action.add, ","),
+				"remove": strings.Join(action.remove, ","),
+			}).Info("Annotation changes planned")
+			actions = append(actions, action)
+			progress.planned(installation.ID, "annotate", strings.Join(annotationNames(installation), ", "), strings.Join(action.annotations(), ", "))
+		}
+
+		logger.WithFields(log.Fields{
+			"annotate-count":       len(actions),
+			"unchanged-count":      unchangedCount,
+			"annotate-skip-errors": errorSkipCount,
+		}).Info("Annotation calculations complete")
+
+		if len(actions) == 0 {
+			logger.Info("No installations require annotation changes; exiting...")
+			return nil
+		}
+		if dryrun {
+			logger.Infof("Dry run complete; %d installations would be annotated", len(actions))
+			return nil
+		}
+
+		leader, err := acquireRunLock(command, settings, cancel, logger)
+		if err != nil {
+			return err
+		}
+		defer leader.release(logger)
+
+		exec, err := newExecutor(command, settings, client, logger)
+		if err != nil {
+			return err
+		}
+
+		var tasks []*executor.Task
+		actionsByID := make(map[string]*annotateAction, len(actions))
+		for i, action := range actions {
+			i, action := i, action
+			actionsByID[action.installation.ID] = action
+			tasks = append(tasks, &executor.Task{
+				InstallationID: action.installation.ID,
+				Run: func() error {
+					logger.WithField("installation", action.installation.ID).Infof("Annotating installation %d/%d", i+1, len(actions))
+
+					err := annotateInstallation(action, client)
+					if err != nil {
+						return err
+					}
+
+					recordJournalEntry(runJournal, &journal.Entry{
+						InstallationID:     action.installation.ID,
+						Action:             "annotate",
+						PreviousSize:       action.installation.Size,
+						NewSize:            action.installation.Size,
+						PreviousState:      action.installation.State,
+						NewState:           action.installation.State,
+						APISecurityLock:    action.installation.APISecurityLock,
+						AddedAnnotations:   action.add,
+						RemovedAnnotations: action.remove,
+					}, logger)
+
+					return nil
+				},
+			})
+		}
+
+		results, runErr := exec.Run(ctx, progress.trackTasks(leader.lockTasks(tasks)))
+
+		var annotatedCount, failedCount int
+		for _, result := range results {
+			if result.Err != nil {
+				logger.WithField("installation", result.InstallationID).WithError(result.Err).Error("Failed to annotate installation")
+				summary.AddError(result.InstallationID, result.Err)
+				failedCount++
+				continue
+			}
+
+			action := actionsByID[result.InstallationID]
+			summary.AddChange(result.InstallationID, strings.Join(annotationNames(action.installation), ", "), strings.Join(action.annotations(), ", "))
+			annotatedCount++
+		}
+		if runErr != nil {
+			summary.AddError("", runErr)
+		}
+
+		summary.AddCount("Selected Installations", len(installations))
+		summary.AddCount("Installations Annotated", annotatedCount)
+		summary.AddCount("Installations Unchanged", unchangedCount)
+		summary.AddCount("Annotation Skip Errors", errorSkipCount)
+		summary.AddCount("Annotation Failures", failedCount)
+		notifier.sendRunReport(ctx, summary, start, logger)
+
+		logger.WithField("runtime", summary.Runtime).Info("Installation annotation complete")
+
+		if runErr != nil {
+			return runErr
+		}
+		if failedCount != 0 {
+			return errors.Errorf("failed to annotate %d of %d installations", failedCount, len(actions))
+		}
+
+		return nil
+	}),
+}
+
+func validateAnnotationChanges(add, remove []string) error {
+	if len(add) == 0 && len(remove) == 0 {
+		return errors.New("at least one annotation to add or remove must be defined")
+	}
+	_, err := cmodel.AnnotationsFromStringSlice(append(append([]string{}, add...), remove...))
+	if err != nil {
+		return err
+	}
+	for _, name := range add {
+		for _, removed := range remove {
+			if name == removed {
+				return errors.Errorf("annotation %s can't be both added and removed", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// planAnnotations returns the annotations that have to be added to and
+// removed from an installation.
+func planAnnotations(installation *cmodel.InstallationDTO, add, remove []string) *annotateAction {
+	existing := make(map[string]bool)
+	for _, name := range annotationNames(installation) {
+		existing[name] = true
+	}
+
+	action := &annotateAction{installation: installation}
+	for _, name := range add {
+		if !existing[name] {
+			action.add = append(action.add, name)
+			existing[name] = true
+		}
+	}
+	for _, name := range remove {
+		if existing[name] {
+			action.remove = append(action.remove, name)
+			delete(existing, name)
+		}
+	}
+
+	return action
+}
+
+// annotations returns the installation annotations after the action.
+func (a *annotateAction) annotations() []string {
+	removed := make(map[string]bool)
+	for _, name := range a.remove {
+		removed[name] = true
+	}
+
+	var names []string
+	for _, name := range annotationNames(a.installation) {
+		if !removed[name] {
+			names = append(names, name)
+		}
+	}
+	names = append(names, a.add...)
+	sort.Strings(names)
+
+	return names
+}
+
+func annotationNames(installation *cmodel.InstallationDTO) []string {
+	var names []string
+	for _, annotation := range installation.Annotations {
+		names = append(names, annotation.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func annotateInstallation(action *annotateAction, client model.ProvisionerClient) error {
+	installation := action.installation
+
+	return withUnlockedAPI(installation, client, func() error {
+		if len(action.add) != 0 {
+			_, err := client.AddInstallationAnnotations(installation.ID, &cmodel.AddAnnotationsRequest{
+				Annotations: action.add,
+			})
+			if err != nil {
+				return errors.Wrap(err, "failed to add installation annotations")
+			}
+		}
+		for _, name := range action.remove {
+			err := client.DeleteInstallationAnnotation(installation.ID, name)
+			if err != nil {
+				return errors.Wrapf(err, "failed to remove installation annotation %s", name)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"testing"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanAnnotations(t *testing.T) {
+	installation := &cmodel.InstallationDTO{
+		Installation: &cmodel.Installation{ID: cmodel.NewID()},
+		Annotations:  []*cmodel.Annotation{{Name: "tier-trial"}, {Name: "owner-sales"}},
+	}
+
+	action := planAnnotations(installation, []string{"tier-trial", "scheduled"}, []string{"owner-sales", "missing"})
+	assert.Equal(t, []string{"scheduled"}, action.add)
+	assert.Equal(t, []string{"owner-sales"}, action.remove)
+	assert.Equal(t, []string{"scheduled", "tier-trial"}, action.annotations())
+
+	action = planAnnotations(installation, []string{"tier-trial"}, []string{"missing"})
+	assert.Empty(t, action.add)
+	assert.Empty(t, action.remove)
+}
+
+func TestValidateAnnotationChanges(t *testing.T) {
+	assert.NoError(t, validateAnnotationChanges([]string{"tier-trial"}, nil))
+	assert.NoError(t, validateAnnotationChanges(nil, []string{"tier-trial"}))
+	assert.Error(t, validateAnnotationChanges(nil, nil))
+	assert.Error(t, validateAnnotationChanges([]string{"Tier=Trial"}, nil))
+	assert.Error(t, validateAnnotationChanges([]string{"tier-trial"}, []string{"tier-trial"}))
+}
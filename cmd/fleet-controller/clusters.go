@@ -0,0 +1,197 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/metrics"
+	"github.com/mattermost/fleet-controller/model"
+)
+
+// defaultClusterBudget is the budget file key applied to clusters without
+// their own budget.
+const defaultClusterBudget = "*"
+
+// addClusterCapacityFlags adds the flags controlling cluster-aware scaling.
+func addClusterCapacityFlags(command *cobra.Command) {
+	command.PersistentFlags().String("cluster-utilization-query", "", "Optional Thanos query returning the current node utilization (0-1) of each cluster. Large scale ups are only made on clusters below the max utilization.")
+	command.PersistentFlags().String("cluster-utilization-label", "clusterID", "The label holding the cluster ID in the cluster utilization query results.")
+	command.PersistentFlags().Float64("cluster-max-utilization", 0.8, "The cluster utilization at or above which large scale ups are not made.")
+	command.PersistentFlags().String("cluster-budget-file", "", "Optional JSON file mapping cluster IDs to the maximum number of large scale ups per run. The \"*\" key applies to all other clusters.")
+	command.PersistentFlags().String("cluster-check-min-size", size5000users, "The smallest size that installations are scaled up to only when their cluster has capacity.")
+	command.PersistentFlags().Bool("cluster-flag-only", false, "Whether large scale ups without cluster capacity are made anyway and flagged in the report instead of being deferred.")
+	command.PersistentFlags().Int("max-scale-ups-per-cluster", 0, "The maximum number of scale ups on a single cluster in each batch. A value of 0 disables the limit.")
+}
+
+// clusterCapacity tracks the room clusters have for installations to be scaled
+// up to large sizes.
+type clusterCapacity struct {
+	utilizationQuery      string
+	utilizationLabel      string
+	maxUtilization        float64
+	budgets               map[string]int
+	minSize               string
+	flagOnly              bool
+	maxScaleUpsPerCluster int
+
+	installationClusters map[string][]string
+	utilization          map[string]float64
+	used                 map[string]int
+}
+
+func newClusterCapacity(command *cobra.Command) (*clusterCapacity, error) {
+	utilizationQuery, _ := command.Flags().GetString("cluster-utilization-query")
+	utilizationLabel, _ := command.Flags().GetString("cluster-utilization-label")
+	maxUtilization, _ := command.Flags().GetFloat64("cluster-max-utilization")
+	budgetFile, _ := command.Flags().GetString("cluster-budget-file")
+	minSize, _ := command.Flags().GetString("cluster-check-min-size")
+	flagOnly, _ := command.Flags().GetBool("cluster-flag-only")
+	maxScaleUpsPerCluster, _ := command.Flags().GetInt("max-scale-ups-per-cluster")
+
+	if _, err := getScaleValues(minSize); err != nil {
+		return nil, errors.Wrap(err, "invalid cluster-check-min-size")
+	}
+	if maxScaleUpsPerCluster < 0 {
+		return nil, errors.New("max-scale-ups-per-cluster must not be negative")
+	}
+
+	var budgets map[string]int
+	if len(budgetFile) != 0 {
+		var err error
+		budgets, err = loadClusterBudgets(budgetFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &clusterCapacity{
+		utilizationQuery:      utilizationQuery,
+		utilizationLabel:      utilizationLabel,
+		maxUtilization:        maxUtilization,
+		budgets:               budgets,
+		minSize:               minSize,
+		flagOnly:              flagOnly,
+		maxScaleUpsPerCluster: maxScaleUpsPerCluster,
+		used:                  make(map[string]int),
+	}, nil
+}
+
+func loadClusterBudgets(filename string) (map[string]int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read cluster budget file")
+	}
+
+	var budgets map[string]int
+	err = json.Unmarshal(data, &budgets)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse cluster budget file")
+	}
+	for cluster, budget := range budgets {
+		if budget < 0 {
+			return nil, errors.Errorf("cluster %s has a negative budget", cluster)
+		}
+	}
+
+	return budgets, nil
+}
+
+// checksCapacity returns whether cluster capacity is checked before large
+// scale ups.
+func (c *clusterCapacity) checksCapacity() bool {
+	return len(c.utilizationQuery) != 0 || c.budgets != nil
+}
+
+// enabled returns whether cluster information is needed at all.
+func (c *clusterCapacity) enabled() bool {
+	return c.checksCapacity() || c.maxScaleUpsPerCluster > 0
+}
+
+// refresh updates the cluster of each installation and the current cluster
+// utilization.
+func (c *clusterCapacity) refresh(ctx context.Context, client model.ProvisionerClient, tc *metrics.ThanosClient) error {
+	if !c.enabled() {
+		return nil
+	}
+
+	installationClusters, err := model.GetInstallationClusters(client)
+	if err != nil {
+		return err
+	}
+	c.installationClusters = installationClusters
+
+	if len(c.utilizationQuery) != 0 {
+		utilization, err := tc.GetCurrentValuesByLabel(ctx, c.utilizationQuery, c.utilizationLabel)
+		if err != nil {
+			return errors.Wrap(err, "failed to obtain cluster utilization")
+		}
+		c.utilization = utilization
+	}
+
+	return nil
+}
+
+// isLargeScaleUp returns whether scaling between the sizes needs cluster
+// capacity.
+func (c *clusterCapacity) isLargeScaleUp(fromSize, toSize string) bool {
+	return fromSize != toSize && scaleDictionary.isAtLeast(toSize, fromSize) && scaleDictionary.isAtLeast(toSize, c.minSize)
+}
+
+// cluster returns the cluster used to spread scale ups of an installation.
+func (c *clusterCapacity) cluster(installationID string) string {
+	clusters := c.installationClusters[installationID]
+	if len(clusters) == 0 {
+		return ""
+	}
+
+	return clusters[0]
+}
+
+// checkRoom returns an error if any cluster of the installation doesn't have
+// room for a large scale up.
+func (c *clusterCapacity) checkRoom(installationID string) error {
+	if !c.checksCapacity() {
+		return nil
+	}
+
+	for _, cluster := range c.installationClusters[installationID] {
+		if utilization, ok := c.utilization[cluster]; ok && utilization >= c.maxUtilization {
+			return errors.Errorf("cluster %s utilization of %.0f%% is at or above %.0f%%", cluster, utilization*100, c.maxUtilization*100)
+		}
+
+		budget, ok := c.budgets[cluster]
+		if !ok {
+			budget, ok = c.budgets[defaultClusterBudget]
+		}
+		if ok && c.used[cluster] >= budget {
+			return errors.Errorf("cluster %s scale up budget of %d is used up", cluster, budget)
+		}
+	}
+
+	return nil
+}
+
+// reserve counts a large scale up against the budgets of the installation
+// clusters.
+func (c *clusterCapacity) reserve(installationID string) {
+	for _, cluster := range c.installationClusters[installationID] {
+		c.used[cluster]++
+	}
+}
+
+// release returns a reservation for a large scale up that failed.
+func (c *clusterCapacity) release(installationID string) {
+	for _, cluster := range c.installationClusters[installationID] {
+		if c.used[cluster] > 0 {
+			c.used[cluster]--
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterCapacity(t *testing.T) {
+	capacity := &clusterCapacity{
+		utilizationQuery: "query",
+		maxUtilization:   0.8,
+		budgets:          map[string]int{"busy": 0, defaultClusterBudget: 1},
+		minSize:          size5000users,
+		used:             make(map[string]int),
+		installationClusters: map[string][]string{
+			"a": {"cluster1"},
+			"b": {"cluster1"},
+			"c": {"cluster2"},
+			"d": {"busy"},
+		},
+		utilization: map[string]float64{"cluster1": 0.5, "cluster2": 0.9},
+	}
+
+	t.Run("large scale up", func(t *testing.T) {
+		assert.True(t, capacity.isLargeScaleUp(size1000users, size5000users))
+		assert.True(t, capacity.isLargeScaleUp(size5000users, size25000users))
+		assert.False(t, capacity.isLargeScaleUp(cloud100users, size1000users))
+		assert.False(t, capacity.isLargeScaleUp(size10000users, size5000users))
+		assert.False(t, capacity.isLargeScaleUp(size5000users, size5000users))
+	})
+
+	t.Run("check room", func(t *testing.T) {
+		assert.NoError(t, capacity.checkRoom("a"))
+		capacity.reserve("a")
+		assert.Error(t, capacity.checkRoom("b"))
+		assert.Error(t, capacity.checkRoom("c"))
+		assert.Error(t, capacity.checkRoom("d"))
+		assert.NoError(t, capacity.checkRoom("unknown"))
+	})
+
+	t.Run("release", func(t *testing.T) {
+		capacity.release("a")
+		assert.NoError(t, capacity.checkRoom("b"))
+		capacity.release("a")
+		assert.Equal(t, 0, capacity.used["cluster1"])
+	})
+
+	t.Run("cluster", func(t *testing.T) {
+		assert.Equal(t, "cluster2", capacity.cluster("c"))
+		assert.Equal(t, "", capacity.cluster("unknown"))
+	})
+}
@@ -6,13 +6,16 @@ package main
 
 import (
 	"bufio"
-	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/journal"
 	"github.com/mattermost/fleet-controller/model"
 	cmodel "github.com/mattermost/mattermost-cloud/model"
 )
@@ -22,22 +25,28 @@ func init() {
 	deleteCmd.PersistentFlags().String("file", "installations.txt", "Location of file containing installation IDs to be deleted. File should contain only IDs separated by a newline.")
 	deleteCmd.PersistentFlags().Bool("dry-run", true, "Whether the autoscaler will perform scaling actions or just print actions that would be taken.")
 	deleteCmd.PersistentFlags().Bool("unlock", false, "Whether the autoscaler will unlock installations to update their size or not.")
+	deleteCmd.PersistentFlags().Int64("max-updating", 25, "The maximum number of installations that can be currently updating before deleting more.")
+	addExecutorFlags(deleteCmd, 3*time.Second, 3*time.Hour)
+	addVerificationFlags(deleteCmd, time.Hour)
+	addSelectorFlag(deleteCmd)
 }
 
 var deleteCmd = &cobra.Command{
 	Use:   "delete",
 	Short: "Delete hibernating installations",
-	RunE: func(command *cobra.Command, args []string) error {
+	RunE: forEachProvisioner(func(command *cobra.Command, args []string, settings *provisionerSettings) error {
 		command.SilenceUsage = true
+		ctx, cancel := newRunContext(command)
+		defer cancel()
 
 		productionLogs, _ := command.Flags().GetBool("production-logs")
-		logger := setupLogger("delete", productionLogs)
+		logger := setupLogger("delete", productionLogs, settings.name)
 
 		logger.Info("Starting installation deletion")
 
 		start := time.Now()
 
-		serverAddress, _ := command.Flags().GetString("server")
+		serverAddress := settings.server
 		file, _ := command.Flags().GetString("file")
 		dryrun, _ := command.Flags().GetBool("dry-run")
 		unlock, _ := command.Flags().GetBool("unlock")
@@ -45,8 +54,30 @@ var deleteCmd = &cobra.Command{
 		if len(serverAddress) == 0 {
 			return errors.New("server value must be defined")
 		}
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+
+		pricing, err := getPricingTable(command)
+		if err != nil {
+			return err
+		}
+		runJournal, err := newJournal(command, "delete", settings.name)
+		if err != nil {
+			return err
+		}
+
+		notifier, err := newProvisionerNotifier(command, settings)
+		if err != nil {
+			return err
+		}
 
-		client := cmodel.NewClient(serverAddress)
+		summary := newRunSummary("Deletion Report", "delete", dryrun)
+		summary.AddFilter("File", file)
+		summary.AddFilter("Selector", sel)
+
+		client := newProvisionerClient(settings)
 
 		installationIDs, err := readInInstallationIDs(file)
 		if err != nil {
@@ -55,68 +86,160 @@ var deleteCmd = &cobra.Command{
 
 		logger.Infof("Deleting %d installations", len(installationIDs))
 
-		var deletedInstallations []string
+		var installationsToDelete []*cmodel.InstallationDTO
+		var notFoundCount, notSelectedCount, skippedCount int
+		for _, installationID := range installationIDs {
+			err = runCancelled(ctx)
+			if err != nil {
+				return err
+			}
+			installation, err := client.GetInstallation(installationID, &cmodel.GetInstallationRequest{})
+			if err != nil {
+				return errors.Wrap(err, "failed to get installation")
+			}
+			if installation == nil {
+				logger.WithField("installation", installationID).Info("Could not find installation")
+				notFoundCount++
+				continue
+			}
+			if !sel.Match(installation) {
+				logger.WithField("installation", installation.ID).Debug("Installation not matched by selector")
+				notSelectedCount++
+				continue
+			}
+			err = ensureSafeToDelete(installation, unlock)
+			if err != nil {
+				logger.WithField("installation", installation.ID).WithError(err).Warn("Skipping installation deletion")
+				summary.AddError(installation.ID, err)
+				skippedCount++
+				continue
+			}
+
+			installationsToDelete = append(installationsToDelete, installation)
+			progress.planned(installation.ID, "delete", installation.State, cmodel.InstallationStateDeleted)
+		}
+
+		if dryrun {
+			for _, installation := range installationsToDelete {
+				logger.WithField("installation", installation.ID).Info("Installation would be deleted")
+			}
+			logger.Infof("Dry run complete; %d installations would be deleted", len(installationsToDelete))
+			return nil
+		}
+
+		leader, err := acquireRunLock(command, settings, cancel, logger)
+		if err != nil {
+			return err
+		}
+		defer leader.release(logger)
+
+		verify := newVerification(command)
+		exec, err := newExecutor(command, settings, client, logger)
+		if err != nil {
+			return err
+		}
+
+		var tasks []*executor.Task
+		for i, planned := range installationsToDelete {
+			i, planned := i, planned
+			tasks = append(tasks, &executor.Task{
+				InstallationID: planned.ID,
+				Run: func() error {
+					logger.WithField("installation", planned.ID).Infof("Deleting installation %d/%d", i+1, len(installationsToDelete))
 
-		timer := time.NewTimer(3 * time.Hour)
-		maxUpdating := int64(25)
-		var installationToDeleteIndex int
-		for {
-			if model.InstallationsUpdatingIsBelowMax(maxUpdating, client, logger) {
-				// Delete up to 5 installations at a time.
-				for i := 1; i <= 5 && installationToDeleteIndex < len(installationIDs); i++ {
-					installation, err := client.GetInstallation(installationIDs[installationToDeleteIndex], &cmodel.GetInstallationRequest{})
+					installation, err := refreshInstallation(planned.ID, client)
 					if err != nil {
-						return errors.Wrap(err, "failed to get installation")
-					}
-					if installation == nil {
-						logger.Info("Could not find installation")
-						installationToDeleteIndex++
-						continue
+						return err
 					}
 					err = ensureSafeToDelete(installation, unlock)
 					if err != nil {
-						logger.WithError(err).Warn("Skipping installation deletion")
-						installationToDeleteIndex++
-						continue
+						return errors.Wrap(err, "installation changed since deletion was planned")
 					}
 
-					logger.WithField("installation", installation.ID).Infof("Deleting installation %d/%d", installationToDeleteIndex+1, len(installationIDs))
-
-					if !dryrun {
-						err = deleteInstallation(installation, client)
-						if err != nil {
-							return errors.Wrap(err, "failed to delete installation")
-						}
-						deletedInstallations = append(deletedInstallations, installation.ID)
+					err = deleteInstallation(installation, client)
+					if err != nil {
+						return err
 					}
-					installationToDeleteIndex++
 
-					// Another sleep to slow the API calls to the provisioner.
-					time.Sleep(100 * time.Millisecond)
-				}
-			}
+					cost, _ := pricing.monthlyCost(installation.Size, true)
+					recordJournalEntry(runJournal, &journal.Entry{
+						InstallationID:    installation.ID,
+						Action:            "delete",
+						PreviousSize:      installation.Size,
+						PreviousState:     installation.State,
+						NewState:          cmodel.InstallationStateDeletionRequested,
+						MonthlyCostChange: -cost,
+						APISecurityLock:   installation.APISecurityLock,
+					}, logger)
+
+					return nil
+				},
+			})
+		}
 
-			if installationToDeleteIndex >= len(installationIDs) {
-				break
-			}
+		results, runErr := exec.Run(ctx, progress.trackTasks(leader.lockTasks(tasks)))
 
-			select {
-			case <-time.After(3 * time.Second):
-				continue
-			case <-timer.C:
-				return errors.Errorf("timed out after 3 hours trying to delete %d installations", len(installationIDs))
-			}
+		installationsByID := make(map[string]*cmodel.InstallationDTO, len(installationsToDelete))
+		for _, installation := range installationsToDelete {
+			installationsByID[installation.ID] = installation
 		}
 
-		runtime := fmt.Sprintf("%s", time.Now().Sub(start))
+		var deletedCount, failedCount int
+		var estimatedMonthlySavings float64
+		var expectations []*model.Expectation
+		for _, result := range results {
+			if result.Err != nil {
+				logger.WithField("installation", result.InstallationID).WithError(result.Err).Error("Failed to delete installation")
+				summary.AddError(result.InstallationID, result.Err)
+				failedCount++
+				continue
+			}
 
-		logger.WithField("runtime", runtime).Info("Instalaltion deletion complete")
+			installation := installationsByID[result.InstallationID]
+			cost, err := pricing.monthlyCost(installation.Size, true)
+			if err != nil {
+				logger.WithField("installation", installation.ID).WithError(err).Warn("Failed to estimate deletion savings")
+			}
+			estimatedMonthlySavings += cost
+			summary.AddChange(installation.ID, installation.State, cmodel.InstallationStateDeletionRequested)
+			expectations = append(expectations, verify.expect(installation.ID, result.FinishedAt, "", cmodel.InstallationStateDeletionFinalCleanup, cmodel.InstallationStateDeleted))
+			deletedCount++
+		}
+		if runErr != nil {
+			summary.AddError("", runErr)
+		}
+		verify.run(ctx, client, expectations, summary, logger)
+
+		summary.AddCount("Requested Installations", len(installationIDs))
+		summary.AddCount("Installations Deleted", deletedCount)
+		summary.AddCount("Installations Not Found", notFoundCount)
+		summary.AddCount("Installations Not Selected", notSelectedCount)
+		summary.AddCount("Installations Skipped", skippedCount)
+		summary.AddCount("Deletion Failures", failedCount)
+		verify.addCounts(summary)
+		summary.EstimatedMonthlyCostChange = -estimatedMonthlySavings
+		notifier.sendRunReport(ctx, summary, start, logger)
+
+		logger.WithFields(log.Fields{
+			"runtime":                   time.Since(start).String(),
+			"estimated-monthly-savings": estimatedMonthlySavings,
+		}).Info("Instalaltion deletion complete")
+
+		if runErr != nil {
+			return runErr
+		}
+		if failedCount != 0 {
+			return errors.Errorf("failed to delete %d of %d installations", failedCount, len(installationsToDelete))
+		}
+		if verify.failed != 0 {
+			return errors.Errorf("%d deleted installations failed verification", verify.failed)
+		}
 
 		return nil
-	},
+	}),
 }
 
-func deleteInstallation(installation *cmodel.InstallationDTO, client *cmodel.Client) error {
+func deleteInstallation(installation *cmodel.InstallationDTO, client model.ProvisionerClient) error {
 	var err error
 
 	if installation.APISecurityLock {
@@ -156,7 +279,11 @@ func readInInstallationIDs(filename string) ([]string, error) {
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		installationIDs = append(installationIDs, scanner.Text())
+		installationID := strings.TrimSpace(scanner.Text())
+		if len(installationID) == 0 {
+			continue
+		}
+		installationIDs = append(installationIDs, installationID)
 	}
 
 	err = scanner.Err()
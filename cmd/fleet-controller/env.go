@@ -0,0 +1,513 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/model"
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+)
+
+func init() {
+	envCmd.PersistentFlags().String("server", "http://localhost:8075", "The provisioning server whose API will be queried.")
+	envCmd.PersistentFlags().Bool("dry-run", true, "Whether the fleet controller will perform actions or just print the environment changes that would be made.")
+	envCmd.PersistentFlags().Bool("unlock", false, "Whether the fleet controller will unlock installations to patch them or not.")
+	envCmd.PersistentFlags().Int64("max-updating", 10, "The maximum number of installations that can be currently updating before patching more.")
+	envCmd.PersistentFlags().String("file", "", "JSON file of the environment variables to patch, e.g. {\"mattermostEnv\": {\"MM_FEATUREFLAGS_EXAMPLE\": {\"value\": \"true\"}, \"MM_REMOVED\": {}}}. Variables without a value are removed.")
+	envCmd.PersistentFlags().String("restore", "", "Rollback file of a previous env run to restore the prior environment variables of its installations from instead of applying a patch file.")
+	envCmd.PersistentFlags().String("rollback-file", "", "Where the prior values of patched environment variables are saved. Defaults to env-rollback-<run-id>.json in the journal directory or the current directory.")
+	addExecutorFlags(envCmd, 10*time.Second, 0)
+	addVerificationFlags(envCmd, 30*time.Minute)
+	addTargetFlags(envCmd)
+	addSelectorFlag(envCmd)
+
+	// Installation filters
+	envCmd.PersistentFlags().String("owner", "", "The owner ID value to filter installations by.")
+	envCmd.PersistentFlags().String("group", "", "The group ID value to filter installations by.")
+}
+
+// envPatchFile is the file format of environment variable patches.
+type envPatchFile struct {
+	MattermostEnv cmodel.EnvVarMap `json:"mattermostEnv"`
+	// PriorityEnv is rejected as the provisioning server API in use doesn't
+	// support it yet.
+	PriorityEnv cmodel.EnvVarMap `json:"priorityEnv,omitempty"`
+}
+
+// envRollbackFile holds the prior values of the environment variables patched
+// by a run. Variables that weren't set have no value so restoring removes them.
+type envRollbackFile struct {
+	RunID         string                      `json:"runID"`
+	Provisioner   string                      `json:"provisioner,omitempty"`
+	CreateAt      int64                       `json:"createAt"`
+	Installations map[string]cmodel.EnvVarMap `json:"installations"`
+}
+
+// envChange is a change to a single environment variable. Values can be
+// secrets, so changes are only described by the variable name and whether it
+// was set, changed or removed. Prior values are kept in the rollback file.
+type envChange struct {
+	name string
+	from *cmodel.EnvVar
+	to   *cmodel.EnvVar
+}
+
+func (c *envChange) String() string {
+	return fmt.Sprintf("%s %s", c.name, c.kind())
+}
+
+// kind returns whether the change sets, changes or removes the variable.
+func (c *envChange) kind() string {
+	switch {
+	case c.from == nil:
+		return "set"
+	case c.to == nil:
+		return "removed"
+	default:
+		return "changed"
+	}
+}
+
+type envAction struct {
+	installation *cmodel.InstallationDTO
+	changes      []*envChange
+}
+
+// envPatch returns the patch that makes the changes of the action. Variables
+// that are already up to date aren't sent, and only variables that exist are
+// removed.
+func (a *envAction) envPatch() cmodel.EnvVarMap {
+	patch := make(cmodel.EnvVarMap, len(a.changes))
+	for _, change := range a.changes {
+		if change.to == nil {
+			patch[change.name] = cmodel.EnvVar{}
+			continue
+		}
+		patch[change.name] = *change.to
+	}
+
+	return patch
+}
+
+var envCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Patch the environment variables of installations",
+	RunE: forEachProvisioner(func(command *cobra.Command, args []string, settings *provisionerSettings) error {
+		command.SilenceUsage = true
+		ctx, cancel := newRunContext(command)
+		defer cancel()
+
+		productionLogs, _ := command.Flags().GetBool("production-logs")
+		logger := setupLogger("env", productionLogs, settings.name)
+
+		logger.Info("Starting environment variable patching")
+
+		start := time.Now()
+
+		serverAddress := settings.server
+		dryrun, _ := command.Flags().GetBool("dry-run")
+		unlock, _ := command.Flags().GetBool("unlock")
+		file, _ := command.Flags().GetString("file")
+		restore, _ := command.Flags().GetString("restore")
+		rollbackFile, _ := command.Flags().GetString("rollback-file")
+		journalDir, _ := command.Flags().GetString("journal-dir")
+		owner, _ := command.Flags().GetString("owner")
+		group, _ := command.Flags().GetString("group")
+
+		if len(serverAddress) == 0 {
+			return errors.New("server value must be defined")
+		}
+		if (len(file) == 0) == (len(restore) == 0) {
+			return errors.New("exactly one of file or restore must be defined")
+		}
+
+		targets, err := newInstallationTargets(command)
+		if err != nil {
+			return err
+		}
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+
+		// patchFor returns the patch applied to an installation.
+		var patchFor func(installationID string) cmodel.EnvVarMap
+		if len(file) != 0 {
+			var patch cmodel.EnvVarMap
+			patch, err = readEnvPatchFile(file)
+			if err != nil {
+				return err
+			}
+			patchFor = func(string) cmodel.EnvVarMap { return patch }
+		} else {
+			var rollback *envRollbackFile
+			rollback, err = readEnvRollbackFile(restore)
+			if err != nil {
+				return err
+			}
+			if len(rollback.Provisioner) != 0 && rollback.Provisioner != settings.name {
+				logger.Infof("Rollback file is for provisioner %s; skipping...", rollback.Provisioner)
+				return nil
+			}
+			patchFor = func(installationID string) cmodel.EnvVarMap { return rollback.Installations[installationID] }
+			targets.ids = restoreTargets(rollback, targets)
+		}
+
+		runJournal, err := newJournal(command, "env", settings.name)
+		if err != nil {
+			return err
+		}
+
+		notifier, err := newProvisionerNotifier(command, settings)
+		if err != nil {
+			return err
+		}
+
+		summary := newRunSummary("Environment Patch Report", "env", dryrun)
+		summary.AddFilter("File", file)
+		summary.AddFilter("Restore", restore)
+		summary.AddFilter("Group ID", group)
+		summary.AddFilter("Owner ID", owner)
+		summary.AddFilter("Selector", sel)
+		targets.addFilters(summary)
+
+		client := newProvisionerClient(settings)
+
+		var installations []*cmodel.InstallationDTO
+		if targets.enabled() {
+			logger.Infof("Obtaining %d selected installations", len(targets.ids))
+			var missing []string
+			installations, missing, err = targets.getInstallations(ctx, client)
+			if err != nil {
+				return err
+			}
+			for _, id := range missing {
+				logger.WithField("installation", id).Warn("Could not find installation")
+				summary.AddError(id, errors.New("installation not found"))
+			}
+		} else if len(restore) == 0 {
+			logger.WithFields(log.Fields{
+				"owner-filter": owner,
+				"group-filter": group,
+			}).Info("Obtaining current installations")
+			installations, err = client.GetInstallations(&cmodel.GetInstallationsRequest{
+				State:                       cmodel.InstallationStateStable,
+				OwnerID:                     owner,
+				GroupID:                     group,
+				IncludeGroupConfig:          false,
+				IncludeGroupConfigOverrides: false,
+				Paging: cmodel.Paging{
+					Page:           0,
+					PerPage:        cmodel.AllPerPage,
+					IncludeDeleted: false,
+				},
+			})
+			if err != nil {
+				return errors.Wrap(err, "failed to get installations")
+			}
+		}
+		installations = sel.Filter(installations)
+
+		logger.Infof("Calculating environment changes on %d installations", len(installations))
+		var errorSkipCount, unchangedCount int
+		var actions []*envAction
+		for _, installation := range installations {
+			logger := logger.WithField("installation", installation.ID)
+
+			patch := patchFor(installation.ID)
+			changes := diffEnv(installation.MattermostEnv, patch)
+			if len(changes) == 0 {
+				logger.Debug("Installation environment is already up to date")
+				unchangedCount++
+				continue
+			}
+			err = canUpdate(installation, unlock)
+			if err != nil {
+				logger.WithError(err).Warn("Skipping installation environment patch")
+				summary.AddError(installation.ID, err)
+				errorSkipCount++
+				continue
+			}
+
+			var descriptions []string
+			for _, change := range changes {
+				logger.Infof("Environment change %s", change)
+				descriptions = append(descriptions, change.String())
+			}
+			actions = append(actions, &envAction{
+				installation: installation,
+				changes:      changes,
+			})
+			progress.planned(installation.ID, "env", "", strings.Join(descriptions, ", "))
+		}
+
+		logger.WithFields(log.Fields{
+			"patch-count":       len(actions),
+			"unchanged-count":   unchangedCount,
+			"patch-skip-errors": errorSkipCount,
+		}).Info("Environment calculations complete")
+
+		if len(actions) == 0 {
+			logger.Info("No installations require environment changes; exiting...")
+			return nil
+		}
+		if dryrun {
+			logger.Infof("Dry run complete; %d installations would be patched", len(actions))
+			return nil
+		}
+
+		leader, err := acquireRunLock(command, settings, cancel, logger)
+		if err != nil {
+			return err
+		}
+		defer leader.release(logger)
+
+		if len(rollbackFile) == 0 {
+			rollbackFile = defaultEnvRollbackFile(journalDir, settings.name)
+		}
+		err = writeEnvRollbackFile(rollbackFile, settings.name, actions)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Prior environment values saved to %s", rollbackFile)
+		summary.AddFilter("Rollback File", rollbackFile)
+
+		verify := newVerification(command)
+		exec, err := newExecutor(command, settings, client, logger)
+		if err != nil {
+			return err
+		}
+
+		var tasks []*executor.Task
+		actionsByID := make(map[string]*envAction, len(actions))
+		for i, action := range actions {
+			i, action := i, action
+			actionsByID[action.installation.ID] = action
+			tasks = append(tasks, &executor.Task{
+				InstallationID: action.installation.ID,
+				Run: func() error {
+					logger.WithField("installation", action.installation.ID).Infof("Patching installation environment %d/%d", i+1, len(actions))
+
+					err := patchInstallation(action.installation, &cmodel.PatchInstallationRequest{
+						MattermostEnv: action.envPatch(),
+					}, client)
+					if err != nil {
+						return err
+					}
+
+					recordJournalEntry(runJournal, &journal.Entry{
+						InstallationID:  action.installation.ID,
+						Action:          "env",
+						PreviousSize:    action.installation.Size,
+						NewSize:         action.installation.Size,
+						PreviousState:   action.installation.State,
+						NewState:        cmodel.InstallationStateUpdateRequested,
+						APISecurityLock: action.installation.APISecurityLock,
+					}, logger)
+
+					return nil
+				},
+			})
+		}
+
+		results, runErr := exec.Run(ctx, progress.trackTasks(leader.lockTasks(tasks)))
+
+		var patchedCount, failedCount int
+		var expectations []*model.Expectation
+		for _, result := range results {
+			if result.Err != nil {
+				logger.WithField("installation", result.InstallationID).WithError(result.Err).Error("Failed to patch installation environment")
+				summary.AddError(result.InstallationID, result.Err)
+				failedCount++
+				continue
+			}
+
+			for _, change := range actionsByID[result.InstallationID].changes {
+				summary.AddChange(result.InstallationID, fmt.Sprintf("%s (%s)", change.name, describeEnvVar(change.from)), fmt.Sprintf("%s (%s)", change.name, change.kind()))
+			}
+			expectations = append(expectations, verify.expect(result.InstallationID, result.FinishedAt, "", cmodel.InstallationStateStable))
+			patchedCount++
+		}
+		if runErr != nil {
+			summary.AddError("", runErr)
+		}
+		verify.run(ctx, client, expectations, summary, logger)
+
+		summary.AddCount("Selected Installations", len(installations))
+		summary.AddCount("Installations Patched", patchedCount)
+		summary.AddCount("Installations Unchanged", unchangedCount)
+		summary.AddCount("Patch Skip Errors", errorSkipCount)
+		summary.AddCount("Patch Failures", failedCount)
+		verify.addCounts(summary)
+		notifier.sendRunReport(ctx, summary, start, logger)
+
+		logger.WithField("runtime", summary.Runtime).Info("Environment patching complete")
+
+		if runErr != nil {
+			return runErr
+		}
+		if failedCount != 0 {
+			return errors.Errorf("failed to patch %d of %d installations", failedCount, len(actions))
+		}
+		if verify.failed != 0 {
+			return errors.Errorf("%d patched installations failed verification", verify.failed)
+		}
+
+		return nil
+	}),
+}
+
+func readEnvPatchFile(filename string) (cmodel.EnvVarMap, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read env patch file")
+	}
+	var patch envPatchFile
+	err = json.Unmarshal(data, &patch)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse env patch file")
+	}
+
+	if len(patch.PriorityEnv) != 0 {
+		return nil, errors.New("priorityEnv patches aren't supported by the provisioning server API in use")
+	}
+	if len(patch.MattermostEnv) == 0 {
+		return nil, errors.New("env patch file contains no mattermostEnv variables")
+	}
+
+	return patch.MattermostEnv, nil
+}
+
+func readEnvRollbackFile(filename string) (*envRollbackFile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read env rollback file")
+	}
+	var rollback envRollbackFile
+	err = json.Unmarshal(data, &rollback)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse env rollback file")
+	}
+	if len(rollback.Installations) == 0 {
+		return nil, errors.New("env rollback file contains no installations")
+	}
+
+	return &rollback, nil
+}
+
+// restoreTargets returns the installations of a rollback file to restore,
+// narrowed to the installations selected by ID when there are any.
+func restoreTargets(rollback *envRollbackFile, targets *installationTargets) []string {
+	selected := make(map[string]bool)
+	for _, id := range targets.ids {
+		selected[id] = true
+	}
+
+	var ids []string
+	for id := range rollback.Installations {
+		if targets.enabled() && !selected[id] {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func defaultEnvRollbackFile(journalDir, provisioner string) string {
+	name := fmt.Sprintf("env-rollback-%s", runID)
+	if len(provisioner) != 0 {
+		name += "-" + provisioner
+	}
+
+	return filepath.Join(journalDir, name+".json")
+}
+
+// writeEnvRollbackFile saves the prior values of the variables changed by the
+// actions. It is written before any installation is patched.
+func writeEnvRollbackFile(filename, provisioner string, actions []*envAction) error {
+	rollback := &envRollbackFile{
+		RunID:         runID,
+		Provisioner:   provisioner,
+		CreateAt:      time.Now().UnixNano() / int64(time.Millisecond),
+		Installations: make(map[string]cmodel.EnvVarMap, len(actions)),
+	}
+	for _, action := range actions {
+		prior := make(cmodel.EnvVarMap, len(action.changes))
+		for _, change := range action.changes {
+			if change.from == nil {
+				prior[change.name] = cmodel.EnvVar{}
+				continue
+			}
+			prior[change.name] = *change.from
+		}
+		rollback.Installations[action.installation.ID] = prior
+	}
+
+	data, err := json.MarshalIndent(rollback, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode env rollback file")
+	}
+	err = ioutil.WriteFile(filename, data, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to write env rollback file")
+	}
+
+	return nil
+}
+
+// diffEnv returns the changes a patch makes to an environment. Variables in
+// the patch without a value are removed.
+func diffEnv(current, patch cmodel.EnvVarMap) []*envChange {
+	var changes []*envChange
+	for name, value := range patch {
+		value := value
+		existing, exists := current[name]
+		if !value.HasValue() {
+			if exists {
+				changes = append(changes, &envChange{name: name, from: &existing})
+			}
+			continue
+		}
+		if exists && reflect.DeepEqual(existing, value) {
+			continue
+		}
+
+		change := &envChange{name: name, to: &value}
+		if exists {
+			change.from = &existing
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].name < changes[j].name
+	})
+
+	return changes
+}
+
+// describeEnvVar describes whether a variable is set without its value.
+func describeEnvVar(env *cmodel.EnvVar) string {
+	if env == nil || !env.HasValue() {
+		return "unset"
+	}
+
+	return "set"
+}
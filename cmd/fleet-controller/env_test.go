@@ -0,0 +1,95 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffEnv(t *testing.T) {
+	current := cmodel.EnvVarMap{
+		"MM_SAME":    {Value: "1"},
+		"MM_CHANGED": {Value: "old"},
+		"MM_REMOVED": {Value: "gone"},
+	}
+	patch := cmodel.EnvVarMap{
+		"MM_SAME":    {Value: "1"},
+		"MM_CHANGED": {Value: "new"},
+		"MM_REMOVED": {},
+		"MM_ADDED":   {Value: "added"},
+		"MM_MISSING": {},
+	}
+
+	changes := diffEnv(current, patch)
+	require.Len(t, changes, 3)
+	assert.Equal(t, "MM_ADDED set", changes[0].String())
+	assert.Equal(t, "MM_CHANGED changed", changes[1].String())
+	assert.Equal(t, "MM_REMOVED removed", changes[2].String())
+
+	assert.Empty(t, diffEnv(current, cmodel.EnvVarMap{"MM_SAME": {Value: "1"}}))
+	assert.Len(t, diffEnv(nil, patch), 3)
+
+	action := &envAction{changes: changes}
+	assert.Equal(t, cmodel.EnvVarMap{
+		"MM_ADDED":   {Value: "added"},
+		"MM_CHANGED": {Value: "new"},
+		"MM_REMOVED": {},
+	}, action.envPatch())
+}
+
+func TestEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("patch file", func(t *testing.T) {
+		file := filepath.Join(dir, "patch.json")
+		require.NoError(t, ioutil.WriteFile(file, []byte(`{"mattermostEnv": {"MM_A": {"value": "true"}, "MM_B": {}}}`), 0600))
+		patch, err := readEnvPatchFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, cmodel.EnvVarMap{"MM_A": {Value: "true"}, "MM_B": {}}, patch)
+	})
+
+	t.Run("priority env patch file", func(t *testing.T) {
+		file := filepath.Join(dir, "priority.json")
+		require.NoError(t, ioutil.WriteFile(file, []byte(`{"priorityEnv": {"MM_A": {"value": "true"}}}`), 0600))
+		_, err := readEnvPatchFile(file)
+		assert.Error(t, err)
+	})
+
+	t.Run("rollback file", func(t *testing.T) {
+		file := filepath.Join(dir, "rollback.json")
+		previous := cmodel.EnvVar{Value: "old"}
+		actions := []*envAction{
+			{
+				installation: &cmodel.InstallationDTO{Installation: &cmodel.Installation{ID: "id1"}},
+				changes: []*envChange{
+					{name: "MM_ADDED", to: &cmodel.EnvVar{Value: "new"}},
+					{name: "MM_CHANGED", from: &previous, to: &cmodel.EnvVar{Value: "new"}},
+				},
+			},
+			{
+				installation: &cmodel.InstallationDTO{Installation: &cmodel.Installation{ID: "id2"}},
+				changes:      []*envChange{{name: "MM_REMOVED", from: &previous}},
+			},
+		}
+		require.NoError(t, writeEnvRollbackFile(file, "us-east", actions))
+
+		rollback, err := readEnvRollbackFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, "us-east", rollback.Provisioner)
+		assert.Equal(t, map[string]cmodel.EnvVarMap{
+			"id1": {"MM_ADDED": {}, "MM_CHANGED": {Value: "old"}},
+			"id2": {"MM_REMOVED": {Value: "old"}},
+		}, rollback.Installations)
+
+		assert.Equal(t, []string{"id1", "id2"}, restoreTargets(rollback, &installationTargets{}))
+		assert.Equal(t, []string{"id2"}, restoreTargets(rollback, &installationTargets{ids: []string{"id2", "id3"}}))
+	})
+}
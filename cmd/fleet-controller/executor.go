@@ -0,0 +1,137 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/model"
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+)
+
+// addExecutorFlags adds the flags controlling how actions are run against the
+// provisioning server along with the command defaults for how often the
+// provisioner is polled and how long the run may take.
+func addExecutorFlags(command *cobra.Command, pollInterval, runTimeout time.Duration) {
+	command.PersistentFlags().Int("workers", 5, "The maximum number of installation actions to run concurrently, which is the size of each batch of actions. Concurrency is reduced automatically when the provisioner is busy or actions start failing.")
+	command.PersistentFlags().Int("min-workers", 1, "The minimum number of installation actions to run concurrently.")
+	command.PersistentFlags().Int64("max-updating-per-cluster", 0, "The maximum number of installations that can be updating on a single cluster before acting on more installations there. A value of 0 disables the limit.")
+	command.PersistentFlags().Int64("max-updating-per-group", 0, "The maximum number of installations that can be updating in a single installation group before acting on more installations in it. A value of 0 disables the limit.")
+	command.PersistentFlags().Float64("rate-limit", 10, "The maximum number of provisioning server API calls per second. A value of 0 disables rate limiting.")
+	command.PersistentFlags().Duration("poll-interval", pollInterval, "How often the number of updating installations is checked while actions are held back.")
+	command.PersistentFlags().Duration("action-timeout", 5*time.Minute, "How long a single installation action may take before it is reported as timed out. A timed out action keeps its worker and installation lock until it returns. A value of 0 disables the timeout.")
+	command.PersistentFlags().Duration("run-timeout", runTimeout, "How long the whole run may take. Once reached, no new actions are started and a report of what completed is sent. A value of 0 disables the timeout.")
+}
+
+// newProvisionerClient returns a rate-limited client for the provisioning
+// server.
+func newProvisionerClient(settings *provisionerSettings) model.ProvisionerClient {
+	return model.NewRateLimitedClient(cmodel.NewClient(settings.server), settings.rateLimit, int(settings.rateLimit)+1)
+}
+
+// newExecutor returns an executor that holds back new actions while the
+// provisioner's max-updating or more installations are updating on it.
+func newExecutor(command *cobra.Command, settings *provisionerSettings, client model.ProvisionerClient, logger log.FieldLogger) (*executor.Executor, error) {
+	workers := settings.workers
+	minWorkers, _ := command.Flags().GetInt("min-workers")
+	maxUpdating := settings.maxUpdating
+	maxUpdatingPerCluster := settings.maxUpdatingPerCluster
+	maxUpdatingPerGroup := settings.maxUpdatingPerGroup
+	pollInterval, _ := command.Flags().GetDuration("poll-interval")
+	actionTimeout, _ := command.Flags().GetDuration("action-timeout")
+
+	if workers < 1 {
+		return nil, errors.New("workers must be at least 1")
+	}
+	if minWorkers < 1 || minWorkers > workers {
+		return nil, errors.Errorf("min-workers must be between 1 and %d", workers)
+	}
+	if maxUpdating < 1 {
+		return nil, errors.New("max-updating must be at least 1")
+	}
+
+	if maxUpdatingPerCluster < 0 || maxUpdatingPerGroup < 0 {
+		return nil, errors.New("per-cluster and per-group updating limits must not be negative")
+	}
+	if pollInterval <= 0 {
+		return nil, errors.New("poll-interval must be greater than 0")
+	}
+	if actionTimeout < 0 {
+		return nil, errors.New("action-timeout must not be negative")
+	}
+
+	perKey := maxUpdatingPerCluster > 0 || maxUpdatingPerGroup > 0
+	status := func() (*executor.Status, error) {
+		return getProvisionerStatus(client, perKey)
+	}
+
+	return executor.New(executor.Config{
+		MinWorkers:            minWorkers,
+		MaxWorkers:            workers,
+		MaxUpdating:           maxUpdating,
+		MaxUpdatingPerCluster: maxUpdatingPerCluster,
+		MaxUpdatingPerGroup:   maxUpdatingPerGroup,
+		PollInterval:          pollInterval,
+		TaskTimeout:           actionTimeout,
+	}, status, logger), nil
+}
+
+// getProvisionerStatus returns the number of installations updating on the
+// provisioning server. When perKey is set, the installations updating on each
+// cluster and in each group are counted from the installation list and cluster
+// installation mappings.
+func getProvisionerStatus(client model.ProvisionerClient, perKey bool) (*executor.Status, error) {
+	installationsStatus, err := client.GetInstallationsStatus()
+	if err != nil {
+		return nil, err
+	}
+	status := &executor.Status{Updating: installationsStatus.InstallationsUpdating}
+	if !perKey {
+		return status, nil
+	}
+
+	installations, err := client.GetInstallations(&cmodel.GetInstallationsRequest{
+		Paging: cmodel.Paging{
+			Page:           0,
+			PerPage:        cmodel.AllPerPage,
+			IncludeDeleted: false,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get installations")
+	}
+	installationClusters, err := model.GetInstallationClusters(client)
+	if err != nil {
+		return nil, err
+	}
+
+	status.UpdatingByCluster = make(map[string]int64)
+	status.UpdatingByGroup = make(map[string]int64)
+	status.InstallationClusters = installationClusters
+	status.InstallationGroups = make(map[string]string)
+	for _, installation := range installations {
+		var group string
+		if installation.GroupID != nil {
+			group = *installation.GroupID
+			status.InstallationGroups[installation.ID] = group
+		}
+		if !model.IsUpdatingState(installation.State) {
+			continue
+		}
+		for _, cluster := range installationClusters[installation.ID] {
+			status.UpdatingByCluster[cluster]++
+		}
+		if len(group) != 0 {
+			status.UpdatingByGroup[group]++
+		}
+	}
+
+	return status, nil
+}
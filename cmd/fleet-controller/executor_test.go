@@ -0,0 +1,66 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"testing"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/fleet-controller/model"
+)
+
+type mockStatusClient struct {
+	model.ProvisionerClient
+	installations        []*cmodel.InstallationDTO
+	clusterInstallations []*cmodel.ClusterInstallation
+}
+
+func (c *mockStatusClient) GetInstallationsStatus() (*cmodel.InstallationsStatus, error) {
+	return &cmodel.InstallationsStatus{InstallationsUpdating: 3}, nil
+}
+
+func (c *mockStatusClient) GetInstallations(request *cmodel.GetInstallationsRequest) ([]*cmodel.InstallationDTO, error) {
+	return c.installations, nil
+}
+
+func (c *mockStatusClient) GetClusterInstallations(request *cmodel.GetClusterInstallationsRequest) ([]*cmodel.ClusterInstallation, error) {
+	return c.clusterInstallations, nil
+}
+
+func TestGetProvisionerStatus(t *testing.T) {
+	group := "group1"
+	newInstallation := func(id, state string, groupID *string) *cmodel.InstallationDTO {
+		return &cmodel.InstallationDTO{Installation: &cmodel.Installation{ID: id, State: state, GroupID: groupID}}
+	}
+	client := &mockStatusClient{
+		installations: []*cmodel.InstallationDTO{
+			newInstallation("a", cmodel.InstallationStateUpdateInProgress, &group),
+			newInstallation("b", cmodel.InstallationStateHibernationRequested, nil),
+			newInstallation("c", cmodel.InstallationStateStable, &group),
+			newInstallation("d", cmodel.InstallationStateUpdateFailed, nil),
+		},
+		clusterInstallations: []*cmodel.ClusterInstallation{
+			{ClusterID: "cluster1", InstallationID: "a"},
+			{ClusterID: "cluster1", InstallationID: "b"},
+			{ClusterID: "cluster2", InstallationID: "c"},
+			{ClusterID: "cluster2", InstallationID: "d"},
+		},
+	}
+
+	status, err := getProvisionerStatus(client, false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), status.Updating)
+	assert.Nil(t, status.UpdatingByCluster)
+
+	status, err = getProvisionerStatus(client, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"cluster1": 2}, status.UpdatingByCluster)
+	assert.Equal(t, map[string]int64{"group1": 1}, status.UpdatingByGroup)
+	assert.Equal(t, "group1", status.InstallationGroups["c"])
+	assert.Equal(t, []string{"cluster2"}, status.InstallationClusters["d"])
+}
@@ -5,13 +5,15 @@
 package main
 
 import (
+	"context"
 	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
-	"github.com/mattermost/fleet-controller/internal/metrics"
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/journal"
 	"github.com/mattermost/fleet-controller/model"
 	cmodel "github.com/mattermost/mattermost-cloud/model"
 )
@@ -23,6 +25,12 @@ func init() {
 	hibernate.PersistentFlags().Bool("unlock", false, "Whether the autoscaler will unlock installations to update their size or not.")
 	hibernate.PersistentFlags().Int("days", 7, "The number of days back to check if an installation has received new posts since.")
 	hibernate.PersistentFlags().Int("max-users", 100, "The number of users where the installation won't be hibernated regardless of activity.")
+	hibernate.PersistentFlags().Int64("max-updating", 25, "The maximum number of installations that can be currently updating before hibernating more.")
+	addExecutorFlags(hibernate, 10*time.Second, 3*time.Hour)
+	addVerificationFlags(hibernate, 30*time.Minute)
+	addTargetFlags(hibernate)
+	addForceFlags(hibernate)
+	addSelectorFlag(hibernate)
 
 	// Installation filters
 	hibernate.PersistentFlags().String("owner", "", "The owner ID value to filter installations by.")
@@ -32,70 +40,132 @@ func init() {
 var hibernate = &cobra.Command{
 	Use:   "hibernate",
 	Short: "Hibernate installations based on activity metrics",
-	RunE: func(command *cobra.Command, args []string) error {
+	RunE: forEachProvisioner(func(command *cobra.Command, args []string, settings *provisionerSettings) error {
 		command.SilenceUsage = true
+		ctx, cancel := newRunContext(command)
+		defer cancel()
 
 		productionLogs, _ := command.Flags().GetBool("production-logs")
-		logger := setupLogger("hibernate", productionLogs)
+		logger := setupLogger("hibernate", productionLogs, settings.name)
 
 		logger.Info("Starting installation hibernator")
 
 		start := time.Now()
 
-		serverAddress, _ := command.Flags().GetString("server")
-		thanosURL, _ := command.Flags().GetString("thanos-url")
+		serverAddress := settings.server
+		thanosURL := settings.thanosURL
 		dryrun, _ := command.Flags().GetBool("dry-run")
 		unlock, _ := command.Flags().GetBool("unlock")
 		days, _ := command.Flags().GetInt("days")
 		maxUsers, _ := command.Flags().GetInt("max-users")
 		owner, _ := command.Flags().GetString("owner")
 		group, _ := command.Flags().GetString("group")
-		webhookURL, _ := command.Flags().GetString("mm-webhook-url")
 
 		if len(serverAddress) == 0 {
 			return errors.New("server value must be defined")
 		}
-		if len(thanosURL) == 0 {
+
+		targets, err := newInstallationTargets(command)
+		if err != nil {
+			return err
+		}
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+		if len(thanosURL) == 0 && !targets.force {
 			return errors.New("thanos-url value must be defined")
 		}
 
-		client := cmodel.NewClient(serverAddress)
+		pricing, err := getPricingTable(command)
+		if err != nil {
+			return err
+		}
+		runJournal, err := newJournal(command, "hibernate", settings.name)
+		if err != nil {
+			return err
+		}
 
-		logger.WithFields(log.Fields{
-			"owner-filter": owner,
-			"group-filter": group,
-		}).Info("Obtaining current installations")
-		installations, err := client.GetInstallations(&cmodel.GetInstallationsRequest{
-			State:                       cmodel.InstallationStateStable,
-			OwnerID:                     owner,
-			GroupID:                     group,
-			IncludeGroupConfig:          false,
-			IncludeGroupConfigOverrides: false,
-			Paging: cmodel.Paging{
-				Page:           0,
-				PerPage:        cmodel.AllPerPage,
-				IncludeDeleted: false,
-			},
-		})
+		notifier, err := newProvisionerNotifier(command, settings)
 		if err != nil {
-			return errors.Wrap(err, "failed to get installations")
+			return err
 		}
 
-		tc := metrics.NewThanosClient(thanosURL)
+		summary := newRunSummary("Hibernation Report", "hibernate", dryrun)
+		summary.AddFilter("Days", days)
+		summary.AddFilter("Max Users", maxUsers)
+		summary.AddFilter("Group ID", group)
+		summary.AddFilter("Owner ID", owner)
+		summary.AddFilter("Selector", sel)
+		targets.addFilters(summary)
+
+		client := newProvisionerClient(settings)
+
+		var installations []*cmodel.InstallationDTO
+		if targets.enabled() {
+			logger.Infof("Obtaining %d selected installations", len(targets.ids))
+			var missing []string
+			installations, missing, err = targets.getInstallations(ctx, client)
+			if err != nil {
+				return err
+			}
+			for _, id := range missing {
+				logger.WithField("installation", id).Warn("Could not find installation")
+				summary.AddError(id, errors.New("installation not found"))
+			}
+		} else {
+			logger.WithFields(log.Fields{
+				"owner-filter": owner,
+				"group-filter": group,
+			}).Info("Obtaining current installations")
+			installations, err = client.GetInstallations(&cmodel.GetInstallationsRequest{
+				State:                       cmodel.InstallationStateStable,
+				OwnerID:                     owner,
+				GroupID:                     group,
+				IncludeGroupConfig:          false,
+				IncludeGroupConfigOverrides: false,
+				Paging: cmodel.Paging{
+					Page:           0,
+					PerPage:        cmodel.AllPerPage,
+					IncludeDeleted: false,
+				},
+			})
+			if err != nil {
+				return errors.Wrap(err, "failed to get installations")
+			}
+		}
+		installations = sel.Filter(installations)
 
-		logger.Info("Gathering installation user metrics")
-		userMetrics, err := tc.GetInstallationUserMetrics()
-		if err != nil {
-			return errors.Wrap(err, "failed to obtain installation metrics")
+		var tc metricsClient
+		var userMetrics map[string]int64
+		if !targets.force {
+			thanos, err := newThanosClient(command, thanosURL)
+			if err != nil {
+				return err
+			}
+			defer logMetricsCacheStats(thanos, logger)
+			tc = thanos
+
+			logger.Info("Gathering installation user metrics")
+			userMetrics, err = tc.GetInstallationUserMetrics(ctx)
+			if err != nil {
+				return errors.Wrap(err, "failed to obtain installation metrics")
+			}
+		} else {
+			logger.WithField("reason", targets.reason).Warn("Forcing hibernation; skipping activity policy checks")
 		}
 
 		logger.Infof("Calculating hibernate actions on %d stable installations", len(installations))
 		var errorSkipCount, maxUserSkipCount int
-		var hibernateCalculationErrors []string
 		var installationsToHibernate []*cmodel.InstallationDTO
 		creationTimestampCutoff := (time.Now().UnixNano() / int64(time.Millisecond)) - (int64(days) * 24 * int64(time.Hour/time.Millisecond))
 
 		for i, installation := range installations {
+			err = runCancelled(ctx)
+			if err != nil {
+				return err
+			}
+
 			current := i + 1
 			if current%10 == 0 {
 				logger.Debugf("Processing installation %d of %d", current, len(installations))
@@ -103,23 +173,30 @@ var hibernate = &cobra.Command{
 
 			logger := logger.WithField("installation", installation.ID)
 
-			shouldHibernate, err := shouldHibernate(installation, userMetrics, tc, unlock, days, maxUsers, creationTimestampCutoff, logger)
-			if shouldHibernate && err != nil {
+			var hibernatable bool
+			if targets.force {
+				err = canHibernate(installation, unlock)
+				hibernatable = err == nil
+			} else {
+				hibernatable, err = shouldHibernate(ctx, installation, userMetrics, tc, unlock, days, maxUsers, creationTimestampCutoff, logger)
+			}
+			if hibernatable && err != nil {
 				logger.WithField("reason", err.Error()).Info("Skipping valid hibernation target")
 				maxUserSkipCount++
 				continue
 			}
 			if err != nil {
 				logger.WithError(err).Warn("Failed hibernation determination")
-				hibernateCalculationErrors = append(hibernateCalculationErrors, errors.Wrapf(err, " - `%s`", installation.ID).Error())
+				summary.AddError(installation.ID, err)
 				errorSkipCount++
 				continue
 			}
-			if !shouldHibernate {
+			if !hibernatable {
 				continue
 			}
 
 			installationsToHibernate = append(installationsToHibernate, installation)
+			progress.planned(installation.ID, "hibernate", installation.State, cmodel.InstallationStateHibernating)
 		}
 
 		logger.WithFields(log.Fields{
@@ -133,89 +210,141 @@ var hibernate = &cobra.Command{
 			return nil
 		}
 
-		logger.Infof("Hibernating %d installations", len(installationsToHibernate))
+		var estimatedMonthlyCostChange float64
+		for _, installation := range installationsToHibernate {
+			change, err := pricing.monthlyCostChange(installation.Size, false, installation.Size, true)
+			if err != nil {
+				logger.WithField("installation", installation.ID).WithError(err).Warn("Failed to estimate hibernation savings")
+				continue
+			}
+			estimatedMonthlyCostChange += change
+		}
+
+		logger.WithField("estimated-monthly-cost-change", estimatedMonthlyCostChange).Infof("Hibernating %d installations", len(installationsToHibernate))
 		if dryrun {
 			logger.Info("Dry run complete")
 			return nil
 		}
 
-		timer := time.NewTimer(3 * time.Hour)
-		maxUpdating := int64(25)
-		var installationToHibernateIndex int
-		for {
-			if model.InstallationsUpdatingIsBelowMax(maxUpdating, client, logger) {
-				// Hibernate up to 5 installations at a time.
-				for i := 1; i <= 5 && installationToHibernateIndex < len(installationsToHibernate); i++ {
-					installation := installationsToHibernate[installationToHibernateIndex]
-					logger.WithField("installation", installation.ID).Infof("Hibernating installation %d/%d", installationToHibernateIndex+1, len(installationsToHibernate))
+		leader, err := acquireRunLock(command, settings, cancel, logger)
+		if err != nil {
+			return err
+		}
+		defer leader.release(logger)
 
-					err = hibernateInstallation(installation, client)
+		verify := newVerification(command)
+		exec, err := newExecutor(command, settings, client, logger)
+		if err != nil {
+			return err
+		}
+
+		var tasks []*executor.Task
+		for i, planned := range installationsToHibernate {
+			i, planned := i, planned
+			tasks = append(tasks, &executor.Task{
+				InstallationID: planned.ID,
+				Run: func() error {
+					logger.WithField("installation", planned.ID).Infof("Hibernating installation %d/%d", i+1, len(installationsToHibernate))
+
+					installation, err := refreshInstallation(planned.ID, client)
 					if err != nil {
-						return errors.Wrap(err, "failed to hibernate installation")
+						return err
+					}
+					err = canHibernate(installation, unlock)
+					if err != nil {
+						return errors.Wrap(err, "installation changed since hibernation was planned")
 					}
 
-					installationToHibernateIndex++
+					err = hibernateInstallation(installation, client)
+					if err != nil {
+						return err
+					}
 
-					// Another sleep to slow the API calls to the provisioner.
-					time.Sleep(100 * time.Millisecond)
-				}
-			}
+					change, _ := pricing.monthlyCostChange(installation.Size, false, installation.Size, true)
+					recordJournalEntry(runJournal, &journal.Entry{
+						InstallationID:    installation.ID,
+						Action:            "hibernate",
+						PreviousSize:      installation.Size,
+						NewSize:           installation.Size,
+						PreviousState:     installation.State,
+						NewState:          cmodel.InstallationStateHibernating,
+						MonthlyCostChange: change,
+						APISecurityLock:   installation.APISecurityLock,
+					}, logger)
+
+					return nil
+				},
+			})
+		}
 
-			if installationToHibernateIndex >= len(installationsToHibernate) {
-				break
-			}
+		results, runErr := exec.Run(ctx, progress.trackTasks(leader.lockTasks(tasks)))
 
-			select {
-			case <-time.After(10 * time.Second):
+		var hibernatedCount, failedCount int
+		var expectations []*model.Expectation
+		for _, result := range results {
+			if result.Err != nil {
+				logger.WithField("installation", result.InstallationID).WithError(result.Err).Error("Failed to hibernate installation")
+				summary.AddError(result.InstallationID, result.Err)
+				failedCount++
 				continue
-			case <-timer.C:
-				return errors.Errorf("timed out after 3 hours trying to hibernate %d installations", len(installations))
 			}
+			summary.AddChange(result.InstallationID, cmodel.InstallationStateStable, cmodel.InstallationStateHibernating)
+			expectations = append(expectations, verify.expect(result.InstallationID, result.FinishedAt, "", cmodel.InstallationStateHibernating))
+			hibernatedCount++
 		}
-
-		runtime := time.Since(start).Round(time.Second).String()
-
-		if len(webhookURL) != 0 {
-			logger.Info("Sending hibernation report webhook")
-
-			err = sendHibernateWebhook(webhookURL,
-				runID, runtime, group, owner, days, maxUsers,
-				len(installations), len(installationsToHibernate),
-				maxUserSkipCount, errorSkipCount, hibernateCalculationErrors,
-			)
-			if err != nil {
-				logger.WithError(err).Error("Failed to send Mattermost webhook")
-			}
+		if runErr != nil {
+			summary.AddError("", runErr)
 		}
+		verify.run(ctx, client, expectations, summary, logger)
 
-		logger.WithField("runtime", runtime).Info("Hibernation check complete")
+		if targets.enabled() {
+			summary.AddCount("Selected Installations", len(targets.ids))
+		} else {
+			summary.AddCount("Original Stable Installations", len(installations))
+		}
+		summary.AddCount("Installations Hibernated", hibernatedCount)
+		summary.AddCount("Installations Skipped (User Count)", maxUserSkipCount)
+		summary.AddCount("Hibernation Calculation Errors", errorSkipCount)
+		summary.AddCount("Hibernation Failures", failedCount)
+		verify.addCounts(summary)
+		summary.EstimatedMonthlyCostChange = estimatedMonthlyCostChange
+		notifier.sendRunReport(ctx, summary, start, logger)
+
+		logger.WithField("runtime", summary.Runtime).Info("Hibernation check complete")
+
+		if runErr != nil {
+			return runErr
+		}
+		if failedCount != 0 {
+			return errors.Errorf("failed to hibernate %d of %d installations", failedCount, len(installationsToHibernate))
+		}
+		if verify.failed != 0 {
+			return errors.Errorf("%d hibernated installations failed verification", verify.failed)
+		}
 
 		return nil
-	},
+	}),
 }
 
-func hibernateInstallation(installation *cmodel.InstallationDTO, client *cmodel.Client) error {
-	var relock bool
-	var err error
-
-	if installation.APISecurityLock {
-		err = client.UnlockAPIForInstallation(installation.ID)
+func hibernateInstallation(installation *cmodel.InstallationDTO, client model.ProvisionerClient) error {
+	return withUnlockedAPI(installation, client, func() error {
+		_, err := client.HibernateInstallation(installation.ID)
 		if err != nil {
-			return errors.Wrapf(err, "failed to unlock installation %s", installation.ID)
+			return errors.Wrap(err, "failed to hibernate installation")
 		}
-		relock = true
-	}
 
-	installation, err = client.HibernateInstallation(installation.ID)
-	if err != nil {
-		return errors.Wrap(err, "failed to hibernate installation")
-	}
+		return nil
+	})
+}
 
-	if relock {
-		err = client.LockAPIForInstallation(installation.ID)
-		if err != nil {
-			return errors.Wrapf(err, "failed to relock installation %s", installation.ID)
-		}
+// canHibernate checks that an installation is in a state that can be
+// hibernated. These checks apply even when hibernation is forced.
+func canHibernate(installation *cmodel.InstallationDTO, unlock bool) error {
+	if installation.State != cmodel.InstallationStateStable {
+		return errors.Errorf("expected only stable installations (%s)", installation.State)
+	}
+	if installation.APISecurityLock && !unlock {
+		return errors.New("installation is locked and hibernator is not set to perform unlocks")
 	}
 
 	return nil
@@ -225,12 +354,10 @@ func hibernateInstallation(installation *cmodel.InstallationDTO, client *cmodel.
 // If the installation should be hibernated, but an error is also returned then
 // that indicates that the installation meets hibernation criteria, but was also
 // whitelisted due to another metric such as user count.
-func shouldHibernate(installation *cmodel.InstallationDTO, userMetrics map[string]int64, mc metricsClient, unlock bool, days, maxUsers int, creationTimestampCutoff int64, logger log.FieldLogger) (bool, error) {
-	if installation.State != cmodel.InstallationStateStable {
-		return false, errors.Errorf("expected only stable installations (%s)", installation.State)
-	}
-	if installation.APISecurityLock && !unlock {
-		return false, errors.New("installation is locked and hibernator is not set to perform unlocks")
+func shouldHibernate(ctx context.Context, installation *cmodel.InstallationDTO, userMetrics map[string]int64, mc metricsClient, unlock bool, days, maxUsers int, creationTimestampCutoff int64, logger log.FieldLogger) (bool, error) {
+	err := canHibernate(installation, unlock)
+	if err != nil {
+		return false, err
 	}
 
 	if installation.CreateAt >= creationTimestampCutoff {
@@ -240,9 +367,13 @@ func shouldHibernate(installation *cmodel.InstallationDTO, userMetrics map[strin
 
 	// A small sleep to help prevent hitting the metrics host too hard.
 	// Using the force a bit here. May need to be tweaked.
-	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-time.After(100 * time.Millisecond):
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
 
-	newPosts, err := mc.GetInstallationNewPostCount(installation.ID, days)
+	newPosts, err := mc.GetInstallationNewPostCount(ctx, installation.ID, days)
 	if err != nil {
 		return false, errors.Wrap(err, "failed to deterimine if installation has new posts")
 	}
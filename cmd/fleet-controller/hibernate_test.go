@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"testing"
 
@@ -31,20 +32,20 @@ func TestShouldHibernate(t *testing.T) {
 	logger := logger.WithField("fleet-controller", "hibernate")
 
 	t.Run("hibernator can't unlock", func(t *testing.T) {
-		shouldHibernate, err := shouldHibernate(installation, userMetrics, mc, false, 7, 100, creationCutoff, logger)
+		shouldHibernate, err := shouldHibernate(context.Background(), installation, userMetrics, mc, false, 7, 100, creationCutoff, logger)
 		assert.False(t, shouldHibernate)
 		assert.Error(t, err)
 	})
 
 	t.Run("installation has new posts", func(t *testing.T) {
-		shouldHibernate, err := shouldHibernate(installation, userMetrics, mc, true, 7, 100, creationCutoff, logger)
+		shouldHibernate, err := shouldHibernate(context.Background(), installation, userMetrics, mc, true, 7, 100, creationCutoff, logger)
 		assert.False(t, shouldHibernate)
 		assert.NoError(t, err)
 	})
 
 	t.Run("installation has no new posts", func(t *testing.T) {
 		mc.newPostCount = 0
-		shouldHibernate, err := shouldHibernate(installation, userMetrics, mc, true, 7, 100, creationCutoff, logger)
+		shouldHibernate, err := shouldHibernate(context.Background(), installation, userMetrics, mc, true, 7, 100, creationCutoff, logger)
 		assert.True(t, shouldHibernate)
 		assert.NoError(t, err)
 		mc.newPostCount = 10
@@ -52,7 +53,7 @@ func TestShouldHibernate(t *testing.T) {
 
 	t.Run("installation has no user metrics", func(t *testing.T) {
 		mc.newPostCount = 0
-		shouldHibernate, err := shouldHibernate(installation, make(map[string]int64), mc, true, 7, 100, creationCutoff, logger)
+		shouldHibernate, err := shouldHibernate(context.Background(), installation, make(map[string]int64), mc, true, 7, 100, creationCutoff, logger)
 		assert.False(t, shouldHibernate)
 		assert.Error(t, err)
 		mc.newPostCount = 10
@@ -60,7 +61,7 @@ func TestShouldHibernate(t *testing.T) {
 
 	t.Run("installation no new posts, but more than maxUsers", func(t *testing.T) {
 		mc.newPostCount = 0
-		shouldHibernate, err := shouldHibernate(installation, userMetrics, mc, true, 7, 4, creationCutoff, logger)
+		shouldHibernate, err := shouldHibernate(context.Background(), installation, userMetrics, mc, true, 7, 4, creationCutoff, logger)
 		assert.True(t, shouldHibernate)
 		assert.Error(t, err)
 		mc.newPostCount = 10
@@ -69,7 +70,7 @@ func TestShouldHibernate(t *testing.T) {
 	t.Run("installation has a user metric count of 0", func(t *testing.T) {
 		mc.newPostCount = 0
 		userMetrics[installation.ID] = 0
-		shouldHibernate, err := shouldHibernate(installation, userMetrics, mc, true, 7, 100, creationCutoff, logger)
+		shouldHibernate, err := shouldHibernate(context.Background(), installation, userMetrics, mc, true, 7, 100, creationCutoff, logger)
 		assert.False(t, shouldHibernate)
 		assert.Error(t, err)
 		mc.newPostCount = 10
@@ -78,7 +79,7 @@ func TestShouldHibernate(t *testing.T) {
 
 	t.Run("error getting post metrics", func(t *testing.T) {
 		mc.newPostsError = errors.New("test")
-		shouldHibernate, err := shouldHibernate(installation, userMetrics, mc, true, 7, 4, creationCutoff, logger)
+		shouldHibernate, err := shouldHibernate(context.Background(), installation, userMetrics, mc, true, 7, 4, creationCutoff, logger)
 		assert.False(t, shouldHibernate)
 		assert.Error(t, err)
 		mc.newPostsError = nil
@@ -86,15 +87,23 @@ func TestShouldHibernate(t *testing.T) {
 
 	t.Run("installation not stable", func(t *testing.T) {
 		installation.State = cmodel.InstallationStateUpdateInProgress
-		shouldHibernate, err := shouldHibernate(installation, userMetrics, mc, true, 7, 100, creationCutoff, logger)
+		shouldHibernate, err := shouldHibernate(context.Background(), installation, userMetrics, mc, true, 7, 100, creationCutoff, logger)
 		assert.False(t, shouldHibernate)
 		assert.Error(t, err)
 	})
 
 	t.Run("installation was created recently", func(t *testing.T) {
 		installation.State = cmodel.ClusterInstallationStateStable
-		shouldHibernate, err := shouldHibernate(installation, userMetrics, mc, true, 7, 100, 0, logger)
+		shouldHibernate, err := shouldHibernate(context.Background(), installation, userMetrics, mc, true, 7, 100, 0, logger)
 		assert.False(t, shouldHibernate)
 		assert.NoError(t, err)
 	})
+
+	t.Run("run cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		shouldHibernate, err := shouldHibernate(ctx, installation, userMetrics, mc, true, 7, 100, creationCutoff, logger)
+		assert.False(t, shouldHibernate)
+		assert.Equal(t, context.Canceled, err)
+	})
 }
@@ -0,0 +1,349 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/internal/selector"
+	"github.com/mattermost/fleet-controller/model"
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+)
+
+func init() {
+	reportInventoryCmd.PersistentFlags().String("server", "http://localhost:8075", "The provisioning server whose API will be queried.")
+	reportInventoryCmd.PersistentFlags().String("thanos-url", "", "Optional URL to query thanos metrics from. User counts, post activity and size drift are only reported when set.")
+	reportInventoryCmd.PersistentFlags().Int("days", 7, "The number of days back to count new posts over.")
+	reportInventoryCmd.PersistentFlags().String("format", "table", "The output format: table, csv or json.")
+	reportInventoryCmd.PersistentFlags().Duration("stuck-after", 6*time.Hour, "How long an installation must have been observed in an updating or failed state before it is reported as stuck. States are only observed across runs when a journal directory is set.")
+	reportInventoryCmd.PersistentFlags().String("should-be-locked", "", "Optional selector expression matching installations that should have their API locked.")
+	reportInventoryCmd.PersistentFlags().Bool("drift-only", false, "Whether only installations with drift are listed.")
+	addSelectorFlag(reportInventoryCmd)
+
+	// Installation filters
+	reportInventoryCmd.PersistentFlags().String("owner", "", "The owner ID value to filter installations by.")
+	reportInventoryCmd.PersistentFlags().String("group", "", "The group ID value to filter installations by.")
+
+	reportCmd.AddCommand(reportInventoryCmd)
+}
+
+// inventoryRow is a single installation in the inventory report.
+// StateObservedSince is when the installation was first observed in its
+// current state, which is no earlier than when it entered the state.
+type inventoryRow struct {
+	ID                 string   `json:"id"`
+	DNS                string   `json:"dns"`
+	Size               string   `json:"size"`
+	SuggestedSize      string   `json:"suggestedSize,omitempty"`
+	State              string   `json:"state"`
+	StateObservedSince int64    `json:"stateObservedSince"`
+	Users              *int64   `json:"users,omitempty"`
+	NewPosts           *float64 `json:"newPosts,omitempty"`
+	Locked             bool     `json:"locked"`
+	Group              string   `json:"group,omitempty"`
+	Owner              string   `json:"owner"`
+	Version            string   `json:"version"`
+	Image              string   `json:"image"`
+	Clusters           []string `json:"clusters,omitempty"`
+	Annotations        []string `json:"annotations,omitempty"`
+	Drift              []string `json:"drift,omitempty"`
+}
+
+// inventoryPolicy decides which installations have drifted from the fleet
+// policies.
+type inventoryPolicy struct {
+	stuckAfter     time.Duration
+	shouldBeLocked *selector.Selector
+}
+
+// inventoryData is everything known about the fleet other than the
+// installations themselves. Metrics are nil when no metrics source is set.
+type inventoryData struct {
+	userCounts    map[string]int64
+	newPosts      map[string]float64
+	clusters      map[string][]string
+	lastJournaled map[string]*journal.Entry
+	// observed is updated with the state of every installation.
+	observed journal.ObservedStates
+}
+
+var reportInventoryCmd = &cobra.Command{
+	Use:   "inventory",
+	Short: "List every installation and highlight drift from fleet policies",
+	RunE: func(command *cobra.Command, args []string) error {
+		command.SilenceUsage = true
+		ctx := command.Context()
+
+		productionLogs, _ := command.Flags().GetBool("production-logs")
+		logger := setupLogger("inventory", productionLogs, "")
+
+		serverAddress, _ := command.Flags().GetString("server")
+		thanosURL, _ := command.Flags().GetString("thanos-url")
+		days, _ := command.Flags().GetInt("days")
+		format, _ := command.Flags().GetString("format")
+		stuckAfter, _ := command.Flags().GetDuration("stuck-after")
+		shouldBeLocked, _ := command.Flags().GetString("should-be-locked")
+		driftOnly, _ := command.Flags().GetBool("drift-only")
+		journalDir, _ := command.Flags().GetString("journal-dir")
+		owner, _ := command.Flags().GetString("owner")
+		group, _ := command.Flags().GetString("group")
+
+		if len(serverAddress) == 0 {
+			return errors.New("server value must be defined")
+		}
+		if format != "table" && format != "csv" && format != "json" {
+			return errors.Errorf("unsupported format %s; expected table, csv or json", format)
+		}
+
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+		policy := &inventoryPolicy{stuckAfter: stuckAfter}
+		if len(shouldBeLocked) != 0 {
+			policy.shouldBeLocked, err = selector.Parse(shouldBeLocked)
+			if err != nil {
+				return errors.Wrap(err, "invalid should-be-locked value")
+			}
+		}
+
+		client := newProvisionerClient(newProvisionerSettings(command, nil))
+
+		logger.Info("Obtaining current installations")
+		installations, err := client.GetInstallations(&cmodel.GetInstallationsRequest{
+			OwnerID:                     owner,
+			GroupID:                     group,
+			IncludeGroupConfig:          false,
+			IncludeGroupConfigOverrides: false,
+			Paging: cmodel.Paging{
+				Page:           0,
+				PerPage:        cmodel.AllPerPage,
+				IncludeDeleted: false,
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to get installations")
+		}
+		installations = sel.Filter(installations)
+
+		data := &inventoryData{}
+		data.clusters, err = model.GetInstallationClusters(client)
+		if err != nil {
+			return err
+		}
+		data.lastJournaled, err = lastJournalEntries(journalDir)
+		if err != nil {
+			return err
+		}
+		data.observed, err = journal.ReadObservedStates(journalDir)
+		if err != nil {
+			return err
+		}
+		if len(thanosURL) != 0 {
+			tc, err := newThanosClient(command, thanosURL)
+			if err != nil {
+				return err
+			}
+			defer logMetricsCacheStats(tc, logger)
+
+			logger.Info("Gathering installation metrics")
+			data.userCounts, err = tc.GetInstallationUserMetrics(ctx)
+			if err != nil {
+				return errors.Wrap(err, "failed to obtain installation user metrics")
+			}
+			data.newPosts, err = tc.GetInstallationsNewPostCountsAt(ctx, days, time.Now())
+			if err != nil {
+				return errors.Wrap(err, "failed to obtain installation post metrics")
+			}
+		}
+
+		rows := buildInventory(installations, data, policy, time.Now())
+		err = journal.WriteObservedStates(journalDir, data.observed)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to save observed installation states")
+		}
+		var driftCount int
+		var listed []*inventoryRow
+		for _, row := range rows {
+			if len(row.Drift) != 0 {
+				driftCount++
+			}
+			if driftOnly && len(row.Drift) == 0 {
+				continue
+			}
+			listed = append(listed, row)
+		}
+
+		logger.WithFields(log.Fields{
+			"installations": len(rows),
+			"drift":         driftCount,
+		}).Info("Inventory complete")
+
+		return writeInventory(os.Stdout, format, listed)
+	},
+}
+
+// lastJournalEntries returns the most recent journal entry of each
+// installation. No entries are returned when there is no journal.
+func lastJournalEntries(journalDir string) (map[string]*journal.Entry, error) {
+	last := make(map[string]*journal.Entry)
+	if len(journalDir) == 0 {
+		return last, nil
+	}
+
+	entries, err := journal.ReadAll(journalDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if current, ok := last[entry.InstallationID]; !ok || entry.Timestamp > current.Timestamp {
+			last[entry.InstallationID] = entry
+		}
+	}
+
+	return last, nil
+}
+
+func buildInventory(installations []*cmodel.InstallationDTO, data *inventoryData, policy *inventoryPolicy, now time.Time) []*inventoryRow {
+	var rows []*inventoryRow
+	for _, installation := range installations {
+		since := data.observed.Observe(installation.ID, installation.State, now)
+		row := &inventoryRow{
+			ID:                 installation.ID,
+			DNS:                installation.DNS,
+			Size:               installation.Size,
+			State:              installation.State,
+			StateObservedSince: since.UnixNano() / int64(time.Millisecond),
+			Locked:             installation.APISecurityLock,
+			Owner:              installation.OwnerID,
+			Version:            installation.Version,
+			Image:              installation.Image,
+			Clusters:           data.clusters[installation.ID],
+			Annotations:        annotationNames(installation),
+		}
+		if installation.GroupID != nil {
+			row.Group = *installation.GroupID
+		}
+		if newPosts, ok := data.newPosts[installation.ID]; ok {
+			newPosts := newPosts
+			row.NewPosts = &newPosts
+		}
+
+		if userCount, ok := data.userCounts[installation.ID]; ok {
+			userCount := userCount
+			row.Users = &userCount
+			suggestedSize, err := getSuggestedScaleSize(installation.Size, userCount)
+			if err == nil && suggestedSize != installation.Size && installation.State == cmodel.InstallationStateStable {
+				row.SuggestedSize = suggestedSize
+				row.Drift = append(row.Drift, fmt.Sprintf("size %s should be %s for %d users", installation.Size, suggestedSize, userCount))
+			}
+		}
+
+		if !installation.APISecurityLock {
+			if last := data.lastJournaled[installation.ID]; last != nil && last.APISecurityLock {
+				row.Drift = append(row.Drift, fmt.Sprintf("unlocked since %s run %s", last.Action, last.RunID))
+			} else if policy.shouldBeLocked != nil && policy.shouldBeLocked.MatchAt(installation, now) {
+				row.Drift = append(row.Drift, "unlocked but should be locked")
+			}
+		}
+
+		// Installations first observed in their state by this run are never
+		// reported as stuck as how long they have been in it is unknown.
+		if model.IsUpdatingState(installation.State) || model.IsFailedState(installation.State) {
+			if age := now.Sub(since); age >= policy.stuckAfter {
+				row.Drift = append(row.Drift, fmt.Sprintf("%s for at least %s", installation.State, age.Round(time.Minute)))
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if (len(rows[i].Drift) != 0) != (len(rows[j].Drift) != 0) {
+			return len(rows[i].Drift) != 0
+		}
+		return rows[i].ID < rows[j].ID
+	})
+
+	return rows
+}
+
+var inventoryColumns = []string{"ID", "DNS", "SIZE", "SUGGESTED SIZE", "STATE", "STATE OBSERVED SINCE", "USERS", "NEW POSTS", "LOCKED", "GROUP", "OWNER", "VERSION", "CLUSTERS", "ANNOTATIONS", "DRIFT"}
+
+func (r *inventoryRow) values() []string {
+	users, newPosts := "", ""
+	if r.Users != nil {
+		users = strconv.FormatInt(*r.Users, 10)
+	}
+	if r.NewPosts != nil {
+		newPosts = strconv.FormatFloat(*r.NewPosts, 'f', 0, 64)
+	}
+
+	return []string{
+		r.ID,
+		r.DNS,
+		r.Size,
+		r.SuggestedSize,
+		r.State,
+		time.Unix(0, r.StateObservedSince*int64(time.Millisecond)).UTC().Format(time.RFC3339),
+		users,
+		newPosts,
+		strconv.FormatBool(r.Locked),
+		r.Group,
+		r.Owner,
+		r.Version,
+		strings.Join(r.Clusters, " "),
+		strings.Join(r.Annotations, " "),
+		strings.Join(r.Drift, "; "),
+	}
+}
+
+func writeInventory(w io.Writer, format string, rows []*inventoryRow) error {
+	switch format {
+	case "json":
+		if rows == nil {
+			rows = []*inventoryRow{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	case "csv":
+		writer := csv.NewWriter(w)
+		err := writer.Write(inventoryColumns)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			err = writer.Write(row.values())
+			if err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(inventoryColumns, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row.values(), "\t"))
+	}
+
+	return tw.Flush()
+}
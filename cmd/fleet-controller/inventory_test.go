@@ -0,0 +1,141 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/internal/selector"
+)
+
+func TestBuildInventory(t *testing.T) {
+	now := time.Now()
+	millis := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+	newInstallation := func(id, size, state string, locked bool) *cmodel.InstallationDTO {
+		return &cmodel.InstallationDTO{
+			Installation: &cmodel.Installation{
+				ID:              id,
+				Size:            size,
+				State:           state,
+				APISecurityLock: locked,
+				CreateAt:        millis(now.Add(-30 * 24 * time.Hour)),
+			},
+		}
+	}
+
+	installations := []*cmodel.InstallationDTO{
+		newInstallation("a-healthy", cloud100users, cmodel.InstallationStateStable, true),
+		newInstallation("b-oversized", size1000users, cmodel.InstallationStateStable, true),
+		newInstallation("c-unlocked", cloud100users, cmodel.InstallationStateStable, false),
+		newInstallation("d-stuck", cloud100users, cmodel.InstallationStateUpdateInProgress, true),
+		newInstallation("e-recent", cloud100users, cmodel.InstallationStateUpdateInProgress, true),
+		newInstallation("f-policy", cloud100users, cmodel.InstallationStateStable, false),
+		newInstallation("g-unobserved", cloud100users, cmodel.InstallationStateUpdateInProgress, true),
+	}
+	installations[5].OwnerID = "enterprise"
+
+	shouldBeLocked, err := selector.Parse("owner = enterprise")
+	require.NoError(t, err)
+
+	data := &inventoryData{
+		userCounts: map[string]int64{"a-healthy": 50, "b-oversized": 20},
+		newPosts:   map[string]float64{"a-healthy": 120},
+		clusters:   map[string][]string{"a-healthy": {"cluster1"}},
+		lastJournaled: map[string]*journal.Entry{
+			"c-unlocked": {InstallationID: "c-unlocked", Action: "scale", RunID: "run1", APISecurityLock: true, Timestamp: millis(now.Add(-time.Hour))},
+			"e-recent":   {InstallationID: "e-recent", Action: "scale", RunID: "run2", Timestamp: millis(now.Add(-time.Hour))},
+		},
+		observed: journal.ObservedStates{
+			"d-stuck":  {State: cmodel.InstallationStateUpdateInProgress, Since: millis(now.Add(-7 * time.Hour))},
+			"e-recent": {State: cmodel.InstallationStateUpdateInProgress, Since: millis(now.Add(-time.Hour))},
+			"f-policy": {State: cmodel.InstallationStateUpdateInProgress, Since: millis(now.Add(-7 * time.Hour))},
+		},
+	}
+	policy := &inventoryPolicy{stuckAfter: 6 * time.Hour, shouldBeLocked: shouldBeLocked}
+
+	rows := buildInventory(installations, data, policy, now)
+	require.Len(t, rows, 7)
+
+	byID := make(map[string]*inventoryRow)
+	var order []string
+	for _, row := range rows {
+		byID[row.ID] = row
+		order = append(order, row.ID)
+	}
+	assert.Equal(t, []string{"b-oversized", "c-unlocked", "d-stuck", "f-policy", "a-healthy", "e-recent", "g-unobserved"}, order)
+
+	assert.Empty(t, byID["a-healthy"].Drift)
+	require.NotNil(t, byID["a-healthy"].Users)
+	assert.EqualValues(t, 50, *byID["a-healthy"].Users)
+	require.NotNil(t, byID["a-healthy"].NewPosts)
+	assert.EqualValues(t, 120, *byID["a-healthy"].NewPosts)
+	assert.Equal(t, []string{"cluster1"}, byID["a-healthy"].Clusters)
+
+	assert.Equal(t, cloud100users, byID["b-oversized"].SuggestedSize)
+	assert.Len(t, byID["b-oversized"].Drift, 1)
+
+	require.Len(t, byID["c-unlocked"].Drift, 1)
+	assert.Contains(t, byID["c-unlocked"].Drift[0], "run1")
+
+	require.Len(t, byID["d-stuck"].Drift, 1)
+	assert.Contains(t, byID["d-stuck"].Drift[0], cmodel.InstallationStateUpdateInProgress)
+	assert.Nil(t, byID["d-stuck"].Users)
+
+	assert.Empty(t, byID["e-recent"].Drift)
+	assert.Equal(t, millis(now.Add(-time.Hour)), byID["e-recent"].StateObservedSince)
+
+	// Installations not observed in their state before aren't stuck however
+	// old they are, and states that changed are observed from now.
+	assert.Empty(t, byID["g-unobserved"].Drift)
+	assert.Equal(t, millis(now), byID["g-unobserved"].StateObservedSince)
+	assert.Equal(t, millis(now), byID["f-policy"].StateObservedSince)
+	assert.Equal(t, cmodel.InstallationStateStable, data.observed["f-policy"].State)
+
+	assert.Equal(t, []string{"unlocked but should be locked"}, byID["f-policy"].Drift)
+}
+
+func TestWriteInventory(t *testing.T) {
+	users := int64(42)
+	rows := []*inventoryRow{{
+		ID:     "id1",
+		Size:   cloud100users,
+		State:  cmodel.InstallationStateStable,
+		Users:  &users,
+		Locked: true,
+		Drift:  []string{"one", "two"},
+	}}
+
+	var buf bytes.Buffer
+	require.NoError(t, writeInventory(&buf, "csv", rows))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "ID,DNS,SIZE"))
+	assert.Contains(t, lines[1], ",42,")
+	assert.Contains(t, lines[1], "one; two")
+
+	buf.Reset()
+	require.NoError(t, writeInventory(&buf, "json", rows))
+	var decoded []*inventoryRow
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, rows, decoded)
+
+	buf.Reset()
+	require.NoError(t, writeInventory(&buf, "json", nil))
+	assert.Equal(t, "[]\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, writeInventory(&buf, "table", rows))
+	assert.Contains(t, buf.String(), "SUGGESTED SIZE")
+	assert.Contains(t, buf.String(), "id1")
+}
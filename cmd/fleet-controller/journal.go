@@ -0,0 +1,39 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/journal"
+)
+
+// newJournal returns the journal for the current run against the provisioner.
+// A nil journal is returned when no journal directory is configured.
+func newJournal(command *cobra.Command, name, provisioner string) (*journal.Journal, error) {
+	journalDir, _ := command.Flags().GetString("journal-dir")
+
+	j, err := journal.New(journalDir, runID, name, provisioner)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create run journal")
+	}
+
+	return j, nil
+}
+
+// recordJournalEntry records an action in the run journal. Failing to record
+// an action is logged, but never stops a run that is already taking actions.
+func recordJournalEntry(j *journal.Journal, entry *journal.Entry, logger log.FieldLogger) {
+	entry.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+
+	err := j.Record(entry)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to record journal entry")
+	}
+}
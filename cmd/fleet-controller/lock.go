@@ -0,0 +1,169 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/lock"
+)
+
+// runLock holds the leader lease for a mutating run and locks installations
+// while actions are taken on them. A nil runLock is valid and locks nothing.
+type runLock struct {
+	backend lock.Backend
+	lease   *lock.Lease
+	ttl     time.Duration
+	logger  log.FieldLogger
+	stop    chan struct{}
+}
+
+// acquireRunLock acquires the leader lease for the provisioning server with
+// the configured lock backend. The run is cancelled if the lease is lost, so
+// no new actions are started once another run may have taken over. A nil
+// runLock is returned when no backend is configured.
+func acquireRunLock(command *cobra.Command, settings *provisionerSettings, cancelRun context.CancelFunc, logger log.FieldLogger) (*runLock, error) {
+	backendType, _ := command.Flags().GetString("lock-backend")
+	ttl, _ := command.Flags().GetDuration("lock-ttl")
+	wait, _ := command.Flags().GetDuration("lock-wait")
+
+	var backend lock.Backend
+	switch backendType {
+	case "":
+		return nil, nil
+	case "file":
+		dir, _ := command.Flags().GetString("lock-dir")
+		if len(dir) == 0 {
+			return nil, errors.New("lock-dir value must be defined for the file lock backend")
+		}
+		fileBackend, err := lock.NewFileBackend(dir)
+		if err != nil {
+			return nil, err
+		}
+		backend = fileBackend
+	case "redis":
+		redisURL, _ := command.Flags().GetString("lock-redis-url")
+		redisBackend, err := lock.NewRedisBackend(redisURL)
+		if err != nil {
+			return nil, err
+		}
+		backend = redisBackend
+	case "kubernetes":
+		kubeconfig, _ := command.Flags().GetString("lock-kubeconfig")
+		namespace, _ := command.Flags().GetString("lock-namespace")
+		kubernetesBackend, err := lock.NewKubernetesBackend(kubeconfig, namespace)
+		if err != nil {
+			return nil, err
+		}
+		backend = kubernetesBackend
+	default:
+		return nil, errors.Errorf("unknown lock backend %s", backendType)
+	}
+
+	logger.Info("Acquiring leader lease")
+	lease, err := lock.Acquire(command.Context(), backend, leaderLeaseName(settings.server), runID, ttl, wait, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "another fleet controller run is taking actions")
+	}
+
+	l := &runLock{backend: backend, lease: lease, ttl: ttl, logger: logger, stop: make(chan struct{})}
+	go func() {
+		select {
+		case <-lease.Lost():
+			logger.Error("Leader lease was lost; cancelling run")
+			cancelRun()
+		case <-l.stop:
+		}
+	}()
+
+	return l, nil
+}
+
+// leaderLeaseName returns the name of the lease held by the run that is
+// allowed to take actions against a provisioning server. Runs against
+// different servers don't act on the same installations so each server has
+// its own leader, however it was configured. The URL is hashed to keep the
+// name valid for every backend.
+func leaderLeaseName(server string) string {
+	normalised := strings.TrimRight(strings.ToLower(server), "/")
+	if serverURL, err := url.Parse(normalised); err == nil && len(serverURL.Host) != 0 {
+		host := serverURL.Hostname()
+		port := serverURL.Port()
+		if (serverURL.Scheme == "http" && port == "80") || (serverURL.Scheme == "https" && port == "443") {
+			port = ""
+		}
+		if len(port) != 0 {
+			host += ":" + port
+		}
+		normalised = serverURL.Scheme + "://" + host + strings.TrimRight(serverURL.Path, "/")
+	}
+
+	sum := sha256.Sum256([]byte(normalised))
+
+	return "leader-" + hex.EncodeToString(sum[:8])
+}
+
+// release stops watching the leader lease and releases it.
+func (l *runLock) release(logger log.FieldLogger) {
+	if l == nil {
+		return
+	}
+
+	close(l.stop)
+	err := l.lease.Release()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to release leader lease")
+	}
+}
+
+// lockTasks wraps tasks so each holds a lock on its installation while it runs
+// and fails if the leader lease has been lost. Installation locks are renewed
+// until the task returns so actions outliving the lock TTL stay locked.
+func (l *runLock) lockTasks(tasks []*executor.Task) []*executor.Task {
+	if l == nil {
+		return tasks
+	}
+
+	locked := make([]*executor.Task, 0, len(tasks))
+	for _, task := range tasks {
+		task := task
+		locked = append(locked, &executor.Task{
+			InstallationID: task.InstallationID,
+			Run: func() error {
+				if l.lease.IsLost() {
+					return errors.New("leader lease was lost")
+				}
+
+				lease, err := lock.TryAcquire(l.backend, "installation-"+task.InstallationID, runID, l.ttl, l.logger)
+				if err != nil {
+					return errors.Wrap(err, "failed to lock installation")
+				}
+				if lease == nil {
+					return errors.New("installation is locked by another run")
+				}
+				defer func() {
+					err := lease.Release()
+					if err != nil {
+						l.logger.WithError(err).WithField("installation", task.InstallationID).Warn("Failed to release installation lock")
+					}
+				}()
+
+				return task.Run()
+			},
+		})
+	}
+
+	return locked
+}
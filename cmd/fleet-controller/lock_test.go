@@ -0,0 +1,21 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaderLeaseName(t *testing.T) {
+	name := leaderLeaseName("https://provisioner.example.com")
+
+	assert.Equal(t, name, leaderLeaseName("https://provisioner.example.com/"))
+	assert.Equal(t, name, leaderLeaseName("HTTPS://Provisioner.Example.com:443"))
+	assert.NotEqual(t, name, leaderLeaseName("https://other.example.com"))
+	assert.NotEqual(t, name, leaderLeaseName("https://provisioner.example.com:8075"))
+	assert.Regexp(t, "^leader-[0-9a-f]{16}$", name)
+}
@@ -22,12 +22,15 @@ func init() {
 	})
 }
 
-func setupLogger(cmd string, production bool) *log.Entry {
+func setupLogger(cmd string, production bool, provisioner string) *log.Entry {
 	l := logger.WithField("fleet-controller", cmd)
 	if production {
 		logger.SetFormatter(&logrus.JSONFormatter{})
 		l = l.WithField("run", runID)
 	}
+	if len(provisioner) != 0 {
+		l = l.WithField("provisioner", provisioner)
+	}
 
 	return l
 }
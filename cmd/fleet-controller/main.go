@@ -6,11 +6,14 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/mattermost/mattermost-cloud/model"
 	"github.com/ory/viper"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/api"
 )
 
 var runID string
@@ -21,20 +24,66 @@ func init() {
 	viper.SetEnvPrefix("FC")
 	viper.AutomaticEnv()
 
+	// Runs started by the API server are given their ID.
+	if id := viper.GetString("RUN_ID"); len(id) != 0 {
+		runID = id
+	}
+
 	rootCmd.PersistentFlags().Bool("production-logs", viper.GetBool("PRODUCTION_LOGS"), "Set log output with production settings | ENV: FC_PRODUCTION_LOGS")
 	rootCmd.PersistentFlags().String("mm-webhook-url", viper.GetString("MM_WEBHOOK_URL"), "Optional Mattmost incoming webhook URL to send information on actions taken by fleet controller | ENV: FC_MM_WEBHOOK_URL")
+	rootCmd.PersistentFlags().Duration("metrics-cache-ttl", viper.GetDuration("METRICS_CACHE_TTL"), "How long metrics query results are cached for. A value of 0 disables caching | ENV: FC_METRICS_CACHE_TTL")
+	rootCmd.PersistentFlags().String("notifications-config", viper.GetString("NOTIFICATIONS_CONFIG"), "Optional JSON or YAML file configuring notification sinks and which events are routed to them | ENV: FC_NOTIFICATIONS_CONFIG")
+	rootCmd.PersistentFlags().String("notifications-dead-letter-file", viper.GetString("NOTIFICATIONS_DEAD_LETTER_FILE"), "Optional file that notifications are written to when they can't be delivered | ENV: FC_NOTIFICATIONS_DEAD_LETTER_FILE")
+	rootCmd.PersistentFlags().Duration("notifications-retry-deadline", 2*time.Minute, "How long delivery of a notification to a single sink is retried for.")
+	rootCmd.PersistentFlags().String("webhook-username", "Fleet Controller", "The username webhook messages are posted as.")
+	rootCmd.PersistentFlags().String("webhook-icon-url", defaultWebhookIconURL, "The icon URL webhook messages are posted with.")
+	rootCmd.PersistentFlags().String("webhook-channel", viper.GetString("WEBHOOK_CHANNEL"), "Optional channel to post webhook messages to instead of the webhook default | ENV: FC_WEBHOOK_CHANNEL")
+	rootCmd.PersistentFlags().String("webhook-run-summary-template", viper.GetString("WEBHOOK_RUN_SUMMARY_TEMPLATE"), "Optional Go text/template file used to render run summary webhook messages | ENV: FC_WEBHOOK_RUN_SUMMARY_TEMPLATE")
+	rootCmd.PersistentFlags().String("webhook-error-template", viper.GetString("WEBHOOK_ERROR_TEMPLATE"), "Optional Go text/template file used to render error webhook messages | ENV: FC_WEBHOOK_ERROR_TEMPLATE")
+	rootCmd.PersistentFlags().String("journal-dir", viper.GetString("JOURNAL_DIR"), "Optional directory where the actions taken by each run are recorded | ENV: FC_JOURNAL_DIR")
+	rootCmd.PersistentFlags().String("pricing-file", viper.GetString("PRICING_FILE"), "Optional JSON file of hourly installation costs used for savings estimates | ENV: FC_PRICING_FILE")
+	rootCmd.PersistentFlags().String("lock-backend", viper.GetString("LOCK_BACKEND"), "Optional lock backend (file, redis or kubernetes) used so only one fleet controller run takes actions at a time | ENV: FC_LOCK_BACKEND")
+	rootCmd.PersistentFlags().String("lock-dir", viper.GetString("LOCK_DIR"), "The directory leases are stored in with the file lock backend | ENV: FC_LOCK_DIR")
+	rootCmd.PersistentFlags().String("lock-redis-url", viper.GetString("LOCK_REDIS_URL"), "The redis://[:password@]host:port[/database] URL of the server leases are stored in with the redis lock backend | ENV: FC_LOCK_REDIS_URL")
+	rootCmd.PersistentFlags().String("lock-kubeconfig", viper.GetString("LOCK_KUBECONFIG"), "Optional kubeconfig file of the cluster leases are stored in with the kubernetes lock backend. The in-cluster config is used when empty | ENV: FC_LOCK_KUBECONFIG")
+	rootCmd.PersistentFlags().String("lock-namespace", viper.GetString("LOCK_NAMESPACE"), "The namespace leases are stored in with the kubernetes lock backend | ENV: FC_LOCK_NAMESPACE")
+	rootCmd.PersistentFlags().Duration("lock-ttl", time.Minute, "How long a lease is held without being renewed.")
+	rootCmd.PersistentFlags().Duration("lock-wait", 0, "How long to wait for another run to release the leader lease before failing.")
+	rootCmd.PersistentFlags().String("provisioners-config", viper.GetString("PROVISIONERS_CONFIG"), "Optional JSON or YAML file listing provisioning servers and their metrics sources. Commands taking actions run against each of them with a combined report | ENV: FC_PROVISIONERS_CONFIG")
+	rootCmd.PersistentFlags().String(api.StatusFileFlag, "", "Optional file the plan and progress of the run are written to.")
+	rootCmd.PersistentFlags().MarkHidden(api.StatusFileFlag)
+	rootCmd.PersistentFlags().String("metrics-cache-dir", viper.GetString("METRICS_CACHE_DIR"), "Optional directory to cache metrics query results in so they can be reused across runs. Results are cached in memory when not set | ENV: FC_METRICS_CACHE_DIR")
 
 	rootCmd.AddCommand(scaleCmd)
 	rootCmd.AddCommand(hibernate)
 	rootCmd.AddCommand(wakeupCmd)
 	rootCmd.AddCommand(deleteCmd)
+	rootCmd.AddCommand(upgradeCmd)
+	rootCmd.AddCommand(envCmd)
+	rootCmd.AddCommand(annotateCmd)
+	rootCmd.AddCommand(stuckCmd)
+	rootCmd.AddCommand(simulateCmd)
+	rootCmd.AddCommand(reportCmd)
+	rootCmd.AddCommand(notificationsCmd)
+	rootCmd.AddCommand(undoCmd)
+	rootCmd.AddCommand(serveCmd)
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, stop := newShutdownContext()
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if err != nil {
 		logger.Error(errors.Wrap(err, "Command failed").Error())
-		webhookURL, _ := rootCmd.Flags().GetString("mm-webhook-url")
-		sendErrorWebhook(webhookURL, runID, err)
+		notifier, notifierErr := newRunNotifier(rootCmd)
+		if notifierErr != nil {
+			logger.WithError(notifierErr).Error("Failed to create notifier")
+			os.Exit(1)
+		}
+		notifyErr := notifier.sendError(err)
+		if notifyErr != nil {
+			logger.WithError(notifyErr).Error("Failed to send error notification")
+		}
 		os.Exit(1)
 	}
 }
@@ -43,4 +92,7 @@ var rootCmd = &cobra.Command{
 	Use:           "fleet-controller",
 	Short:         "The fleet controller manages configuration of the fleet of Mattermost Cloud installations.",
 	SilenceErrors: true,
+	PersistentPreRun: func(command *cobra.Command, args []string) {
+		progress = newRunProgress(command)
+	},
 }
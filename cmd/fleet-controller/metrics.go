@@ -4,7 +4,49 @@
 
 package main
 
+import (
+	"context"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/metrics"
+)
+
 type metricsClient interface {
-	GetInstallationUserMetrics() (map[string]int64, error)
-	GetInstallationNewPostCount(installationID string, days int) (float64, error)
+	GetInstallationUserMetrics(ctx context.Context) (map[string]int64, error)
+	GetInstallationNewPostCount(ctx context.Context, installationID string, days int) (float64, error)
+}
+
+// newThanosClient returns a Thanos client configured with the metrics cache
+// flags of the provided command.
+func newThanosClient(command *cobra.Command, thanosURL string) (*metrics.ThanosClient, error) {
+	cacheTTL, _ := command.Flags().GetDuration("metrics-cache-ttl")
+	cacheDir, _ := command.Flags().GetString("metrics-cache-dir")
+
+	if cacheTTL <= 0 {
+		return metrics.NewThanosClient(thanosURL), nil
+	}
+	if len(cacheDir) == 0 {
+		return metrics.NewCachedThanosClient(thanosURL, metrics.NewMemoryCache(cacheTTL)), nil
+	}
+
+	cache, err := metrics.NewFileCache(cacheDir, cacheTTL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create metrics cache")
+	}
+
+	return metrics.NewCachedThanosClient(thanosURL, cache), nil
+}
+
+func logMetricsCacheStats(tc *metrics.ThanosClient, logger log.FieldLogger) {
+	hits, misses := tc.CacheStats()
+	if hits == 0 && misses == 0 {
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"metrics-cache-hits":   hits,
+		"metrics-cache-misses": misses,
+	}).Info("Metrics cache stats")
 }
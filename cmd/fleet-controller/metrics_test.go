@@ -4,6 +4,8 @@
 
 package main
 
+import "context"
+
 type mockMetricsClient struct {
 	finalUserMetrics map[string]int64
 	userError        error
@@ -16,10 +18,10 @@ func newMockMetricsClient() *mockMetricsClient {
 	return &mockMetricsClient{}
 }
 
-func (mc *mockMetricsClient) GetInstallationUserMetrics() (map[string]int64, error) {
+func (mc *mockMetricsClient) GetInstallationUserMetrics(ctx context.Context) (map[string]int64, error) {
 	return mc.finalUserMetrics, mc.userError
 }
 
-func (mc *mockMetricsClient) GetInstallationNewPostCount(installationID string, days int) (float64, error) {
+func (mc *mockMetricsClient) GetInstallationNewPostCount(ctx context.Context, installationID string, days int) (float64, error) {
 	return mc.newPostCount, mc.newPostsError
 }
@@ -0,0 +1,70 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/notify"
+)
+
+func init() {
+	notificationsCmd.AddCommand(notificationsReplayCmd)
+}
+
+var notificationsCmd = &cobra.Command{
+	Use:   "notifications",
+	Short: "Manage fleet controller notifications",
+}
+
+var notificationsReplayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Resend notifications from the dead-letter file",
+	RunE: func(command *cobra.Command, args []string) error {
+		command.SilenceUsage = true
+
+		productionLogs, _ := command.Flags().GetBool("production-logs")
+		logger := setupLogger("notifications-replay", productionLogs, "")
+
+		deadLetterFile, _ := command.Flags().GetString("notifications-dead-letter-file")
+		if len(deadLetterFile) == 0 {
+			return errors.New("notifications-dead-letter-file value must be defined")
+		}
+
+		notifier, err := newRunNotifier(command)
+		if err != nil {
+			return err
+		}
+
+		// Take the letters out of the file so notifications that fail while
+		// replaying aren't lost when the remaining letters are written back.
+		letters, err := notify.TakeDeadLetters(deadLetterFile)
+		if err != nil {
+			return err
+		}
+		if len(letters) == 0 {
+			logger.Info("No notifications to replay")
+			return nil
+		}
+
+		logger.Infof("Replaying %d notifications", len(letters))
+		remaining, replayErr := notifier.router.Replay(context.Background(), letters)
+
+		err = notify.ReturnDeadLetters(deadLetterFile, remaining)
+		if err != nil {
+			return errors.Wrap(err, "failed to update dead-letter file")
+		}
+		if replayErr != nil {
+			return replayErr
+		}
+
+		logger.Infof("Replayed %d notifications", len(letters))
+
+		return nil
+	},
+}
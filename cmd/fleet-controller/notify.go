@@ -0,0 +1,175 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/notify"
+	"github.com/mattermost/fleet-controller/internal/webhook"
+)
+
+const defaultWebhookIconURL = "https://static.wikia.nocookie.net/starwars/images/a/a7/ISD_arrow.jpg/revision/latest/scale-to-width-down/870?cb=20070424053722"
+
+// runNotifier renders run events and routes them to the configured
+// notification sinks.
+type runNotifier struct {
+	router   *notify.Router
+	renderer *webhook.Renderer
+	// settings are the settings of the provisioner the run is against.
+	settings *provisionerSettings
+}
+
+// newProvisionerNotifier returns a notifier for a run against a single
+// provisioner. The run summary of a run fanned out across provisioners is
+// collected so a combined summary can be sent.
+func newProvisionerNotifier(command *cobra.Command, settings *provisionerSettings) (*runNotifier, error) {
+	notifier, err := newRunNotifier(command)
+	if err != nil {
+		return nil, err
+	}
+	notifier.settings = settings
+
+	return notifier, nil
+}
+
+// newRunNotifier returns a notifier configured with the notification flags of
+// the provided command. The Mattermost webhook flags add a sink that receives
+// every event type alongside any sinks from the notifications config.
+func newRunNotifier(command *cobra.Command) (*runNotifier, error) {
+	configFile, _ := command.Flags().GetString("notifications-config")
+	deadLetterFile, _ := command.Flags().GetString("notifications-dead-letter-file")
+	retryDeadline, _ := command.Flags().GetDuration("notifications-retry-deadline")
+	webhookURL, _ := command.Flags().GetString("mm-webhook-url")
+	username, _ := command.Flags().GetString("webhook-username")
+	iconURL, _ := command.Flags().GetString("webhook-icon-url")
+	channel, _ := command.Flags().GetString("webhook-channel")
+	runSummaryTemplate, _ := command.Flags().GetString("webhook-run-summary-template")
+	errorTemplate, _ := command.Flags().GetString("webhook-error-template")
+
+	renderer, err := webhook.NewRenderer(runSummaryTemplate, errorTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load webhook templates")
+	}
+
+	config := &notify.Config{}
+	if len(configFile) != 0 {
+		config, err = notify.LoadConfig(configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	router, err := notify.NewRouter(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid notifications config")
+	}
+
+	retryPolicy := notify.DefaultRetryPolicy()
+	retryPolicy.Deadline = retryDeadline
+	router.SetRetryPolicy(retryPolicy)
+	router.SetDeadLetterFile(deadLetterFile)
+
+	if len(webhookURL) != 0 {
+		router.AddSink("mm-webhook-url", &notify.MattermostNotifier{
+			URL:      webhookURL,
+			Username: username,
+			IconURL:  iconURL,
+			Channel:  channel,
+		}, notify.EventRunSummary, notify.EventError, notify.EventAbort, notify.EventEscalation)
+	}
+
+	return &runNotifier{
+		router:   router,
+		renderer: renderer,
+	}, nil
+}
+
+func (n *runNotifier) notify(event *notify.Event) error {
+	ctx := context.Background()
+	event.RunID = runID
+	event.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return n.router.Notify(ctx, event)
+}
+
+func (n *runNotifier) sendError(err error) error {
+	if !n.router.HasRoutes(notify.EventError) {
+		return nil
+	}
+
+	report := &webhook.ErrorReport{RunID: runID, Error: err.Error()}
+	text, renderErr := n.renderer.RenderError(report)
+	if renderErr != nil {
+		return renderErr
+	}
+
+	return n.notify(&notify.Event{
+		Type:  notify.EventError,
+		Title: "Fleet Controller Encountered an Error",
+		Text:  text,
+		Data:  report,
+	})
+}
+
+func newRunSummary(title, action string, dryrun bool) *webhook.RunSummary {
+	return &webhook.RunSummary{
+		Title:  title,
+		Action: action,
+		RunID:  runID,
+		DryRun: dryrun,
+	}
+}
+
+// sendRunSummary completes the run summary and sends it to all sinks routed
+// for run summaries. Failures are logged as the run itself has completed.
+func (n *runNotifier) sendRunSummary(summary *webhook.RunSummary, start time.Time, logger log.FieldLogger) {
+	n.sendSummaryEvent(notify.EventRunSummary, summary, start, logger)
+}
+
+// sendRunReport sends the run summary. If the run timeout was reached, the
+// summary of what completed is also sent as an abort event.
+func (n *runNotifier) sendRunReport(ctx context.Context, summary *webhook.RunSummary, start time.Time, logger log.FieldLogger) {
+	n.sendRunSummary(summary, start, logger)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		n.sendSummaryEvent(notify.EventAbort, summary, start, logger)
+	}
+}
+
+func (n *runNotifier) sendSummaryEvent(eventType notify.EventType, summary *webhook.RunSummary, start time.Time, logger log.FieldLogger) {
+	summary.Runtime = time.Since(start).Round(time.Second).String()
+
+	if eventType == notify.EventRunSummary && n.settings != nil && n.settings.fanOut != nil {
+		n.settings.fanOut.add(n.settings.name, summary)
+		return
+	}
+	if eventType == notify.EventRunSummary {
+		progress.finished(summary)
+	}
+
+	if !n.router.HasRoutes(eventType) {
+		return
+	}
+
+	logger.Infof("Sending %s %s notification", summary.Action, eventType)
+	text, err := n.renderer.RenderRunSummary(summary)
+	if err != nil {
+		logger.WithError(err).Error("Failed to render run summary")
+		return
+	}
+	err = n.notify(&notify.Event{
+		Type:  eventType,
+		Title: summary.Title,
+		Text:  text,
+		Data:  summary,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to send notification")
+	}
+}
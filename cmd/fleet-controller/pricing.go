@@ -0,0 +1,117 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const hoursPerMonth = 730
+
+// pricingTable maps installation sizes and the hibernated state to an
+// estimated hourly cost.
+type pricingTable struct {
+	Sizes      map[string]float64 `json:"sizes"`
+	Hibernated float64            `json:"hibernated"`
+}
+
+// defaultPricing contains rough hourly cost estimates. Use --pricing-file to
+// provide values that reflect real infrastructure costs.
+var defaultPricing = pricingTable{
+	Sizes: map[string]float64{
+		cloud10users:   0.05,
+		cloud100users:  0.10,
+		size1000users:  0.40,
+		size5000users:  1.60,
+		size10000users: 3.20,
+		size25000users: 8.00,
+		miniSingleton:  0.05,
+		miniHA:         0.10,
+	},
+	Hibernated: 0.01,
+}
+
+// loadPricingTable returns the default pricing table with any values from the
+// provided JSON file overriding the defaults.
+func loadPricingTable(filename string) (*pricingTable, error) {
+	pricing := &pricingTable{
+		Sizes:      make(map[string]float64),
+		Hibernated: defaultPricing.Hibernated,
+	}
+	for size, cost := range defaultPricing.Sizes {
+		pricing.Sizes[size] = cost
+	}
+	if len(filename) == 0 {
+		return pricing, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pricing file")
+	}
+	var override pricingTable
+	err = json.Unmarshal(data, &override)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse pricing file")
+	}
+
+	for size, cost := range override.Sizes {
+		pricing.Sizes[size] = cost
+	}
+	if override.Hibernated != 0 {
+		pricing.Hibernated = override.Hibernated
+	}
+
+	return pricing, nil
+}
+
+func getPricingTable(command *cobra.Command) (*pricingTable, error) {
+	pricingFile, _ := command.Flags().GetString("pricing-file")
+
+	return loadPricingTable(pricingFile)
+}
+
+func (p *pricingTable) hourlyCost(size string, hibernated bool) (float64, error) {
+	if hibernated {
+		return p.Hibernated, nil
+	}
+
+	cost, ok := p.Sizes[size]
+	if !ok {
+		return 0, errors.Errorf("no pricing found for size %s", size)
+	}
+
+	return cost, nil
+}
+
+// monthlyCostChange returns the estimated change in monthly cost of moving an
+// installation between two sizes or hibernation states. A negative value is a
+// saving.
+func (p *pricingTable) monthlyCostChange(fromSize string, fromHibernated bool, toSize string, toHibernated bool) (float64, error) {
+	fromCost, err := p.hourlyCost(fromSize, fromHibernated)
+	if err != nil {
+		return 0, err
+	}
+	toCost, err := p.hourlyCost(toSize, toHibernated)
+	if err != nil {
+		return 0, err
+	}
+
+	return (toCost - fromCost) * hoursPerMonth, nil
+}
+
+// monthlyCost returns the estimated monthly cost of an installation.
+func (p *pricingTable) monthlyCost(size string, hibernated bool) (float64, error) {
+	cost, err := p.hourlyCost(size, hibernated)
+	if err != nil {
+		return 0, err
+	}
+
+	return cost * hoursPerMonth, nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/fleet-controller/internal/journal"
+)
+
+func TestPricingTable(t *testing.T) {
+	pricing := &pricingTable{
+		Sizes: map[string]float64{
+			cloud10users:  1,
+			cloud100users: 2,
+		},
+		Hibernated: 0.5,
+	}
+
+	t.Run("scale up", func(t *testing.T) {
+		change, err := pricing.monthlyCostChange(cloud10users, false, cloud100users, false)
+		require.NoError(t, err)
+		assert.Equal(t, float64(hoursPerMonth), change)
+	})
+
+	t.Run("hibernate", func(t *testing.T) {
+		change, err := pricing.monthlyCostChange(cloud100users, false, cloud100users, true)
+		require.NoError(t, err)
+		assert.Equal(t, -1.5*hoursPerMonth, change)
+	})
+
+	t.Run("unknown size", func(t *testing.T) {
+		_, err := pricing.monthlyCostChange(cloud10users, false, size1000users, false)
+		assert.Error(t, err)
+	})
+}
+
+func TestSummarizeSavings(t *testing.T) {
+	entries := []*journal.Entry{
+		{RunID: "run1", Timestamp: 1, Action: "hibernate", MonthlyCostChange: -10},
+		{RunID: "run1", Timestamp: 2, Action: "hibernate", MonthlyCostChange: -5},
+		{RunID: "run2", Timestamp: 3, Action: "scale", MonthlyCostChange: 20},
+		{RunID: "run3", Timestamp: 4, Action: "hibernate", MonthlyCostChange: -1},
+	}
+
+	summaries := summarizeSavings(entries, 0, 0)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, &savingsSummary{action: "hibernate", runs: 2, installations: 3, monthlyCostChange: -16}, summaries[0])
+	assert.Equal(t, &savingsSummary{action: "scale", runs: 1, installations: 1, monthlyCostChange: 20}, summaries[1])
+
+	summaries = summarizeSavings(entries, 2, 4)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, &savingsSummary{action: "hibernate", runs: 1, installations: 1, monthlyCostChange: -5}, summaries[0])
+}
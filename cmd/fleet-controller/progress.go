@@ -0,0 +1,108 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/api"
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/webhook"
+)
+
+// progress records the plan and results of the current run when the run was
+// started by the API server.
+var progress *runProgress
+
+// runProgress keeps the status file of a run up to date. A nil runProgress is
+// valid and records nothing.
+type runProgress struct {
+	path   string
+	lock   sync.Mutex
+	status api.RunStatus
+}
+
+func newRunProgress(command *cobra.Command) *runProgress {
+	statusFile, _ := command.Flags().GetString(api.StatusFileFlag)
+	if len(statusFile) == 0 {
+		return nil
+	}
+
+	return &runProgress{path: statusFile}
+}
+
+// planned records an action the run intends to take.
+func (p *runProgress) planned(installationID, action, from, to string) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.status.Plan = append(p.status.Plan, &api.PlannedAction{
+		InstallationID: installationID,
+		Action:         action,
+		From:           from,
+		To:             to,
+	})
+	p.write()
+}
+
+// trackTasks wraps tasks so their results are recorded as they finish.
+func (p *runProgress) trackTasks(tasks []*executor.Task) []*executor.Task {
+	if p == nil {
+		return tasks
+	}
+
+	tracked := make([]*executor.Task, 0, len(tasks))
+	for _, task := range tasks {
+		task := task
+		tracked = append(tracked, &executor.Task{
+			InstallationID: task.InstallationID,
+			Run: func() error {
+				err := task.Run()
+
+				result := &api.InstallationResult{
+					InstallationID: task.InstallationID,
+					FinishedAt:     time.Now().UnixNano() / int64(time.Millisecond),
+				}
+				if err != nil {
+					result.Error = err.Error()
+				}
+				p.lock.Lock()
+				p.status.Results = append(p.status.Results, result)
+				p.write()
+				p.lock.Unlock()
+
+				return err
+			},
+		})
+	}
+
+	return tracked
+}
+
+// finished records the summary of the run.
+func (p *runProgress) finished(summary *webhook.RunSummary) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.status.Summary = summary
+	p.write()
+}
+
+func (p *runProgress) write() {
+	p.status.UpdatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	err := api.WriteStatusFile(p.path, &p.status)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to update run status file")
+	}
+}
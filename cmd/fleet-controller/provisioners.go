@@ -0,0 +1,207 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ory/viper"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/webhook"
+)
+
+// provisionerConfig is a provisioning server and the metrics source of the
+// installations it manages. Limits override the command flags when set.
+type provisionerConfig struct {
+	Name                  string  `mapstructure:"name"`
+	Server                string  `mapstructure:"server"`
+	ThanosURL             string  `mapstructure:"thanosURL"`
+	MaxUpdating           int64   `mapstructure:"maxUpdating"`
+	MaxUpdatingPerCluster int64   `mapstructure:"maxUpdatingPerCluster"`
+	MaxUpdatingPerGroup   int64   `mapstructure:"maxUpdatingPerGroup"`
+	Workers               int     `mapstructure:"workers"`
+	RateLimit             float64 `mapstructure:"rateLimit"`
+}
+
+type provisionersConfig struct {
+	Provisioners []provisionerConfig `mapstructure:"provisioners"`
+}
+
+func loadProvisionersConfig(filename string) (*provisionersConfig, error) {
+	v := viper.New()
+	v.SetConfigFile(filename)
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read provisioners config")
+	}
+
+	var config provisionersConfig
+	err = v.Unmarshal(&config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse provisioners config")
+	}
+
+	if len(config.Provisioners) == 0 {
+		return nil, errors.New("provisioners config contains no provisioners")
+	}
+	names := make(map[string]bool)
+	for _, provisioner := range config.Provisioners {
+		if len(provisioner.Name) == 0 {
+			return nil, errors.New("provisioner name must be defined")
+		}
+		if names[provisioner.Name] {
+			return nil, errors.Errorf("duplicate provisioner name %s", provisioner.Name)
+		}
+		names[provisioner.Name] = true
+		if len(provisioner.Server) == 0 {
+			return nil, errors.Errorf("provisioner %s has no server", provisioner.Name)
+		}
+	}
+
+	return &config, nil
+}
+
+// provisionerSettings are the settings of a run against a single
+// provisioning server. They come from the command flags, overridden by the
+// provisioners config when a run is fanned out.
+type provisionerSettings struct {
+	name                  string
+	server                string
+	thanosURL             string
+	maxUpdating           int64
+	maxUpdatingPerCluster int64
+	maxUpdatingPerGroup   int64
+	workers               int
+	rateLimit             float64
+	// fanOut collects the run summary when the run is fanned out across
+	// multiple provisioners so a single combined summary can be sent.
+	fanOut *provisionerFanOut
+}
+
+// newProvisionerSettings returns the settings of a run against the provisioner
+// from the config, or against the --server flag when config is nil.
+func newProvisionerSettings(command *cobra.Command, config *provisionerConfig) *provisionerSettings {
+	settings := &provisionerSettings{}
+	settings.server, _ = command.Flags().GetString("server")
+	settings.thanosURL, _ = command.Flags().GetString("thanos-url")
+	settings.maxUpdating, _ = command.Flags().GetInt64("max-updating")
+	settings.maxUpdatingPerCluster, _ = command.Flags().GetInt64("max-updating-per-cluster")
+	settings.maxUpdatingPerGroup, _ = command.Flags().GetInt64("max-updating-per-group")
+	settings.workers, _ = command.Flags().GetInt("workers")
+	settings.rateLimit, _ = command.Flags().GetFloat64("rate-limit")
+	if config == nil {
+		return settings
+	}
+
+	settings.name = config.Name
+	settings.server = config.Server
+	if len(config.ThanosURL) != 0 {
+		settings.thanosURL = config.ThanosURL
+	}
+	if config.MaxUpdating != 0 {
+		settings.maxUpdating = config.MaxUpdating
+	}
+	if config.MaxUpdatingPerCluster != 0 {
+		settings.maxUpdatingPerCluster = config.MaxUpdatingPerCluster
+	}
+	if config.MaxUpdatingPerGroup != 0 {
+		settings.maxUpdatingPerGroup = config.MaxUpdatingPerGroup
+	}
+	if config.Workers != 0 {
+		settings.workers = config.Workers
+	}
+	if config.RateLimit != 0 {
+		settings.rateLimit = config.RateLimit
+	}
+
+	return settings
+}
+
+// forEachProvisioner wraps a command so it runs once against every provisioner
+// in the provisioners config with the settings of that provisioner. Without a
+// config, the command runs once against its --server flag.
+func forEachProvisioner(run func(*cobra.Command, []string, *provisionerSettings) error) func(*cobra.Command, []string) error {
+	return func(command *cobra.Command, args []string) error {
+		configFile, _ := command.Flags().GetString("provisioners-config")
+		if len(configFile) == 0 {
+			return run(command, args, newProvisionerSettings(command, nil))
+		}
+
+		config, err := loadProvisionersConfig(configFile)
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		fanOut := &provisionerFanOut{}
+
+		var failures []string
+		for i := range config.Provisioners {
+			provisioner := &config.Provisioners[i]
+			err = runCancelled(command.Context())
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", provisioner.Name, err.Error()))
+				continue
+			}
+
+			settings := newProvisionerSettings(command, provisioner)
+			settings.fanOut = fanOut
+			logger.WithField("provisioner", provisioner.Name).Infof("Running %s against provisioner %s", command.Name(), provisioner.Server)
+			err = run(command, args, settings)
+			if err != nil {
+				logger.WithField("provisioner", provisioner.Name).WithError(err).Error("Run failed")
+				failures = append(failures, fmt.Sprintf("%s: %s", provisioner.Name, err.Error()))
+			}
+		}
+
+		fanOut.send(command, config, start)
+
+		if len(failures) != 0 {
+			return errors.Errorf("failed on %d of %d provisioners (%s)", len(failures), len(config.Provisioners), strings.Join(failures, "; "))
+		}
+
+		return nil
+	}
+}
+
+// provisionerFanOut collects run summaries by provisioner.
+type provisionerFanOut struct {
+	names     []string
+	summaries []*webhook.RunSummary
+}
+
+func (f *provisionerFanOut) add(provisioner string, summary *webhook.RunSummary) {
+	f.names = append(f.names, provisioner)
+	f.summaries = append(f.summaries, summary)
+}
+
+// send sends a summary combining the results of every provisioner.
+func (f *provisionerFanOut) send(command *cobra.Command, config *provisionersConfig, start time.Time) {
+	if len(f.summaries) == 0 {
+		return
+	}
+
+	first := f.summaries[0]
+	combined := newRunSummary(first.Title, first.Action, first.DryRun)
+	var names []string
+	for _, provisioner := range config.Provisioners {
+		names = append(names, provisioner.Name)
+	}
+	combined.AddFilter("Provisioners", strings.Join(names, ", "))
+	for i, summary := range f.summaries {
+		combined.Merge(f.names[i], summary)
+	}
+
+	notifier, err := newRunNotifier(command)
+	if err != nil {
+		logger.WithError(err).Error("Failed to create notifier")
+		return
+	}
+	notifier.sendRunSummary(combined, start, logger)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeProvisionersConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "provisioners")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	filename := filepath.Join(dir, "provisioners.yaml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0600))
+
+	return filename
+}
+
+func TestLoadProvisionersConfig(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		config, err := loadProvisionersConfig(writeProvisionersConfig(t, `
+provisioners:
+  - name: us-east
+    server: http://east:8075
+    thanosURL: http://thanos-east
+    maxUpdating: 10
+  - name: eu-west
+    server: http://west:8075
+    rateLimit: 2.5
+`))
+		require.NoError(t, err)
+		require.Len(t, config.Provisioners, 2)
+
+		command := &cobra.Command{}
+		command.Flags().String("server", "http://localhost:8075", "")
+		command.Flags().Int64("max-updating", 5, "")
+		addExecutorFlags(command, time.Minute, time.Hour)
+		require.NoError(t, command.ParseFlags(nil))
+
+		assert.Equal(t, &provisionerSettings{
+			server:      "http://localhost:8075",
+			maxUpdating: 5,
+			workers:     5,
+			rateLimit:   10,
+		}, newProvisionerSettings(command, nil))
+		assert.Equal(t, &provisionerSettings{
+			name:        "us-east",
+			server:      "http://east:8075",
+			thanosURL:   "http://thanos-east",
+			maxUpdating: 10,
+			workers:     5,
+			rateLimit:   10,
+		}, newProvisionerSettings(command, &config.Provisioners[0]))
+		assert.Equal(t, &provisionerSettings{
+			name:        "eu-west",
+			server:      "http://west:8075",
+			maxUpdating: 5,
+			workers:     5,
+			rateLimit:   2.5,
+		}, newProvisionerSettings(command, &config.Provisioners[1]))
+	})
+
+	t.Run("duplicate names", func(t *testing.T) {
+		_, err := loadProvisionersConfig(writeProvisionersConfig(t, `
+provisioners:
+  - name: us-east
+    server: http://east:8075
+  - name: us-east
+    server: http://west:8075
+`))
+		assert.Error(t, err)
+	})
+
+	t.Run("missing server", func(t *testing.T) {
+		_, err := loadProvisionersConfig(writeProvisionersConfig(t, `
+provisioners:
+  - name: us-east
+`))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/internal/webhook"
+)
+
+func init() {
+	reportSavingsCmd.PersistentFlags().String("since", "", "Only include runs on or after this day (YYYY-MM-DD).")
+	reportSavingsCmd.PersistentFlags().String("until", "", "Only include runs before this day (YYYY-MM-DD).")
+
+	reportCmd.AddCommand(reportSavingsCmd)
+}
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Generate reports on the fleet and on past fleet controller runs",
+}
+
+var reportSavingsCmd = &cobra.Command{
+	Use:   "savings",
+	Short: "Aggregate estimated cost changes of past runs from the journal",
+	RunE: func(command *cobra.Command, args []string) error {
+		command.SilenceUsage = true
+
+		journalDir, _ := command.Flags().GetString("journal-dir")
+		sinceValue, _ := command.Flags().GetString("since")
+		untilValue, _ := command.Flags().GetString("until")
+
+		if len(journalDir) == 0 {
+			return errors.New("journal-dir value must be defined")
+		}
+
+		var since, until int64
+		if len(sinceValue) != 0 {
+			parsed, err := time.Parse(simulateDateLayout, sinceValue)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse since date")
+			}
+			since = parsed.UnixNano() / int64(time.Millisecond)
+		}
+		if len(untilValue) != 0 {
+			parsed, err := time.Parse(simulateDateLayout, untilValue)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse until date")
+			}
+			until = parsed.UnixNano() / int64(time.Millisecond)
+		}
+
+		entries, err := journal.ReadAll(journalDir)
+		if err != nil {
+			return err
+		}
+
+		summaries := summarizeSavings(entries, since, until)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ACTION\tRUNS\tINSTALLATIONS\tMONTHLY COST CHANGE")
+		var total float64
+		for _, summary := range summaries {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", summary.action, summary.runs, summary.installations, webhook.FormatCost(summary.monthlyCostChange))
+			total += summary.monthlyCostChange
+		}
+		fmt.Fprintf(w, "TOTAL\t\t\t%s\n", webhook.FormatCost(total))
+
+		return w.Flush()
+	},
+}
+
+type savingsSummary struct {
+	action            string
+	runs              int
+	installations     int
+	monthlyCostChange float64
+}
+
+// summarizeSavings aggregates journal entries by action. Entries outside of
+// the since and until timestamps are ignored; a zero value disables the bound.
+func summarizeSavings(entries []*journal.Entry, since, until int64) []*savingsSummary {
+	summaries := make(map[string]*savingsSummary)
+	runs := make(map[string]map[string]bool)
+
+	for _, entry := range entries {
+		if since != 0 && entry.Timestamp < since {
+			continue
+		}
+		if until != 0 && entry.Timestamp >= until {
+			continue
+		}
+
+		summary, ok := summaries[entry.Action]
+		if !ok {
+			summary = &savingsSummary{action: entry.Action}
+			summaries[entry.Action] = summary
+			runs[entry.Action] = make(map[string]bool)
+		}
+		if !runs[entry.Action][entry.RunID] {
+			runs[entry.Action][entry.RunID] = true
+			summary.runs++
+		}
+		summary.installations++
+		summary.monthlyCostChange += entry.MonthlyCostChange
+	}
+
+	var results []*savingsSummary
+	for _, summary := range summaries {
+		results = append(results, summary)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].action < results[j].action
+	})
+
+	return results
+}
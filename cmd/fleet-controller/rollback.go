@@ -0,0 +1,67 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// rollbackPolicy decides when a scale action is reverted to the previous size.
+type rollbackPolicy struct {
+	enabled           bool
+	healthQuery       string
+	healthMaxIncrease float64
+	healthDelay       time.Duration
+}
+
+func newRollbackPolicy(command *cobra.Command) (*rollbackPolicy, error) {
+	enabled, _ := command.Flags().GetBool("rollback")
+	healthQuery, _ := command.Flags().GetString("rollback-health-query")
+	healthMaxIncrease, _ := command.Flags().GetFloat64("rollback-health-max-increase")
+	healthDelay, _ := command.Flags().GetDuration("rollback-health-delay")
+
+	if len(healthQuery) != 0 && !enabled {
+		return nil, errors.New("rollback-health-query requires rollback to be enabled")
+	}
+	if healthMaxIncrease < 0 {
+		return nil, errors.New("rollback-health-max-increase must not be negative")
+	}
+
+	return &rollbackPolicy{
+		enabled:           enabled,
+		healthQuery:       healthQuery,
+		healthMaxIncrease: healthMaxIncrease,
+		healthDelay:       healthDelay,
+	}, nil
+}
+
+// checksHealth returns whether the policy compares a health metric from before
+// and after each action.
+func (p *rollbackPolicy) checksHealth() bool {
+	return p.enabled && len(p.healthQuery) != 0
+}
+
+// healthDegraded returns an error if the health metric of an installation
+// increased by more than the allowed amount. Installations without a value
+// before or after the action are not checked.
+func (p *rollbackPolicy) healthDegraded(installationID string, before, after map[string]float64) error {
+	previous, ok := before[installationID]
+	if !ok {
+		return nil
+	}
+	current, ok := after[installationID]
+	if !ok {
+		return nil
+	}
+
+	if current-previous > p.healthMaxIncrease {
+		return errors.Errorf("health metric increased from %.4f to %.4f", previous, current)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/fleet-controller/internal/executor"
+)
+
+func TestRollbackPolicyHealthDegraded(t *testing.T) {
+	policy := &rollbackPolicy{enabled: true, healthQuery: "query", healthMaxIncrease: 0.05}
+	before := map[string]float64{"a": 0.01, "b": 0.01, "c": 0.01}
+	after := map[string]float64{"a": 0.02, "b": 0.2, "d": 0.5}
+
+	assert.NoError(t, policy.healthDegraded("a", before, after))
+	assert.Error(t, policy.healthDegraded("b", before, after))
+	assert.NoError(t, policy.healthDegraded("c", before, after))
+	assert.NoError(t, policy.healthDegraded("d", before, after))
+	assert.True(t, policy.checksHealth())
+}
+
+func TestRollbackScaleActions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollback")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	previousProgress := progress
+	progress = &runProgress{path: filepath.Join(dir, "status.json")}
+	defer func() { progress = previousProgress }()
+
+	installation := &cmodel.InstallationDTO{Installation: &cmodel.Installation{ID: "id1", Size: size5000users}}
+	actionsByID := map[string]*scaleAction{
+		"id1": {installation: installation, previousSize: size1000users, newSize: size5000users},
+	}
+	exec := executor.New(executor.Config{MaxUpdating: 10}, func() (*executor.Status, error) { return &executor.Status{}, nil }, logger)
+	summary := newRunSummary("Scaling Report", "scale", false)
+
+	rolledBack := rollbackScaleActions(context.Background(), map[string]error{"id1": errors.New("stalled")}, actionsByID, exec, nil, &mockRetryClient{}, nil, summary, logger)
+	assert.Equal(t, []string{"id1"}, rolledBack)
+	assert.Empty(t, summary.Errors)
+	require.Len(t, summary.Changes, 1)
+	assert.Equal(t, size5000users, summary.Changes[0].From)
+	assert.Equal(t, size1000users, summary.Changes[0].To)
+
+	require.Len(t, progress.status.Plan, 1)
+	assert.Equal(t, "scale-rollback", progress.status.Plan[0].Action)
+	require.Len(t, progress.status.Results, 1)
+	assert.Empty(t, progress.status.Results[0].Error)
+}
@@ -5,13 +5,17 @@
 package main
 
 import (
+	"context"
 	"math/rand"
 	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
-	"github.com/mattermost/fleet-controller/internal/metrics"
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/internal/webhook"
 	"github.com/mattermost/fleet-controller/model"
 	cmodel "github.com/mattermost/mattermost-cloud/model"
 )
@@ -23,6 +27,19 @@ func init() {
 	scaleCmd.PersistentFlags().Bool("unlock", false, "Whether the autoscaler will unlock installations to update their size or not.")
 	scaleCmd.PersistentFlags().Int64("max-updating", 5, "The maximum number of installations that can be currently updating before resizing another batch.")
 	scaleCmd.PersistentFlags().Int32("batch-size", 3, "The maximum number of installations to resize in a single batch.")
+	addExecutorFlags(scaleCmd, 15*time.Second, 0)
+	addVerificationFlags(scaleCmd, 30*time.Minute)
+	addTargetFlags(scaleCmd)
+	addForceFlags(scaleCmd)
+	addSelectorFlag(scaleCmd)
+
+	addClusterCapacityFlags(scaleCmd)
+
+	// Rollback policy
+	scaleCmd.PersistentFlags().Bool("rollback", false, "Whether installations that fail or don't return to stable within the verify timeout are scaled back to their previous size. Enables verification.")
+	scaleCmd.PersistentFlags().String("rollback-health-query", "", "Optional Thanos query returning a health metric per installationId, such as an HTTP error rate. Installations are scaled back when the value rises after scaling.")
+	scaleCmd.PersistentFlags().Float64("rollback-health-max-increase", 0.05, "The maximum increase in the health metric that is allowed after scaling.")
+	scaleCmd.PersistentFlags().Duration("rollback-health-delay", 5*time.Minute, "How long to wait after installations are stable before checking the health metric.")
 
 	scaleCmd.PersistentFlags().Bool("fun-mode", true, "Randomizes installation scaling order when disabled which distributes load better. Turn this off if you hate adventure, being generally awesome, and hanging out with the cloud family in the prod alerts channel...")
 
@@ -34,20 +51,24 @@ func init() {
 var scaleCmd = &cobra.Command{
 	Use:   "scale",
 	Short: "Scale installations based on user counts",
-	RunE: func(command *cobra.Command, args []string) error {
+	RunE: forEachProvisioner(func(command *cobra.Command, args []string, settings *provisionerSettings) error {
 		command.SilenceUsage = true
+		ctx, cancel := newRunContext(command)
+		defer cancel()
 
 		productionLogs, _ := command.Flags().GetBool("production-logs")
-		logger := setupLogger("scale", productionLogs)
+		logger := setupLogger("scale", productionLogs, settings.name)
 
 		logger.Info("Starting installation autoscaler")
 
-		serverAddress, _ := command.Flags().GetString("server")
-		thanosURL, _ := command.Flags().GetString("thanos-url")
+		start := time.Now()
+
+		serverAddress := settings.server
+		thanosURL := settings.thanosURL
 		dryrun, _ := command.Flags().GetBool("dry-run")
 		unlock, _ := command.Flags().GetBool("unlock")
 		funMode, _ := command.Flags().GetBool("fun-mode")
-		maxUpdating, _ := command.Flags().GetInt64("max-updating")
+		maxUpdating := settings.maxUpdating
 		batchSize, _ := command.Flags().GetInt32("batch-size")
 		owner, _ := command.Flags().GetString("owner")
 		group, _ := command.Flags().GetString("group")
@@ -59,38 +80,134 @@ var scaleCmd = &cobra.Command{
 			return errors.New("thanos-url value must be defined")
 		}
 
-		client := cmodel.NewClient(serverAddress)
+		targets, err := newInstallationTargets(command)
+		if err != nil {
+			return err
+		}
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+		pricing, err := getPricingTable(command)
+		if err != nil {
+			return err
+		}
+		runJournal, err := newJournal(command, "scale", settings.name)
+		if err != nil {
+			return err
+		}
+
+		notifier, err := newProvisionerNotifier(command, settings)
+		if err != nil {
+			return err
+		}
 
-		for {
-			logger.Info("Obtaining current installation sizes")
-			installations, err := client.GetInstallations(&cmodel.GetInstallationsRequest{
-				OwnerID:                     owner,
-				GroupID:                     group,
-				State:                       cmodel.InstallationStateStable,
-				IncludeGroupConfig:          false,
-				IncludeGroupConfigOverrides: false,
-				Paging: cmodel.Paging{
-					Page:           0,
-					PerPage:        cmodel.AllPerPage,
-					IncludeDeleted: false,
-				},
-			})
+		summary := newRunSummary("Scaling Report", "scale", dryrun)
+		summary.AddFilter("Max Updating", maxUpdating)
+		summary.AddFilter("Batch Size", batchSize)
+		summary.AddFilter("Group ID", group)
+		summary.AddFilter("Owner ID", owner)
+		summary.AddFilter("Selector", sel)
+		targets.addFilters(summary)
+
+		client := newProvisionerClient(settings)
+		tc, err := newThanosClient(command, thanosURL)
+		if err != nil {
+			return err
+		}
+		defer logMetricsCacheStats(tc, logger)
+
+		capacity, err := newClusterCapacity(command)
+		if err != nil {
+			return err
+		}
+		rollback, err := newRollbackPolicy(command)
+		if err != nil {
+			return err
+		}
+		verify := newVerification(command)
+		if rollback.enabled {
+			verify.enabled = true
+		}
+		exec, err := newExecutor(command, settings, client, logger)
+		if err != nil {
+			return err
+		}
+
+		var leader *runLock
+		if !dryrun {
+			leader, err = acquireRunLock(command, settings, cancel, logger)
 			if err != nil {
-				return errors.Wrap(err, "failed to get installations")
+				return err
 			}
+			defer leader.release(logger)
+		}
 
-			var scaled, updating int32
-			if !model.InstallationsUpdatingIsBelowMax(maxUpdating, client, logger) {
-				logger.Info("Requeing scale actions after 15 seconds")
-				time.Sleep(15 * time.Second)
-				continue
+		var estimatedMonthlyCostChange float64
+		var originalInstallationCount, scaledUp, scaledDown int
+		missingMetrics := make(map[string]bool)
+		lockedSkips := make(map[string]bool)
+		failed := make(map[string]bool)
+		rolledBack := make(map[string]bool)
+		deferred := make(map[string]bool)
+		flagged := make(map[string]bool)
+		missingTargets := make(map[string]bool)
+		var runErr error
+		for {
+			runErr = runCancelled(ctx)
+			if runErr != nil {
+				break
 			}
 
-			tc := metrics.NewThanosClient(thanosURL)
+			logger.Info("Obtaining current installation sizes")
+			var installations []*cmodel.InstallationDTO
+			if targets.enabled() {
+				var missing []string
+				installations, missing, err = targets.getInstallations(ctx, client)
+				if err != nil {
+					runErr = runCancelled(ctx)
+					if runErr != nil {
+						break
+					}
+					return err
+				}
+				for _, id := range missing {
+					if missingTargets[id] {
+						continue
+					}
+					logger.Warnf("%s - Could not find installation", id)
+					summary.AddError(id, errors.New("installation not found"))
+					missingTargets[id] = true
+				}
+			} else {
+				installations, err = client.GetInstallations(&cmodel.GetInstallationsRequest{
+					OwnerID:                     owner,
+					GroupID:                     group,
+					State:                       cmodel.InstallationStateStable,
+					IncludeGroupConfig:          false,
+					IncludeGroupConfigOverrides: false,
+					Paging: cmodel.Paging{
+						Page:           0,
+						PerPage:        cmodel.AllPerPage,
+						IncludeDeleted: false,
+					},
+				})
+				if err != nil {
+					return errors.Wrap(err, "failed to get installations")
+				}
+			}
+			installations = sel.Filter(installations)
+			if originalInstallationCount == 0 {
+				originalInstallationCount = len(installations)
+			}
 
 			logger.Info("Gathering installation user metrics")
-			metrics, err := tc.GetInstallationUserMetrics()
+			metrics, err := tc.GetInstallationUserMetrics(ctx)
 			if err != nil {
+				runErr = runCancelled(ctx)
+				if runErr != nil {
+					break
+				}
 				return errors.Wrap(err, "failed to obtain installation metrics")
 			}
 
@@ -101,95 +218,386 @@ var scaleCmd = &cobra.Command{
 				})
 			}
 
+			err = capacity.refresh(ctx, client, tc)
+			if err != nil {
+				runErr = runCancelled(ctx)
+				if runErr != nil {
+					break
+				}
+				return errors.Wrap(err, "failed to obtain cluster capacity")
+			}
+
 			logger.Info("Calculating scale actions")
+			var actions []*scaleAction
+			batchClusterScaleUps := make(map[string]int)
 			for _, installation := range installations {
-				if batchSize != 0 && scaled >= batchSize {
+				if batchSize != 0 && len(actions) >= int(batchSize) {
 					break
 				}
+				if failed[installation.ID] || rolledBack[installation.ID] || deferred[installation.ID] {
+					continue
+				}
 
 				userCount, ok := metrics[installation.ID]
 				if !ok {
 					logger.Warnf("%s - No user metrics found; skipping...", installation.ID)
+					missingMetrics[installation.ID] = true
 					continue
 				}
 				newSize, err := getSuggestedScaleSize(installation.Size, userCount)
 				if err != nil {
 					return errors.Wrap(err, "failed to determine if installation should be scaled")
 				}
+				if installation.Size == newSize {
+					continue
+				}
 
-				if installation.Size != newSize {
-					logger.Debugf("%s - %s -> %s (%d users)", installation.ID, installation.Size, newSize, userCount)
+				logger.Debugf("%s - %s -> %s (%d users)", installation.ID, installation.Size, newSize, userCount)
 
-					if installation.State != cmodel.InstallationStateStable {
-						logger.Warnf("%s - Installation is not stable; skipping...", installation.ID)
-						continue
-					}
+				if installation.State != cmodel.InstallationStateStable {
+					logger.Warnf("%s - Installation is not stable; skipping...", installation.ID)
+					continue
+				}
+				if installation.APISecurityLock && !unlock {
+					logger.Warnf("%s - Installation is locked and autoscaler is not set to perform unlocks; skipping...", installation.ID)
+					lockedSkips[installation.ID] = true
+					continue
+				}
 
-					if installation.APISecurityLock && !unlock {
-						logger.Warnf("%s - Installation is locked and autoscaler is not set to perform unlocks; skipping...", installation.ID)
+				var reserved bool
+				scaleUp := scaleDictionary.isAtLeast(newSize, installation.Size)
+				cluster := capacity.cluster(installation.ID)
+				if scaleUp && !targets.force && capacity.maxScaleUpsPerCluster > 0 && len(cluster) != 0 && batchClusterScaleUps[cluster] >= capacity.maxScaleUpsPerCluster {
+					logger.Debugf("%s - Cluster %s already has %d scale ups in this batch; requeuing...", installation.ID, cluster, batchClusterScaleUps[cluster])
+					continue
+				}
+				if capacity.isLargeScaleUp(installation.Size, newSize) {
+					err = capacity.checkRoom(installation.ID)
+					if err != nil && !capacity.flagOnly && !targets.force {
+						logger.WithError(err).Warnf("%s - Not enough cluster capacity; deferring scale up...", installation.ID)
+						summary.AddError(installation.ID, errors.Wrapf(err, "scale up to %s deferred", newSize))
+						deferred[installation.ID] = true
 						continue
 					}
-
-					scaled++
+					if err != nil {
+						logger.WithError(err).Warnf("%s - Not enough cluster capacity; scaling up anyway", installation.ID)
+						summary.AddError(installation.ID, errors.Wrapf(err, "scaled up to %s without cluster capacity", newSize))
+						flagged[installation.ID] = true
+					}
+					capacity.reserve(installation.ID)
+					reserved = true
 				}
-				if dryrun || installation.Size == newSize {
-					continue
+				if scaleUp {
+					batchClusterScaleUps[cluster]++
 				}
 
-				// Take resizing action.
-				err = scaleInstallation(newSize, installation, client)
+				change, err := pricing.monthlyCostChange(installation.Size, false, newSize, false)
 				if err != nil {
-					return errors.Wrap(err, "failed to scale installation")
+					logger.WithError(err).Warnf("%s - Failed to estimate cost change", installation.ID)
 				}
 
-				time.Sleep(500 * time.Millisecond)
+				actions = append(actions, &scaleAction{
+					installation:      installation,
+					previousSize:      installation.Size,
+					newSize:           newSize,
+					userCount:         userCount,
+					monthlyCostChange: change,
+					reserved:          reserved,
+				})
+				progress.planned(installation.ID, "scale", installation.Size, newSize)
 			}
 
-			logger.Infof("Scaling Stats: %d total, %d scale, %d currently updating", len(installations), scaled, updating)
+			logger.Infof("Scaling Stats: %d total, %d scale", len(installations), len(actions))
 
-			if scaled == 0 || dryrun {
+			if dryrun {
+				for _, action := range actions {
+					estimatedMonthlyCostChange += action.monthlyCostChange
+				}
+				break
+			}
+			if len(actions) == 0 {
 				break
 			}
 
-			logger.Info("Requeing scale actions after 15 seconds")
-			time.Sleep(15 * time.Second)
+			var healthBefore map[string]float64
+			if rollback.checksHealth() {
+				healthBefore, err = tc.GetInstallationHealthMetrics(ctx, rollback.healthQuery)
+				if err != nil {
+					runErr = runCancelled(ctx)
+					if runErr != nil {
+						break
+					}
+					return errors.Wrap(err, "failed to obtain installation health metrics")
+				}
+			}
+
+			tasks := make([]*executor.Task, 0, len(actions))
+			actionsByID := make(map[string]*scaleAction, len(actions))
+			for _, action := range actions {
+				action := action
+				actionsByID[action.installation.ID] = action
+				tasks = append(tasks, &executor.Task{
+					InstallationID: action.installation.ID,
+					Run: func() error {
+						err := scaleInstallation(action.newSize, action.installation, client)
+						if err != nil {
+							return err
+						}
+
+						recordJournalEntry(runJournal, &journal.Entry{
+							InstallationID:    action.installation.ID,
+							Action:            "scale",
+							PreviousSize:      action.previousSize,
+							NewSize:           action.newSize,
+							PreviousState:     action.installation.State,
+							NewState:          cmodel.InstallationStateUpdateRequested,
+							MonthlyCostChange: action.monthlyCostChange,
+							APISecurityLock:   action.installation.APISecurityLock,
+						}, logger)
+
+						return nil
+					},
+				})
+			}
+
+			var results []*executor.Result
+			results, runErr = exec.Run(ctx, progress.trackTasks(leader.lockTasks(tasks)))
+
+			var expectations []*model.Expectation
+			for _, result := range results {
+				if result.Err != nil {
+					logger.WithError(result.Err).Errorf("%s - Failed to scale installation", result.InstallationID)
+					summary.AddError(result.InstallationID, result.Err)
+					failed[result.InstallationID] = true
+					if actionsByID[result.InstallationID].reserved {
+						capacity.release(result.InstallationID)
+					}
+					continue
+				}
+
+				action := actionsByID[result.InstallationID]
+				estimatedMonthlyCostChange += action.monthlyCostChange
+				summary.AddChange(result.InstallationID, action.previousSize, action.newSize)
+				expectations = append(expectations, verify.expect(result.InstallationID, result.FinishedAt, action.newSize, cmodel.InstallationStateStable))
+				if isScaleUp(action.previousSize, action.userCount) {
+					scaledUp++
+				} else {
+					scaledDown++
+				}
+			}
+			verificationResults := verify.run(ctx, client, expectations, summary, logger)
+
+			if rollback.enabled && ctx.Err() == nil {
+				reasons := make(map[string]error)
+				var verified []string
+				for _, result := range verificationResults {
+					if result.Err != nil {
+						reasons[result.InstallationID] = result.Err
+						continue
+					}
+					verified = append(verified, result.InstallationID)
+				}
+
+				if rollback.checksHealth() && len(verified) != 0 {
+					logger.Infof("Checking health of %d scaled installations in %s", len(verified), rollback.healthDelay)
+					select {
+					case <-ctx.Done():
+					case <-time.After(rollback.healthDelay):
+					}
+
+					healthAfter, err := tc.GetInstallationHealthMetrics(ctx, rollback.healthQuery)
+					if err != nil {
+						logger.WithError(err).Error("Failed to check installation health after scaling")
+						summary.AddError("", errors.Wrap(err, "failed to check installation health after scaling"))
+					} else {
+						for _, id := range verified {
+							err = rollback.healthDegraded(id, healthBefore, healthAfter)
+							if err != nil {
+								logger.WithError(err).Warnf("%s - Installation health degraded after scaling", id)
+								summary.AddError(id, err)
+								reasons[id] = err
+							}
+						}
+					}
+				}
+
+				for _, id := range rollbackScaleActions(ctx, reasons, actionsByID, exec, leader, client, runJournal, summary, logger) {
+					rolledBack[id] = true
+					estimatedMonthlyCostChange -= actionsByID[id].monthlyCostChange
+				}
+			}
+			if runErr != nil {
+				break
+			}
 		}
 
+		logger = logger.WithField("estimated-monthly-cost-change", estimatedMonthlyCostChange)
 		if dryrun {
 			logger.Info("Dry run complete")
-		} else {
-			logger.Info("Scaling complete")
+			return runErr
+		}
+
+		if runErr != nil {
+			logger.WithError(runErr).Error("Scaling stopped early")
+			summary.AddError("", runErr)
+		}
+		summary.AddCount("Original Stable Installations", originalInstallationCount)
+		summary.AddCount("Installations Scaled Up", scaledUp)
+		summary.AddCount("Installations Scaled Down", scaledDown)
+		summary.AddCount("Installations Skipped (Locked)", len(lockedSkips))
+		summary.AddCount("Installations Skipped (No Metrics)", len(missingMetrics))
+		summary.AddCount("Scaling Failures", len(failed))
+		if capacity.checksCapacity() {
+			summary.AddCount("Scale Ups Deferred (Cluster Capacity)", len(deferred))
+			summary.AddCount("Scale Ups Flagged (Cluster Capacity)", len(flagged))
+		}
+		if rollback.enabled {
+			summary.AddCount("Scaling Rollbacks", len(rolledBack))
+		}
+		verify.addCounts(summary)
+		summary.EstimatedMonthlyCostChange = estimatedMonthlyCostChange
+		notifier.sendRunReport(ctx, summary, start, logger)
+
+		logger.WithField("runtime", summary.Runtime).Info("Scaling complete")
+
+		if runErr != nil {
+			return runErr
+		}
+		if len(failed) != 0 {
+			return errors.Errorf("failed to scale %d installations", len(failed))
+		}
+		if verify.failed != 0 {
+			return errors.Errorf("%d scaled installations failed verification", verify.failed)
+		}
+		if len(rolledBack) != 0 {
+			return errors.Errorf("%d scaled installations were rolled back", len(rolledBack))
 		}
 
 		return nil
-	},
+	}),
 }
 
-func scaleInstallation(newSize string, installation *cmodel.InstallationDTO, client *cmodel.Client) error {
-	var relock bool
-	var err error
+// scaleAction is a size change to make to an installation.
+type scaleAction struct {
+	installation      *cmodel.InstallationDTO
+	previousSize      string
+	newSize           string
+	userCount         int64
+	monthlyCostChange float64
+	// reserved is whether the action counts against the cluster budgets.
+	reserved bool
+}
 
+// rollbackScaleActions scales installations back to their previous size and
+// returns the IDs of the installations that were rolled back.
+func rollbackScaleActions(ctx context.Context, reasons map[string]error, actionsByID map[string]*scaleAction, exec *executor.Executor, leader *runLock, client model.ProvisionerClient, runJournal *journal.Journal, summary *webhook.RunSummary, logger log.FieldLogger) []string {
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	var tasks []*executor.Task
+	for id, reason := range reasons {
+		action := actionsByID[id]
+		logger.WithError(reason).Warnf("%s - Rolling back %s -> %s", id, action.newSize, action.previousSize)
+		progress.planned(id, "scale-rollback", action.newSize, action.previousSize)
+		tasks = append(tasks, &executor.Task{
+			InstallationID: id,
+			Run: func() error {
+				err := scaleInstallation(action.previousSize, action.installation, client)
+				if err != nil {
+					return err
+				}
+
+				recordJournalEntry(runJournal, &journal.Entry{
+					InstallationID:    action.installation.ID,
+					Action:            "scale-rollback",
+					PreviousSize:      action.newSize,
+					NewSize:           action.previousSize,
+					NewState:          cmodel.InstallationStateUpdateRequested,
+					MonthlyCostChange: -action.monthlyCostChange,
+					APISecurityLock:   action.installation.APISecurityLock,
+				}, logger)
+
+				return nil
+			},
+		})
+	}
+
+	results, err := exec.Run(ctx, progress.trackTasks(leader.lockTasks(tasks)))
+	if err != nil {
+		logger.WithError(err).Error("Not all rollbacks were attempted")
+		summary.AddError("", errors.Wrap(err, "not all rollbacks were attempted"))
+	}
+
+	var rolledBack []string
+	for _, result := range results {
+		action := actionsByID[result.InstallationID]
+		if result.Err != nil {
+			logger.WithError(result.Err).Errorf("%s - Failed to roll back scaling", result.InstallationID)
+			summary.AddError(result.InstallationID, errors.Wrapf(result.Err, "failed to roll back to %s", action.previousSize))
+			continue
+		}
+		summary.AddChange(result.InstallationID, action.newSize, action.previousSize)
+		rolledBack = append(rolledBack, result.InstallationID)
+	}
+
+	return rolledBack
+}
+
+func scaleInstallation(newSize string, installation *cmodel.InstallationDTO, client model.ProvisionerClient) error {
+	return patchInstallation(installation, &cmodel.PatchInstallationRequest{
+		Size: &newSize,
+	}, client)
+}
+
+// patchInstallation applies a patch to an installation with its API unlocked.
+func patchInstallation(installation *cmodel.InstallationDTO, patch *cmodel.PatchInstallationRequest, client model.ProvisionerClient) error {
+	return withUnlockedAPI(installation, client, func() error {
+		_, err := client.UpdateInstallation(installation.ID, patch)
+		if err != nil {
+			return errors.Wrap(err, "failed to update installation")
+		}
+
+		return nil
+	})
+}
+
+// withUnlockedAPI runs an update of an installation, unlocking its API first
+// if it is locked. A locked installation is always locked again afterwards,
+// even if the update fails.
+func withUnlockedAPI(installation *cmodel.InstallationDTO, client model.ProvisionerClient, update func() error) (err error) {
 	if installation.APISecurityLock {
 		err = client.UnlockAPIForInstallation(installation.ID)
 		if err != nil {
 			return errors.Wrapf(err, "failed to unlock installation %s", installation.ID)
 		}
-		relock = true
+		defer func() {
+			lockErr := client.LockAPIForInstallation(installation.ID)
+			if lockErr == nil {
+				return
+			}
+			if err != nil {
+				err = errors.Wrapf(err, "failed to relock installation %s (%s)", installation.ID, lockErr)
+				return
+			}
+			err = errors.Wrapf(lockErr, "failed to relock installation %s", installation.ID)
+		}()
 	}
 
-	installation, err = client.UpdateInstallation(installation.ID, &cmodel.PatchInstallationRequest{
-		Size: &newSize,
-	})
+	return update()
+}
+
+// refreshInstallation gets the current state of an installation an action was
+// planned for. The installation may have changed while the run was waiting to
+// act on it, so the checks made when planning must be made again.
+func refreshInstallation(installationID string, client model.ProvisionerClient) (*cmodel.InstallationDTO, error) {
+	installation, err := client.GetInstallation(installationID, &cmodel.GetInstallationRequest{})
 	if err != nil {
-		return errors.Wrap(err, "failed to update installation size")
+		return nil, errors.Wrap(err, "failed to get installation")
 	}
-
-	if relock {
-		err = client.LockAPIForInstallation(installation.ID)
-		if err != nil {
-			return errors.Wrapf(err, "failed to relock installation %s", installation.ID)
-		}
+	if installation == nil {
+		return nil, errors.New("installation not found")
 	}
 
-	return nil
+	return installation, nil
 }
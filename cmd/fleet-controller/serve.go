@@ -0,0 +1,133 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ory/viper"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/mattermost/fleet-controller/internal/api"
+)
+
+func init() {
+	serveCmd.PersistentFlags().String("listen", "localhost:8077", "The address the API listens on.")
+	serveCmd.PersistentFlags().String("data-dir", "", "The directory the logs and status of runs are stored in.")
+	serveCmd.PersistentFlags().String("api-token", viper.GetString("API_TOKEN"), "The bearer token required on every API request | ENV: FC_API_TOKEN")
+	serveCmd.PersistentFlags().Bool("insecure", false, "Allows the API to run without an API token, leaving it unauthenticated.")
+	serveCmd.PersistentFlags().Duration("cancel-timeout", 5*time.Minute, "How long a cancelled run has to stop gracefully before it is killed.")
+}
+
+// serveActions are the commands that runs can be started for through the API.
+var serveActions = []string{"scale", "hibernate", "wake-up", "delete", "upgrade", "env", "annotate", "stuck", "undo"}
+
+// serveParameters are the action flags runs started through the API may set.
+// Flags choosing the provisioning server, notification sinks, files or locks
+// are fixed by the flags the API is started with. Runs are dry runs unless
+// the request sets dry-run to false.
+var serveParameters = []string{
+	// Mode
+	"dry-run",
+	// Installation selection
+	"selector", "owner", "group", "installation", "annotation", "exclude-annotation", "force", "force-reason",
+	// Execution limits
+	"unlock", "max-updating", "max-updating-per-cluster", "max-updating-per-group", "max-scale-ups-per-cluster",
+	"workers", "min-workers", "batch-size", "poll-interval", "action-timeout", "run-timeout",
+	// Action settings
+	"fun-mode", "rollback", "rollback-health-max-increase", "rollback-health-delay",
+	"cluster-max-utilization", "cluster-check-min-size", "cluster-flag-only",
+	"days", "max-users", "version", "image", "waves", "max-failure-rate",
+	"add", "remove", "stuck-after", "retry", "max-retries",
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run an HTTP API to start runs and query their status",
+	RunE: func(command *cobra.Command, args []string) error {
+		command.SilenceUsage = true
+
+		productionLogs, _ := command.Flags().GetBool("production-logs")
+		logger := setupLogger("serve", productionLogs, "")
+
+		listen, _ := command.Flags().GetString("listen")
+		dataDir, _ := command.Flags().GetString("data-dir")
+		token, _ := command.Flags().GetString("api-token")
+		insecure, _ := command.Flags().GetBool("insecure")
+		cancelTimeout, _ := command.Flags().GetDuration("cancel-timeout")
+
+		if len(dataDir) == 0 {
+			return errors.New("data-dir value must be defined")
+		}
+		if len(token) == 0 && !insecure {
+			return errors.New("api-token value must be defined unless --insecure is set")
+		}
+
+		executable, err := os.Executable()
+		if err != nil {
+			return errors.Wrap(err, "failed to find fleet controller executable")
+		}
+
+		// Global flags given to the server apply to every run.
+		var baseArgs []string
+		command.InheritedFlags().Visit(func(flag *pflag.Flag) {
+			if flag.Name == api.StatusFileFlag {
+				return
+			}
+			baseArgs = append(baseArgs, fmt.Sprintf("--%s=%s", flag.Name, flag.Value.String()))
+		})
+
+		server, err := api.NewServer(api.Config{
+			Executable:    executable,
+			BaseArgs:      baseArgs,
+			Actions:       serveActions,
+			Parameters:    serveParameters,
+			DataDir:       dataDir,
+			Token:         token,
+			Insecure:      insecure,
+			CancelTimeout: cancelTimeout,
+		}, logger)
+		if err != nil {
+			return err
+		}
+		if len(token) == 0 {
+			logger.Warn("No API token is set; the API is unauthenticated")
+		}
+
+		httpServer := &http.Server{
+			Addr:    listen,
+			Handler: server.Handler(),
+		}
+
+		serveErr := make(chan error, 1)
+		go func() {
+			logger.Infof("API listening on %s", listen)
+			serveErr <- httpServer.ListenAndServe()
+		}()
+
+		select {
+		case err = <-serveErr:
+			return errors.Wrap(err, "API server failed")
+		case <-command.Context().Done():
+		}
+
+		logger.Info("Shutting down API; waiting for runs in progress to finish")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		err = httpServer.Shutdown(ctx)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to shut down API cleanly")
+		}
+		server.Wait()
+
+		return nil
+	},
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// newShutdownContext returns a context that is cancelled on SIGINT or SIGTERM.
+// Runs stop starting new actions once it is cancelled, let the actions in
+// flight finish so installations are locked again, and report what was done.
+// A second signal exits immediately.
+func newShutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			// Restore the default behavior so another signal exits.
+			signal.Stop(signals)
+			logger.Warnf("Received %s; finishing actions in progress. Signal again to exit immediately", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// newRunContext returns the context of a run, which is cancelled on shutdown
+// or once the run timeout of the command is reached.
+func newRunContext(command *cobra.Command) (context.Context, context.CancelFunc) {
+	runTimeout, _ := command.Flags().GetDuration("run-timeout")
+	if runTimeout <= 0 {
+		return context.WithCancel(command.Context())
+	}
+
+	return context.WithTimeout(command.Context(), runTimeout)
+}
+
+// runCancelled returns an error if the run was cancelled or timed out.
+func runCancelled(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.Wrap(ctx.Err(), "run timeout reached")
+	}
+
+	return errors.Wrap(ctx.Err(), "run cancelled")
+}
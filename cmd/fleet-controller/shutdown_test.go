@@ -0,0 +1,41 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunContext(t *testing.T) {
+	var runErrs []error
+	command := &cobra.Command{
+		RunE: func(command *cobra.Command, args []string) error {
+			ctx, cancel := newRunContext(command)
+			defer cancel()
+			runErrs = append(runErrs, runCancelled(ctx))
+			<-ctx.Done()
+			runErrs = append(runErrs, runCancelled(ctx))
+			return nil
+		},
+	}
+	addExecutorFlags(command, time.Second, 10*time.Millisecond)
+	command.SetArgs([]string{})
+	require.NoError(t, command.ExecuteContext(context.Background()))
+
+	require.Len(t, runErrs, 2)
+	assert.NoError(t, runErrs[0])
+	require.Error(t, runErrs[1])
+	assert.Contains(t, runErrs[1].Error(), "run timeout reached")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Contains(t, runCancelled(ctx).Error(), "run cancelled")
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+)
+
+const simulateDateLayout = "2006-01-02"
+
+func init() {
+	simulateCmd.PersistentFlags().String("server", "http://localhost:8075", "The provisioning server whose API will be queried.")
+	simulateCmd.PersistentFlags().String("thanos-url", "", "The URL to query thanos metrics from.")
+	simulateCmd.PersistentFlags().String("start", "", "The first day to replay metrics from (YYYY-MM-DD). Defaults to 30 days before the end date.")
+	simulateCmd.PersistentFlags().String("end", "", "The last day to replay metrics from (YYYY-MM-DD). Defaults to today.")
+	simulateCmd.PersistentFlags().Duration("step", 24*time.Hour, "The amount of time between each replayed evaluation.")
+	simulateCmd.PersistentFlags().Int("days", 7, "The number of days back to check if an installation has received new posts since.")
+	simulateCmd.PersistentFlags().Int("max-users", 100, "The number of users where the installation won't be hibernated regardless of activity.")
+	simulateCmd.PersistentFlags().String("scale-thresholds", "", "Optional JSON file of scale thresholds keyed by size that override the default values.")
+
+	// Installation filters
+	simulateCmd.PersistentFlags().String("owner", "", "The owner ID value to filter installations by.")
+	simulateCmd.PersistentFlags().String("group", "", "The group ID value to filter installations by.")
+	addSelectorFlag(simulateCmd)
+}
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Replay historical metrics to predict the impact of scale and hibernate policies",
+	RunE: func(command *cobra.Command, args []string) error {
+		command.SilenceUsage = true
+
+		productionLogs, _ := command.Flags().GetBool("production-logs")
+		logger := setupLogger("simulate", productionLogs, "")
+
+		serverAddress, _ := command.Flags().GetString("server")
+		thanosURL, _ := command.Flags().GetString("thanos-url")
+		startValue, _ := command.Flags().GetString("start")
+		endValue, _ := command.Flags().GetString("end")
+		step, _ := command.Flags().GetDuration("step")
+		days, _ := command.Flags().GetInt("days")
+		maxUsers, _ := command.Flags().GetInt("max-users")
+		scaleThresholds, _ := command.Flags().GetString("scale-thresholds")
+		owner, _ := command.Flags().GetString("owner")
+		group, _ := command.Flags().GetString("group")
+
+		if len(serverAddress) == 0 {
+			return errors.New("server value must be defined")
+		}
+		if len(thanosURL) == 0 {
+			return errors.New("thanos-url value must be defined")
+		}
+		if step <= 0 {
+			return errors.New("step must be greater than 0")
+		}
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+
+		end := time.Now()
+		if len(endValue) != 0 {
+			parsed, err := time.Parse(simulateDateLayout, endValue)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse end date")
+			}
+			end = parsed
+		}
+		start := end.AddDate(0, 0, -30)
+		if len(startValue) != 0 {
+			parsed, err := time.Parse(simulateDateLayout, startValue)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse start date")
+			}
+			start = parsed
+		}
+		if !start.Before(end) {
+			return errors.New("start date must be before end date")
+		}
+
+		dictionary, err := loadScaleDictionary(scaleThresholds)
+		if err != nil {
+			return err
+		}
+
+		client := cmodel.NewClient(serverAddress)
+		tc, err := newThanosClient(command, thanosURL)
+		if err != nil {
+			return err
+		}
+		defer logMetricsCacheStats(tc, logger)
+
+		logger.WithFields(log.Fields{
+			"owner-filter": owner,
+			"group-filter": group,
+		}).Info("Obtaining current installations")
+		installations, err := client.GetInstallations(&cmodel.GetInstallationsRequest{
+			State:                       cmodel.InstallationStateStable,
+			OwnerID:                     owner,
+			GroupID:                     group,
+			IncludeGroupConfig:          false,
+			IncludeGroupConfigOverrides: false,
+			Paging: cmodel.Paging{
+				Page:           0,
+				PerPage:        cmodel.AllPerPage,
+				IncludeDeleted: false,
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to get installations")
+		}
+		installations = sel.Filter(installations)
+
+		var snapshots []*simulationSnapshot
+		for evaluationTime := start; !evaluationTime.After(end); evaluationTime = evaluationTime.Add(step) {
+			logger.Debugf("Gathering metrics for %s", evaluationTime.Format(time.RFC3339))
+
+			userCounts, err := tc.GetInstallationUserMetricsAt(command.Context(), evaluationTime)
+			if err != nil {
+				return errors.Wrap(err, "failed to obtain installation user metrics")
+			}
+			newPosts, err := tc.GetInstallationsNewPostCountsAt(command.Context(), days, evaluationTime)
+			if err != nil {
+				return errors.Wrap(err, "failed to obtain installation post metrics")
+			}
+
+			snapshots = append(snapshots, &simulationSnapshot{
+				time:       evaluationTime,
+				userCounts: userCounts,
+				newPosts:   newPosts,
+			})
+		}
+
+		logger.Infof("Replaying %d evaluations over %d stable installations", len(snapshots), len(installations))
+		results, err := simulatePolicies(installations, snapshots, dictionary, days, maxUsers)
+		if err != nil {
+			return errors.Wrap(err, "failed to simulate policies")
+		}
+
+		logger.WithFields(log.Fields{
+			"start":                start.Format(simulateDateLayout),
+			"end":                  end.Format(simulateDateLayout),
+			"evaluations":          len(snapshots),
+			"installations":        results.installations,
+			"scaled":               results.scaled,
+			"scale-actions":        results.scaleActions,
+			"flapped":              results.flapped,
+			"hibernated":           results.hibernated,
+			"hibernated-woken-up":  results.wokenUp,
+			"missing-metric-skips": results.missingMetrics,
+		}).Info("Simulation complete")
+
+		return nil
+	},
+}
+
+// simulationSnapshot contains the metrics of all installations at a single
+// point in time.
+type simulationSnapshot struct {
+	time       time.Time
+	userCounts map[string]int64
+	newPosts   map[string]float64
+}
+
+// simulationResults summarizes the actions that would have been taken by
+// replaying policies over a series of snapshots.
+type simulationResults struct {
+	installations  int
+	scaled         int
+	scaleActions   int
+	flapped        int
+	hibernated     int
+	wokenUp        int
+	missingMetrics int
+}
+
+type simulatedInstallation struct {
+	size          string
+	lastDirection int
+	scaled        bool
+	flapped       bool
+	hibernated    bool
+}
+
+// simulatePolicies replays scale and hibernation rules over the provided
+// snapshots. Installations start from their current size and are considered
+// woken up when activity is seen while they would have been hibernating.
+func simulatePolicies(installations []*cmodel.InstallationDTO, snapshots []*simulationSnapshot, dictionary scaleValuesDictionary, days, maxUsers int) (*simulationResults, error) {
+	results := &simulationResults{installations: len(installations)}
+
+	states := make(map[string]*simulatedInstallation)
+	for _, installation := range installations {
+		states[installation.ID] = &simulatedInstallation{size: installation.Size}
+	}
+
+	for _, snapshot := range snapshots {
+		creationTimestampCutoff := snapshot.time.AddDate(0, 0, -days).UnixNano() / int64(time.Millisecond)
+
+		for _, installation := range installations {
+			state := states[installation.ID]
+			if installation.CreateAt > snapshot.time.UnixNano()/int64(time.Millisecond) {
+				continue
+			}
+
+			userCount, ok := snapshot.userCounts[installation.ID]
+			if !ok {
+				results.missingMetrics++
+				continue
+			}
+			newPosts, ok := snapshot.newPosts[installation.ID]
+			if !ok {
+				results.missingMetrics++
+				continue
+			}
+
+			if state.hibernated {
+				if newPosts != 0 {
+					state.hibernated = false
+					results.wokenUp++
+				}
+				continue
+			}
+
+			if installation.CreateAt < creationTimestampCutoff && newPosts == 0 && userCount != 0 && userCount < int64(maxUsers) {
+				state.hibernated = true
+				results.hibernated++
+				continue
+			}
+
+			newSize, err := dictionary.getSuggestedScaleSize(state.size, userCount)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to determine scale size for installation %s", installation.ID)
+			}
+			if newSize == state.size {
+				continue
+			}
+
+			direction := 1
+			if dictionary[state.size].scaleDownUserCount > userCount {
+				direction = -1
+			}
+			if state.lastDirection != 0 && state.lastDirection != direction && !state.flapped {
+				state.flapped = true
+				results.flapped++
+			}
+			if !state.scaled {
+				state.scaled = true
+				results.scaled++
+			}
+
+			state.lastDirection = direction
+			state.size = newSize
+			results.scaleActions++
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulatePolicies(t *testing.T) {
+	start := time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+	newInstallation := func(size string) *cmodel.InstallationDTO {
+		return &cmodel.InstallationDTO{
+			Installation: &cmodel.Installation{
+				ID:       cmodel.NewID(),
+				Size:     size,
+				State:    cmodel.InstallationStateStable,
+				CreateAt: start.AddDate(-1, 0, 0).UnixNano() / int64(time.Millisecond),
+			},
+		}
+	}
+
+	steady := newInstallation(cloud100users)
+	flapping := newInstallation(cloud100users)
+	sleepy := newInstallation(cloud10users)
+	missing := newInstallation(cloud10users)
+	installations := []*cmodel.InstallationDTO{steady, flapping, sleepy, missing}
+
+	flappingUsers := []int64{50, 200, 50, 200}
+	sleepyPosts := []float64{10, 0, 0, 5}
+
+	var snapshots []*simulationSnapshot
+	for i := 0; i < 4; i++ {
+		snapshots = append(snapshots, &simulationSnapshot{
+			time: start.AddDate(0, 0, i),
+			userCounts: map[string]int64{
+				steady.ID:   50,
+				flapping.ID: flappingUsers[i],
+				sleepy.ID:   5,
+			},
+			newPosts: map[string]float64{
+				steady.ID:   100,
+				flapping.ID: 100,
+				sleepy.ID:   sleepyPosts[i],
+			},
+		})
+	}
+
+	results, err := simulatePolicies(installations, snapshots, scaleDictionary, 7, 100)
+	require.NoError(t, err)
+
+	assert.Equal(t, 4, results.installations)
+	assert.Equal(t, 1, results.scaled)
+	assert.Equal(t, 3, results.scaleActions)
+	assert.Equal(t, 1, results.flapped)
+	assert.Equal(t, 1, results.hibernated)
+	assert.Equal(t, 1, results.wokenUp)
+	assert.Equal(t, 4, results.missingMetrics)
+}
+
+func TestScaleDictionaryValidate(t *testing.T) {
+	t.Run("default dictionary", func(t *testing.T) {
+		assert.NoError(t, scaleDictionary.validate())
+	})
+
+	t.Run("overlapping thresholds", func(t *testing.T) {
+		dictionary, err := loadScaleDictionary("")
+		require.NoError(t, err)
+
+		values := dictionary[size1000users]
+		values.scaleDownUserCount = 200
+		dictionary[size1000users] = values
+		assert.Error(t, dictionary.validate())
+	})
+
+	t.Run("unknown size", func(t *testing.T) {
+		dictionary, err := loadScaleDictionary("")
+		require.NoError(t, err)
+
+		values := dictionary[size1000users]
+		values.scaleUpSize = "unknown"
+		dictionary[size1000users] = values
+		assert.Error(t, dictionary.validate())
+	})
+}
@@ -5,6 +5,9 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+
 	"github.com/pkg/errors"
 )
 
@@ -29,7 +32,7 @@ const (
 	miniHA        = "miniHA"
 )
 
-var scaleDictionary = map[string]sizeScaleValues{
+var scaleDictionary = scaleValuesDictionary{
 	cloud10users: {
 		scaleDownUserCount: 0,
 		scaleUpUserCount:   11,
@@ -80,8 +83,30 @@ var scaleDictionary = map[string]sizeScaleValues{
 	},
 }
 
+// isScaleUp returns whether the user count of an installation is above the
+// scale up threshold of its current size.
+func isScaleUp(currentSize string, currentUserCount int64) bool {
+	scaleValues, err := getScaleValues(currentSize)
+	if err != nil {
+		return false
+	}
+
+	return currentUserCount > scaleValues.scaleUpUserCount
+}
+
+// scaleValuesDictionary maps installation sizes to their scaling thresholds.
+type scaleValuesDictionary map[string]sizeScaleValues
+
 func getScaleValues(size string) (*sizeScaleValues, error) {
-	values, ok := scaleDictionary[size]
+	return scaleDictionary.getScaleValues(size)
+}
+
+func getSuggestedScaleSize(currentSize string, currentUserCount int64) (string, error) {
+	return scaleDictionary.getSuggestedScaleSize(currentSize, currentUserCount)
+}
+
+func (d scaleValuesDictionary) getScaleValues(size string) (*sizeScaleValues, error) {
+	values, ok := d[size]
 	if !ok {
 		return nil, errors.Errorf("no scale values found for size %s", size)
 	}
@@ -89,13 +114,13 @@ func getScaleValues(size string) (*sizeScaleValues, error) {
 	return &values, nil
 }
 
-func getSuggestedScaleSize(currentSize string, currentUserCount int64) (string, error) {
+func (d scaleValuesDictionary) getSuggestedScaleSize(currentSize string, currentUserCount int64) (string, error) {
 	newSize := currentSize
 
 	for {
 		var recheck bool
 
-		scaleValues, err := getScaleValues(newSize)
+		scaleValues, err := d.getScaleValues(newSize)
 		if err != nil {
 			return "", err
 		}
@@ -116,3 +141,95 @@ func getSuggestedScaleSize(currentSize string, currentUserCount int64) (string,
 
 	return newSize, nil
 }
+
+// isAtLeast returns whether a size is the minimum size or reached by scaling
+// up from it.
+func (d scaleValuesDictionary) isAtLeast(size, minSize string) bool {
+	current := minSize
+	for i := 0; i <= len(d); i++ {
+		if current == size {
+			return true
+		}
+		values, ok := d[current]
+		if !ok || values.scaleUpSize == current {
+			return false
+		}
+		current = values.scaleUpSize
+	}
+
+	return false
+}
+
+// validate ensures that the dictionary thresholds can't cause an installation
+// to bounce between sizes while calculating a suggested size.
+func (d scaleValuesDictionary) validate() error {
+	for size, values := range d {
+		if values.scaleDownUserCount > values.scaleUpUserCount {
+			return errors.Errorf("size %s has a scale down user count greater than its scale up user count", size)
+		}
+
+		downValues, ok := d[values.scaleDownSize]
+		if !ok {
+			return errors.Errorf("size %s scales down to unknown size %s", size, values.scaleDownSize)
+		}
+		upValues, ok := d[values.scaleUpSize]
+		if !ok {
+			return errors.Errorf("size %s scales up to unknown size %s", size, values.scaleUpSize)
+		}
+
+		if values.scaleDownSize != size && values.scaleDownUserCount > downValues.scaleUpUserCount {
+			return errors.Errorf("size %s scales down at %d users, but size %s scales up at %d users", size, values.scaleDownUserCount, values.scaleDownSize, downValues.scaleUpUserCount)
+		}
+		if values.scaleUpSize != size && upValues.scaleDownUserCount > values.scaleUpUserCount {
+			return errors.Errorf("size %s scales up at %d users, but size %s scales down at %d users", size, values.scaleUpUserCount, values.scaleUpSize, upValues.scaleDownUserCount)
+		}
+	}
+
+	return nil
+}
+
+// scaleThresholdsFile is the file format used to override scale thresholds.
+type scaleThresholdsFile map[string]struct {
+	ScaleDownUserCount int64  `json:"scaleDownUserCount"`
+	ScaleUpUserCount   int64  `json:"scaleUpUserCount"`
+	ScaleDownSize      string `json:"scaleDownSize"`
+	ScaleUpSize        string `json:"scaleUpSize"`
+}
+
+// loadScaleDictionary returns the default scale dictionary with any values
+// from the provided JSON file overriding the defaults.
+func loadScaleDictionary(filename string) (scaleValuesDictionary, error) {
+	dictionary := make(scaleValuesDictionary)
+	for size, values := range scaleDictionary {
+		dictionary[size] = values
+	}
+	if len(filename) == 0 {
+		return dictionary, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read scale thresholds file")
+	}
+	var thresholds scaleThresholdsFile
+	err = json.Unmarshal(data, &thresholds)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse scale thresholds file")
+	}
+
+	for size, values := range thresholds {
+		dictionary[size] = sizeScaleValues{
+			scaleDownUserCount: values.ScaleDownUserCount,
+			scaleUpUserCount:   values.ScaleUpUserCount,
+			scaleDownSize:      values.ScaleDownSize,
+			scaleUpSize:        values.ScaleUpSize,
+		}
+	}
+
+	err = dictionary.validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid scale thresholds")
+	}
+
+	return dictionary, nil
+}
@@ -0,0 +1,508 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/internal/notify"
+	"github.com/mattermost/fleet-controller/model"
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+)
+
+const (
+	retryCreate = "create"
+	retryUpdate = "update"
+)
+
+func init() {
+	stuckCmd.PersistentFlags().String("server", "http://localhost:8075", "The provisioning server whose API will be queried.")
+	stuckCmd.PersistentFlags().Bool("dry-run", true, "Whether the fleet controller will retry and escalate stuck installations or just print what would be done.")
+	stuckCmd.PersistentFlags().Bool("unlock", false, "Whether the fleet controller will unlock installations to retry them or not.")
+	stuckCmd.PersistentFlags().Int64("max-updating", 10, "The maximum number of installations that can be currently updating before retrying more.")
+	stuckCmd.PersistentFlags().Duration("stuck-after", 6*time.Hour, "How long an installation must have been observed in an updating or failed state before it is considered stuck. States are observed by every run and stored in the journal directory.")
+	stuckCmd.PersistentFlags().Bool("retry", false, "Whether stuck installations are retried where possible. Installations that aren't retried are escalated.")
+	stuckCmd.PersistentFlags().Int("max-retries", 1, "The number of times the same action is retried on an installation before it is escalated instead.")
+	addExecutorFlags(stuckCmd, 5*time.Second, 0)
+	addTargetFlags(stuckCmd)
+	addSelectorFlag(stuckCmd)
+
+	// Installation filters
+	stuckCmd.PersistentFlags().String("owner", "", "The owner ID value to filter installations by.")
+	stuckCmd.PersistentFlags().String("group", "", "The group ID value to filter installations by.")
+}
+
+// stuckHistory is what the journal knows about the actions taken on an
+// installation.
+type stuckHistory struct {
+	// last is the most recent entry, including retries.
+	last *journal.Entry
+	// intended is the most recent entry that isn't a retry.
+	intended *journal.Entry
+	// retries is the number of retries since the intended action.
+	retries int
+}
+
+type stuckAction struct {
+	installation *cmodel.InstallationDTO
+	age          time.Duration
+	history      *stuckHistory
+	// retry is how the installation is retried. Installations that aren't
+	// retried are escalated with the reason.
+	retry  string
+	patch  *cmodel.PatchInstallationRequest
+	reason string
+}
+
+var stuckCmd = &cobra.Command{
+	Use:   "stuck",
+	Short: "Find installations stuck in updating or failed states and retry or escalate them",
+	RunE: forEachProvisioner(func(command *cobra.Command, args []string, settings *provisionerSettings) error {
+		command.SilenceUsage = true
+		ctx, cancel := newRunContext(command)
+		defer cancel()
+
+		productionLogs, _ := command.Flags().GetBool("production-logs")
+		logger := setupLogger("stuck", productionLogs, settings.name)
+
+		logger.Info("Starting stuck installation check")
+
+		start := time.Now()
+
+		serverAddress := settings.server
+		dryrun, _ := command.Flags().GetBool("dry-run")
+		unlock, _ := command.Flags().GetBool("unlock")
+		stuckAfter, _ := command.Flags().GetDuration("stuck-after")
+		retry, _ := command.Flags().GetBool("retry")
+		maxRetries, _ := command.Flags().GetInt("max-retries")
+		journalDir, _ := command.Flags().GetString("journal-dir")
+		owner, _ := command.Flags().GetString("owner")
+		group, _ := command.Flags().GetString("group")
+
+		if len(serverAddress) == 0 {
+			return errors.New("server value must be defined")
+		}
+		if stuckAfter <= 0 {
+			return errors.New("stuck-after value must be greater than 0")
+		}
+		if len(journalDir) == 0 {
+			return errors.New("journal-dir value must be defined to observe how long installations are in a state")
+		}
+		if maxRetries < 0 {
+			return errors.New("max-retries value must be 0 or greater")
+		}
+
+		targets, err := newInstallationTargets(command)
+		if err != nil {
+			return err
+		}
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+		runJournal, err := newJournal(command, "stuck", settings.name)
+		if err != nil {
+			return err
+		}
+
+		notifier, err := newProvisionerNotifier(command, settings)
+		if err != nil {
+			return err
+		}
+
+		summary := newRunSummary("Stuck Installation Report", "stuck", dryrun)
+		summary.AddFilter("Stuck After", stuckAfter)
+		summary.AddFilter("Retry", retry)
+		summary.AddFilter("Max Retries", maxRetries)
+		summary.AddFilter("Group ID", group)
+		summary.AddFilter("Owner ID", owner)
+		summary.AddFilter("Selector", sel)
+		targets.addFilters(summary)
+
+		client := newProvisionerClient(settings)
+
+		var installations []*cmodel.InstallationDTO
+		if targets.enabled() {
+			logger.Infof("Obtaining %d selected installations", len(targets.ids))
+			var missing []string
+			installations, missing, err = targets.getInstallations(ctx, client)
+			if err != nil {
+				return err
+			}
+			for _, id := range missing {
+				logger.WithField("installation", id).Warn("Could not find installation")
+				summary.AddError(id, errors.New("installation not found"))
+			}
+		} else {
+			logger.WithFields(log.Fields{
+				"owner-filter": owner,
+				"group-filter": group,
+			}).Info("Obtaining current installations")
+			installations, err = client.GetInstallations(&cmodel.GetInstallationsRequest{
+				OwnerID:                     owner,
+				GroupID:                     group,
+				IncludeGroupConfig:          false,
+				IncludeGroupConfigOverrides: false,
+				Paging: cmodel.Paging{
+					Page:           0,
+					PerPage:        cmodel.AllPerPage,
+					IncludeDeleted: false,
+				},
+			})
+			if err != nil {
+				return errors.Wrap(err, "failed to get installations")
+			}
+		}
+		installations = sel.Filter(installations)
+
+		entries, err := journal.ReadAll(journalDir)
+		if err != nil {
+			return err
+		}
+		histories := newStuckHistories(entries, settings.name)
+		observed, err := journal.ReadObservedStates(journalDir)
+		if err != nil {
+			return err
+		}
+
+		logger.Infof("Checking %d installations for stuck states", len(installations))
+		now := time.Now()
+		var settlingCount int
+		var retries, escalations []*stuckAction
+		for _, installation := range installations {
+			// The provisioning server doesn't expose when an installation
+			// changed state, so the age of a state is measured from when it
+			// was first observed. Installations that aren't yet observed in
+			// their state for longer than stuck-after are left to settle.
+			since := observed.Observe(installation.ID, installation.State, now)
+			if !model.IsUpdatingState(installation.State) && !model.IsFailedState(installation.State) {
+				continue
+			}
+			logger := logger.WithField("installation", installation.ID)
+
+			history := histories[installation.ID]
+			if history == nil {
+				history = &stuckHistory{}
+			}
+			age := now.Sub(since)
+			if age < stuckAfter {
+				logger.Debugf("Installation has been observed %s for %s", installation.State, age.Round(time.Minute))
+				settlingCount++
+				continue
+			}
+
+			action := planStuckRemediation(installation, age, history, retry, maxRetries, unlock)
+			if len(action.retry) == 0 {
+				logger.WithField("reason", action.reason).Warnf("Installation stuck %s for at least %s; escalating", installation.State, age.Round(time.Minute))
+				escalations = append(escalations, action)
+				continue
+			}
+
+			logger.Infof("Installation stuck %s for at least %s; retrying %s", installation.State, age.Round(time.Minute), action.retry)
+			retries = append(retries, action)
+			progress.planned(installation.ID, "stuck", installation.State, action.retriedState())
+		}
+
+		logger.WithFields(log.Fields{
+			"retry-count":    len(retries),
+			"escalate-count": len(escalations),
+			"settling-count": settlingCount,
+		}).Info("Stuck installation check complete")
+
+		err = journal.WriteObservedStates(journalDir, observed)
+		if err != nil {
+			return err
+		}
+
+		if len(retries) == 0 && len(escalations) == 0 {
+			logger.Info("No installations are stuck; exiting...")
+			return nil
+		}
+		if dryrun {
+			logger.Infof("Dry run complete; %d installations would be retried and %d escalated", len(retries), len(escalations))
+			return nil
+		}
+
+		var results []*executor.Result
+		var runErr error
+		if len(retries) != 0 {
+			leader, err := acquireRunLock(command, settings, cancel, logger)
+			if err != nil {
+				return err
+			}
+			defer leader.release(logger)
+
+			exec, err := newExecutor(command, settings, client, logger)
+			if err != nil {
+				return err
+			}
+
+			var tasks []*executor.Task
+			for i, action := range retries {
+				i, action := i, action
+				tasks = append(tasks, &executor.Task{
+					InstallationID: action.installation.ID,
+					Run: func() error {
+						logger.WithField("installation", action.installation.ID).Infof("Retrying installation %d/%d", i+1, len(retries))
+
+						err := retryInstallation(action, client)
+						if err != nil {
+							return err
+						}
+
+						entry := &journal.Entry{
+							InstallationID:  action.installation.ID,
+							Action:          "retry",
+							PreviousSize:    action.installation.Size,
+							NewSize:         action.installation.Size,
+							PreviousState:   action.installation.State,
+							NewState:        action.retriedState(),
+							PreviousVersion: action.installation.Version,
+							NewVersion:      action.installation.Version,
+							PreviousImage:   action.installation.Image,
+							NewImage:        action.installation.Image,
+							APISecurityLock: action.installation.APISecurityLock,
+						}
+						if action.patch != nil {
+							entry.NewSize = upgradedValue(action.installation.Size, stringValue(action.patch.Size))
+							entry.NewVersion = upgradedValue(action.installation.Version, stringValue(action.patch.Version))
+							entry.NewImage = upgradedValue(action.installation.Image, stringValue(action.patch.Image))
+						}
+						recordJournalEntry(runJournal, entry, logger)
+
+						return nil
+					},
+				})
+			}
+
+			results, runErr = exec.Run(ctx, progress.trackTasks(leader.lockTasks(tasks)))
+		}
+
+		actionsByID := make(map[string]*stuckAction, len(retries))
+		for _, action := range retries {
+			actionsByID[action.installation.ID] = action
+		}
+		var retriedCount, failedCount int
+		for _, result := range results {
+			action := actionsByID[result.InstallationID]
+			if result.Err != nil {
+				logger.WithField("installation", result.InstallationID).WithError(result.Err).Error("Failed to retry installation")
+				summary.AddError(result.InstallationID, result.Err)
+				action.reason = fmt.Sprintf("retrying %s failed: %s", action.retry, result.Err)
+				escalations = append(escalations, action)
+				failedCount++
+				continue
+			}
+
+			summary.AddChange(result.InstallationID, action.installation.State, action.retriedState())
+			retriedCount++
+		}
+		if runErr != nil {
+			summary.AddError("", runErr)
+		}
+
+		// Installations are escalated once for each state and intended
+		// action rather than on every run they stay stuck.
+		var newEscalations []*stuckAction
+		for _, action := range escalations {
+			if !observed.Escalate(action.installation.ID, action.escalatedFor()) {
+				logger.WithField("installation", action.installation.ID).Debug("Installation was already escalated")
+				continue
+			}
+			newEscalations = append(newEscalations, action)
+		}
+		if len(newEscalations) != 0 {
+			escalation := newRunSummary("Stuck Installations Need Attention", "stuck", dryrun)
+			escalation.AddFilter("Stuck After", stuckAfter)
+			for _, action := range newEscalations {
+				escalation.AddError(action.installation.ID, errors.New(action.describe()))
+			}
+			escalation.AddCount("Installations Escalated", len(newEscalations))
+			notifier.sendSummaryEvent(notify.EventEscalation, escalation, start, logger)
+
+			err = journal.WriteObservedStates(journalDir, observed)
+			if err != nil {
+				logger.WithError(err).Warn("Failed to record escalations; they will be sent again")
+			}
+		}
+
+		summary.AddCount("Installations Checked", len(installations))
+		summary.AddCount("Installations Settling", settlingCount)
+		summary.AddCount("Installations Retried", retriedCount)
+		summary.AddCount("Installations Escalated", len(newEscalations))
+		summary.AddCount("Installations Already Escalated", len(escalations)-len(newEscalations))
+		summary.AddCount("Retry Failures", failedCount)
+		notifier.sendRunReport(ctx, summary, start, logger)
+
+		logger.WithField("runtime", summary.Runtime).Info("Stuck installation check complete")
+
+		if runErr != nil {
+			return runErr
+		}
+		if failedCount != 0 {
+			return errors.Errorf("failed to retry %d of %d installations", failedCount, len(retries))
+		}
+
+		return nil
+	}),
+}
+
+// newStuckHistories returns the journal history of each installation acted on
+// through the provisioner.
+func newStuckHistories(entries []*journal.Entry, provisioner string) map[string]*stuckHistory {
+	histories := make(map[string]*stuckHistory)
+	for _, entry := range entries {
+		if entry.Provisioner != provisioner {
+			continue
+		}
+		history, ok := histories[entry.InstallationID]
+		if !ok {
+			history = &stuckHistory{}
+			histories[entry.InstallationID] = history
+		}
+
+		history.last = entry
+		if entry.Action == "retry" {
+			history.retries++
+			continue
+		}
+		history.intended = entry
+		history.retries = 0
+	}
+
+	return histories
+}
+
+// planStuckRemediation decides whether a stuck installation is retried or
+// escalated. The provisioner only allows failed creations and failed updates
+// to be retried, and ignores updates that don't change the installation, so
+// failed updates are only retried when the journal records an intended
+// change that the installation doesn't have.
+func planStuckRemediation(installation *cmodel.InstallationDTO, age time.Duration, history *stuckHistory, retry bool, maxRetries int, unlock bool) *stuckAction {
+	action := &stuckAction{
+		installation: installation,
+		age:          age,
+		history:      history,
+	}
+
+	var retryType string
+	var patch *cmodel.PatchInstallationRequest
+	switch installation.State {
+	case cmodel.InstallationStateCreationFailed:
+		retryType = retryCreate
+	case cmodel.InstallationStateUpdateFailed:
+		if history.intended == nil {
+			action.reason = "no journaled action to retry"
+			return action
+		}
+		patch = intendedPatch(installation, history.intended)
+		if patch == nil {
+			action.reason = fmt.Sprintf("%s already applied; the provisioner ignores unchanged updates", history.intended.Action)
+			return action
+		}
+		retryType = retryUpdate
+	default:
+		action.reason = fmt.Sprintf("the provisioner doesn't allow retrying %s installations", installation.State)
+		return action
+	}
+
+	if history.retries >= maxRetries {
+		action.reason = fmt.Sprintf("already retried %d times", history.retries)
+		return action
+	}
+	if !retry {
+		action.reason = fmt.Sprintf("retrying %s is possible, but retries are disabled", retryType)
+		return action
+	}
+	if installation.APISecurityLock && !unlock {
+		action.reason = "installation is locked and fleet controller is not set to perform unlocks"
+		return action
+	}
+
+	action.retry = retryType
+	action.patch = patch
+
+	return action
+}
+
+// intendedPatch returns the patch that reapplies the journaled action to the
+// installation, or nil if there is nothing left to apply.
+func intendedPatch(installation *cmodel.InstallationDTO, intended *journal.Entry) *cmodel.PatchInstallationRequest {
+	patch := &cmodel.PatchInstallationRequest{}
+	switch intended.Action {
+	case "scale", "scale-rollback":
+		if len(intended.NewSize) != 0 && intended.NewSize != installation.Size {
+			patch.Size = &intended.NewSize
+		}
+	case "upgrade":
+		if len(intended.NewVersion) != 0 && intended.NewVersion != installation.Version {
+			patch.Version = &intended.NewVersion
+		}
+		if len(intended.NewImage) != 0 && intended.NewImage != installation.Image {
+			patch.Image = &intended.NewImage
+		}
+	}
+	if patch.Size == nil && patch.Version == nil && patch.Image == nil {
+		return nil
+	}
+
+	return patch
+}
+
+func (a *stuckAction) retriedState() string {
+	if a.retry == retryCreate {
+		return cmodel.InstallationStateCreationRequested
+	}
+	return cmodel.InstallationStateUpdateRequested
+}
+
+func (a *stuckAction) describe() string {
+	description := fmt.Sprintf("%s for at least %s", a.installation.State, a.age.Round(time.Minute))
+	if a.history.intended != nil {
+		description += fmt.Sprintf(" after %s run %s", a.history.intended.Action, a.history.intended.RunID)
+	}
+
+	return fmt.Sprintf("%s: %s", description, a.reason)
+}
+
+// escalatedFor identifies the action an installation is escalated for. An
+// installation stuck in the same state is escalated again only once another
+// action is intended for it.
+func (a *stuckAction) escalatedFor() string {
+	if a.history.intended == nil {
+		return "no journaled action"
+	}
+
+	return fmt.Sprintf("%s run %s", a.history.intended.Action, a.history.intended.RunID)
+}
+
+func retryInstallation(action *stuckAction, client model.ProvisionerClient) error {
+	if action.retry == retryUpdate {
+		return patchInstallation(action.installation, action.patch, client)
+	}
+
+	return withUnlockedAPI(action.installation, client, func() error {
+		err := client.RetryCreateInstallation(action.installation.ID)
+		if err != nil {
+			return errors.Wrap(err, "failed to retry installation creation")
+		}
+
+		return nil
+	})
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
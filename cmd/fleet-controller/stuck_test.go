@@ -0,0 +1,179 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/model"
+)
+
+type mockRetryClient struct {
+	model.ProvisionerClient
+	calls     []string
+	updateErr error
+}
+
+func (c *mockRetryClient) RetryCreateInstallation(installationID string) error {
+	c.calls = append(c.calls, "retry-create")
+	return nil
+}
+
+func (c *mockRetryClient) UpdateInstallation(installationID string, request *cmodel.PatchInstallationRequest) (*cmodel.InstallationDTO, error) {
+	c.calls = append(c.calls, "update")
+	if c.updateErr != nil {
+		return nil, c.updateErr
+	}
+	return &cmodel.InstallationDTO{Installation: &cmodel.Installation{ID: installationID}}, nil
+}
+
+func (c *mockRetryClient) LockAPIForInstallation(installationID string) error {
+	c.calls = append(c.calls, "lock")
+	return nil
+}
+
+func (c *mockRetryClient) UnlockAPIForInstallation(installationID string) error {
+	c.calls = append(c.calls, "unlock")
+	return nil
+}
+
+func TestNewStuckHistories(t *testing.T) {
+	entries := []*journal.Entry{
+		{InstallationID: "id1", Action: "scale", RunID: "run1"},
+		{InstallationID: "id1", Action: "retry", RunID: "run2"},
+		{InstallationID: "id1", Action: "retry", RunID: "run3"},
+		{InstallationID: "id2", Action: "retry", RunID: "run1"},
+		{InstallationID: "id2", Action: "upgrade", RunID: "run2"},
+		{InstallationID: "id3", Action: "scale", RunID: "run1", Provisioner: "other"},
+	}
+
+	histories := newStuckHistories(entries, "")
+	require.Len(t, histories, 2)
+	assert.Equal(t, "run1", histories["id1"].intended.RunID)
+	assert.Equal(t, "run3", histories["id1"].last.RunID)
+	assert.Equal(t, 2, histories["id1"].retries)
+	assert.Equal(t, "run2", histories["id2"].intended.RunID)
+	assert.Equal(t, 0, histories["id2"].retries)
+
+	histories = newStuckHistories(entries, "other")
+	require.Len(t, histories, 1)
+	assert.Equal(t, "run1", histories["id3"].intended.RunID)
+}
+
+func TestPlanStuckRemediation(t *testing.T) {
+	newInstallation := func(state string, locked bool) *cmodel.InstallationDTO {
+		return &cmodel.InstallationDTO{Installation: &cmodel.Installation{
+			ID:              cmodel.NewID(),
+			State:           state,
+			Size:            size1000users,
+			Version:         "5.31.0",
+			APISecurityLock: locked,
+		}}
+	}
+	scaled := &stuckHistory{intended: &journal.Entry{Action: "scale", NewSize: size5000users}}
+	age := 12 * time.Hour
+
+	t.Run("failed creation", func(t *testing.T) {
+		action := planStuckRemediation(newInstallation(cmodel.InstallationStateCreationFailed, false), age, &stuckHistory{}, true, 1, false)
+		assert.Equal(t, retryCreate, action.retry)
+		assert.Equal(t, cmodel.InstallationStateCreationRequested, action.retriedState())
+	})
+
+	t.Run("failed update with pending change", func(t *testing.T) {
+		action := planStuckRemediation(newInstallation(cmodel.InstallationStateUpdateFailed, false), age, scaled, true, 1, false)
+		assert.Equal(t, retryUpdate, action.retry)
+		require.NotNil(t, action.patch)
+		assert.Equal(t, size5000users, *action.patch.Size)
+	})
+
+	t.Run("failed update already applied", func(t *testing.T) {
+		history := &stuckHistory{intended: &journal.Entry{Action: "scale", NewSize: size1000users}}
+		action := planStuckRemediation(newInstallation(cmodel.InstallationStateUpdateFailed, false), age, history, true, 1, false)
+		assert.Empty(t, action.retry)
+		assert.Contains(t, action.reason, "already applied")
+	})
+
+	t.Run("failed update without journal", func(t *testing.T) {
+		action := planStuckRemediation(newInstallation(cmodel.InstallationStateUpdateFailed, false), age, &stuckHistory{}, true, 1, false)
+		assert.Empty(t, action.retry)
+		assert.Contains(t, action.describe(), "no journaled action")
+	})
+
+	t.Run("in progress", func(t *testing.T) {
+		action := planStuckRemediation(newInstallation(cmodel.InstallationStateHibernationInProgress, false), age, scaled, true, 1, false)
+		assert.Empty(t, action.retry)
+		assert.Contains(t, action.describe(), "hibernation-in-progress for at least 12h0m0s after scale run")
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		history := &stuckHistory{intended: scaled.intended, retries: 1}
+		action := planStuckRemediation(newInstallation(cmodel.InstallationStateUpdateFailed, false), age, history, true, 1, false)
+		assert.Empty(t, action.retry)
+		assert.Contains(t, action.reason, "already retried 1 times")
+	})
+
+	t.Run("retries disabled", func(t *testing.T) {
+		action := planStuckRemediation(newInstallation(cmodel.InstallationStateCreationFailed, false), age, &stuckHistory{}, false, 1, false)
+		assert.Empty(t, action.retry)
+		assert.Contains(t, action.reason, "retries are disabled")
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		action := planStuckRemediation(newInstallation(cmodel.InstallationStateCreationFailed, true), age, &stuckHistory{}, true, 1, false)
+		assert.Empty(t, action.retry)
+
+		action = planStuckRemediation(newInstallation(cmodel.InstallationStateCreationFailed, true), age, &stuckHistory{}, true, 1, true)
+		assert.Equal(t, retryCreate, action.retry)
+	})
+}
+
+func TestIntendedPatch(t *testing.T) {
+	installation := &cmodel.InstallationDTO{Installation: &cmodel.Installation{Size: size1000users, Version: "5.31.0", Image: "mattermost/mattermost-enterprise-edition"}}
+
+	patch := intendedPatch(installation, &journal.Entry{Action: "upgrade", NewVersion: "5.32.0", NewImage: installation.Image})
+	require.NotNil(t, patch)
+	assert.Equal(t, "5.32.0", *patch.Version)
+	assert.Nil(t, patch.Image)
+	assert.Nil(t, patch.Size)
+
+	assert.Nil(t, intendedPatch(installation, &journal.Entry{Action: "upgrade", NewVersion: "5.31.0"}))
+	assert.Nil(t, intendedPatch(installation, &journal.Entry{Action: "hibernate"}))
+}
+
+func TestStuckEscalatedFor(t *testing.T) {
+	action := &stuckAction{history: &stuckHistory{}}
+	assert.Equal(t, "no journaled action", action.escalatedFor())
+
+	action.history.intended = &journal.Entry{Action: "scale", RunID: "run1"}
+	assert.Equal(t, "scale run run1", action.escalatedFor())
+}
+
+func TestRetryInstallation(t *testing.T) {
+	client := &mockRetryClient{}
+	installation := &cmodel.InstallationDTO{Installation: &cmodel.Installation{ID: cmodel.NewID(), APISecurityLock: true}}
+
+	require.NoError(t, retryInstallation(&stuckAction{installation: installation, retry: retryCreate}, client))
+	assert.Equal(t, []string{"unlock", "retry-create", "lock"}, client.calls)
+
+	client.calls = nil
+	size := size5000users
+	require.NoError(t, retryInstallation(&stuckAction{installation: installation, retry: retryUpdate, patch: &cmodel.PatchInstallationRequest{Size: &size}}, client))
+	assert.Equal(t, []string{"unlock", "update", "lock"}, client.calls)
+
+	// A failed update still locks the installation again.
+	client.calls = nil
+	client.updateErr = errors.New("update failed")
+	err := retryInstallation(&stuckAction{installation: installation, retry: retryUpdate, patch: &cmodel.PatchInstallationRequest{Size: &size}}, client)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "update failed")
+	assert.Equal(t, []string{"unlock", "update", "lock"}, client.calls)
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/selector"
+	"github.com/mattermost/fleet-controller/internal/webhook"
+	"github.com/mattermost/fleet-controller/model"
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+)
+
+// addTargetFlags adds the flags selecting specific installations to act on
+// instead of the installations matched by the command filters.
+func addTargetFlags(command *cobra.Command) {
+	command.PersistentFlags().StringSlice("installation", nil, "The ID of an installation to act on instead of the installations matched by the filters. Can be repeated.")
+	command.PersistentFlags().String("installations-file", "", "Optional file of installation IDs separated by newlines to act on instead of the installations matched by the filters.")
+}
+
+// addSelectorFlag adds the flags narrowing the installations a command acts on
+// with a selector expression and annotations.
+func addSelectorFlag(command *cobra.Command) {
+	command.PersistentFlags().String("selector", "", "Optional expression selecting installations by their fields, e.g. \"size in (cloud10users,cloud100users) and version < 5.37 and age > 30d\". Fields: "+strings.Join(selector.Fields(), ", ")+".")
+	command.PersistentFlags().StringSlice("annotation", nil, "Only act on installations with this annotation. Can be repeated to require several annotations.")
+	command.PersistentFlags().StringSlice("exclude-annotation", nil, "Never act on installations with this annotation. Can be repeated.")
+}
+
+// newSelector returns the selector combining the selector expression and
+// annotation filters set on the command or nil if there are none.
+func newSelector(command *cobra.Command) (*selector.Selector, error) {
+	expression, _ := command.Flags().GetString("selector")
+	annotations, _ := command.Flags().GetStringSlice("annotation")
+	excluded, _ := command.Flags().GetStringSlice("exclude-annotation")
+
+	var conditions []string
+	if len(strings.TrimSpace(expression)) != 0 {
+		conditions = append(conditions, fmt.Sprintf("(%s)", expression))
+	}
+	_, err := cmodel.AnnotationsFromStringSlice(append(append([]string{}, annotations...), excluded...))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid annotation filter")
+	}
+	for _, annotation := range annotations {
+		conditions = append(conditions, fmt.Sprintf("annotation = %s", annotation))
+	}
+	for _, annotation := range excluded {
+		conditions = append(conditions, fmt.Sprintf("annotation != %s", annotation))
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+
+	return selector.Parse(strings.Join(conditions, " and "))
+}
+
+// addForceFlags adds the flags that skip policy checks for selected
+// installations.
+func addForceFlags(command *cobra.Command) {
+	command.PersistentFlags().Bool("force", false, "Whether policy checks are skipped for the installations selected with --installation or --installations-file. Safety checks such as installation state and locks still apply.")
+	command.PersistentFlags().String("force-reason", "", "Why policy checks are skipped. Required with --force and recorded in the run report.")
+}
+
+// installationTargets are the installations selected by ID for a run.
+type installationTargets struct {
+	ids    []string
+	force  bool
+	reason string
+}
+
+func newInstallationTargets(command *cobra.Command) (*installationTargets, error) {
+	ids, _ := command.Flags().GetStringSlice("installation")
+	file, _ := command.Flags().GetString("installations-file")
+	force, _ := command.Flags().GetBool("force")
+	reason, _ := command.Flags().GetString("force-reason")
+
+	if len(file) != 0 {
+		fileIDs, err := readInInstallationIDs(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read installations file")
+		}
+		ids = append(ids, fileIDs...)
+	}
+
+	targets := &installationTargets{force: force, reason: strings.TrimSpace(reason)}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if len(id) == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		targets.ids = append(targets.ids, id)
+	}
+
+	if targets.force && !targets.enabled() {
+		return nil, errors.New("force can only be used with installations selected by ID")
+	}
+	if targets.force && len(targets.reason) == 0 {
+		return nil, errors.New("force-reason value must be defined when forcing")
+	}
+
+	return targets, nil
+}
+
+// enabled returns whether installations were selected by ID.
+func (t *installationTargets) enabled() bool {
+	return len(t.ids) != 0
+}
+
+// addFilters records the selected installations and any forcing in the run
+// summary.
+func (t *installationTargets) addFilters(summary *webhook.RunSummary) {
+	if !t.enabled() {
+		return
+	}
+
+	summary.AddFilter("Installations", strings.Join(t.ids, ", "))
+	if t.force {
+		summary.AddFilter("Forced", t.reason)
+	}
+}
+
+// getInstallations returns the selected installations along with the IDs of
+// those that couldn't be found.
+func (t *installationTargets) getInstallations(ctx context.Context, client model.ProvisionerClient) ([]*cmodel.InstallationDTO, []string, error) {
+	var installations []*cmodel.InstallationDTO
+	var missing []string
+	for _, id := range t.ids {
+		err := runCancelled(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		installation, err := client.GetInstallation(id, &cmodel.GetInstallationRequest{})
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to get installation %s", id)
+		}
+		if installation == nil {
+			missing = append(missing, id)
+			continue
+		}
+		installations = append(installations, installation)
+	}
+
+	return installations, missing, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattermost/fleet-controller/internal/selector"
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallationTargets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "installations.txt")
+	require.NoError(t, ioutil.WriteFile(file, []byte("id2\n\n  id3 \nid1\n"), 0600))
+
+	parse := func(args ...string) (*installationTargets, error) {
+		var targets *installationTargets
+		command := &cobra.Command{
+			RunE: func(command *cobra.Command, args []string) error {
+				var err error
+				targets, err = newInstallationTargets(command)
+				return err
+			},
+			SilenceErrors: true,
+			SilenceUsage:  true,
+		}
+		addTargetFlags(command)
+		addForceFlags(command)
+		command.SetArgs(args)
+		return targets, command.Execute()
+	}
+
+	t.Run("no targets", func(t *testing.T) {
+		targets, err := parse()
+		require.NoError(t, err)
+		assert.False(t, targets.enabled())
+	})
+
+	t.Run("flags and file", func(t *testing.T) {
+		targets, err := parse("--installation", "id1", "--installation", "id2", "--installations-file", file)
+		require.NoError(t, err)
+		assert.True(t, targets.enabled())
+		assert.Equal(t, []string{"id1", "id2", "id3"}, targets.ids)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := parse("--installations-file", filepath.Join(t.TempDir(), "missing.txt"))
+		assert.Error(t, err)
+	})
+
+	t.Run("force without targets", func(t *testing.T) {
+		_, err := parse("--force", "--force-reason", "customer request")
+		assert.Error(t, err)
+	})
+
+	t.Run("force without reason", func(t *testing.T) {
+		_, err := parse("--installation", "id1", "--force")
+		assert.Error(t, err)
+	})
+
+	t.Run("force", func(t *testing.T) {
+		targets, err := parse("--installation", "id1", "--force", "--force-reason", "customer request")
+		require.NoError(t, err)
+		assert.True(t, targets.force)
+		assert.Equal(t, "customer request", targets.reason)
+	})
+}
+
+func TestNewSelector(t *testing.T) {
+	parse := func(args ...string) (*selector.Selector, error) {
+		var sel *selector.Selector
+		command := &cobra.Command{
+			RunE: func(command *cobra.Command, args []string) error {
+				var err error
+				sel, err = newSelector(command)
+				return err
+			},
+			SilenceErrors: true,
+			SilenceUsage:  true,
+		}
+		addSelectorFlag(command)
+		command.SetArgs(args)
+		return sel, command.Execute()
+	}
+
+	sel, err := parse()
+	require.NoError(t, err)
+	assert.Nil(t, sel)
+
+	sel, err = parse("--selector", "size = cloud10users or age > 30d", "--annotation", "tier-trial", "--exclude-annotation", "scheduled")
+	require.NoError(t, err)
+	assert.Equal(t, "(size = cloud10users or age > 30d) and annotation = tier-trial and annotation != scheduled", sel.String())
+
+	sel, err = parse("--annotation", "tier-trial")
+	require.NoError(t, err)
+	assert.True(t, sel.Match(&cmodel.InstallationDTO{Installation: &cmodel.Installation{}, Annotations: []*cmodel.Annotation{{Name: "tier-trial"}}}))
+	assert.False(t, sel.Match(&cmodel.InstallationDTO{Installation: &cmodel.Installation{}}))
+
+	_, err = parse("--annotation", "Tier=Trial")
+	assert.Error(t, err)
+
+	_, err = parse("--selector", "size <")
+	assert.Error(t, err)
+}
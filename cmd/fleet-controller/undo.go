@@ -0,0 +1,438 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/model"
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+)
+
+func init() {
+	undoCmd.PersistentFlags().String("server", "http://localhost:8075", "The provisioning server whose API will be queried.")
+	undoCmd.PersistentFlags().Bool("dry-run", true, "Whether the fleet controller will perform actions or just print actions that would be taken.")
+	undoCmd.PersistentFlags().Bool("unlock", false, "Whether the fleet controller will unlock installations to revert them or not.")
+	undoCmd.PersistentFlags().Int64("max-updating", 25, "The maximum number of installations that can be currently updating before reverting more.")
+	addExecutorFlags(undoCmd, 10*time.Second, 0)
+	addVerificationFlags(undoCmd, 30*time.Minute)
+	addSelectorFlag(undoCmd)
+}
+
+var undoCmd = &cobra.Command{
+	Use:   "undo <run-id>",
+	Short: "Revert the actions taken by a previous run using the journal",
+	Args: func(command *cobra.Command, args []string) error {
+		err := cobra.ExactArgs(1)(command, args)
+		if err != nil {
+			return err
+		}
+		return journal.ValidateRunID(args[0])
+	},
+	RunE: forEachProvisioner(func(command *cobra.Command, args []string, settings *provisionerSettings) error {
+		command.SilenceUsage = true
+		ctx, cancel := newRunContext(command)
+		defer cancel()
+
+		productionLogs, _ := command.Flags().GetBool("production-logs")
+		logger := setupLogger("undo", productionLogs, settings.name)
+
+		start := time.Now()
+		undoRunID := args[0]
+
+		serverAddress := settings.server
+		journalDir, _ := command.Flags().GetString("journal-dir")
+		dryrun, _ := command.Flags().GetBool("dry-run")
+		unlock, _ := command.Flags().GetBool("unlock")
+
+		if len(serverAddress) == 0 {
+			return errors.New("server value must be defined")
+		}
+		if len(journalDir) == 0 {
+			return errors.New("journal-dir value must be defined")
+		}
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+
+		entries, err := journal.ReadRun(journalDir, undoRunID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read journal of run %s", undoRunID)
+		}
+		entries, err = provisionerEntries(entries, settings.name)
+		if err != nil {
+			return err
+		}
+
+		pricing, err := getPricingTable(command)
+		if err != nil {
+			return err
+		}
+		runJournal, err := newJournal(command, "undo", settings.name)
+		if err != nil {
+			return err
+		}
+
+		notifier, err := newProvisionerNotifier(command, settings)
+		if err != nil {
+			return err
+		}
+
+		summary := newRunSummary("Undo Report", "undo", dryrun)
+		summary.AddFilter("Undone Run ID", undoRunID)
+		summary.AddFilter("Selector", sel)
+
+		logger = logger.WithField("undo-run", undoRunID)
+		logger.Infof("Undoing %d journal entries", len(entries))
+
+		actions, irreversible := planUndo(entries)
+		for _, entry := range irreversible {
+			logger.WithField("installation", entry.InstallationID).Warnf("Action %s can't be undone", entry.Action)
+			summary.AddError(entry.InstallationID, errors.Errorf("%s can't be undone", entry.Action))
+		}
+
+		client := newProvisionerClient(settings)
+
+		var undoable []*undoAction
+		var skippedCount, notSelectedCount int
+		for _, action := range actions {
+			err = runCancelled(ctx)
+			if err != nil {
+				return err
+			}
+			logger := logger.WithField("installation", action.installationID)
+
+			installation, err := client.GetInstallation(action.installationID, &cmodel.GetInstallationRequest{})
+			if err != nil {
+				return errors.Wrap(err, "failed to get installation")
+			}
+			if installation != nil && !sel.Match(installation) {
+				logger.Debug("Installation not matched by selector")
+				notSelectedCount++
+				continue
+			}
+			err = checkUndo(action, installation, unlock)
+			if err != nil {
+				logger.WithError(err).Warn("Skipping undo")
+				summary.AddError(action.installationID, err)
+				skippedCount++
+				continue
+			}
+
+			action.installation = installation
+			undoable = append(undoable, action)
+			progress.planned(action.installationID, action.action, action.from(), action.to())
+			logger.Infof("Undo will %s installation (%s)", action.action, action.describe())
+		}
+
+		if dryrun {
+			logger.Infof("Dry run complete; %d actions would be undone", len(undoable))
+			return nil
+		}
+
+		leader, err := acquireRunLock(command, settings, cancel, logger)
+		if err != nil {
+			return err
+		}
+		defer leader.release(logger)
+
+		verify := newVerification(command)
+		exec, err := newExecutor(command, settings, client, logger)
+		if err != nil {
+			return err
+		}
+
+		var tasks []*executor.Task
+		actionsByID := make(map[string]*undoAction, len(undoable))
+		for _, action := range undoable {
+			action := action
+			actionsByID[action.installationID] = action
+			tasks = append(tasks, &executor.Task{
+				InstallationID: action.installationID,
+				Run: func() error {
+					installation, err := refreshInstallation(action.installationID, client)
+					if err != nil {
+						return err
+					}
+					err = checkUndo(action, installation, unlock)
+					if err != nil {
+						return errors.Wrap(err, "installation changed since the undo was planned")
+					}
+					action.installation = installation
+
+					err = undoInstallation(action, client)
+					if err != nil {
+						return err
+					}
+
+					action.entry = action.journalEntry(pricing, logger)
+					recordJournalEntry(runJournal, action.entry, logger)
+
+					return nil
+				},
+			})
+		}
+
+		results, runErr := exec.Run(ctx, progress.trackTasks(leader.lockTasks(tasks)))
+
+		var undoneCount, failedCount int
+		var estimatedMonthlyCostChange float64
+		var expectations []*model.Expectation
+		for _, result := range results {
+			if result.Err != nil {
+				logger.WithField("installation", result.InstallationID).WithError(result.Err).Error("Failed to undo action")
+				summary.AddError(result.InstallationID, result.Err)
+				failedCount++
+				continue
+			}
+
+			action := actionsByID[result.InstallationID]
+			estimatedMonthlyCostChange += action.entry.MonthlyCostChange
+			summary.AddChange(action.installationID, action.from(), action.to())
+			expectations = append(expectations, verify.expect(action.installationID, result.FinishedAt, action.expectedSize(), action.expectedState()))
+			undoneCount++
+		}
+		if runErr != nil {
+			summary.AddError("", runErr)
+		}
+		verify.run(ctx, client, expectations, summary, logger)
+
+		summary.AddCount("Journal Entries", len(entries))
+		summary.AddCount("Actions Undone", undoneCount)
+		summary.AddCount("Actions Skipped", skippedCount)
+		summary.AddCount("Actions Not Selected", notSelectedCount)
+		summary.AddCount("Irreversible Actions", len(irreversible))
+		summary.AddCount("Undo Failures", failedCount)
+		verify.addCounts(summary)
+		summary.EstimatedMonthlyCostChange = estimatedMonthlyCostChange
+		notifier.sendRunReport(ctx, summary, start, logger)
+
+		logger.WithField("runtime", summary.Runtime).Info("Undo complete")
+
+		if runErr != nil {
+			return runErr
+		}
+		if failedCount != 0 {
+			return errors.Errorf("failed to undo %d of %d actions", failedCount, len(undoable))
+		}
+		if verify.failed != 0 {
+			return errors.Errorf("%d undone actions failed verification", verify.failed)
+		}
+
+		return nil
+	}),
+}
+
+// undoAction is the action that reverts the changes made to an installation
+// during a run.
+type undoAction struct {
+	installationID string
+	action         string
+	// original is the first journal entry of the installation in the run and
+	// describes the installation before the run.
+	original *journal.Entry
+	// last is the last journal entry of the installation in the run and
+	// describes the installation after the run.
+	last *journal.Entry
+
+	installation *cmodel.InstallationDTO
+	entry        *journal.Entry
+}
+
+// planUndo returns the actions needed to revert the journal entries of a run
+// along with the entries that can't be reverted.
+func planUndo(entries []*journal.Entry) ([]*undoAction, []*journal.Entry) {
+	var actions []*undoAction
+	var irreversible []*journal.Entry
+	actionsByID := make(map[string]*undoAction)
+
+	for _, entry := range entries {
+		if action, ok := actionsByID[entry.InstallationID]; ok {
+			action.last = entry
+			continue
+		}
+
+		var inverse string
+		switch entry.Action {
+		case "hibernate":
+			inverse = "wake-up"
+		case "wake-up":
+			inverse = "hibernate"
+		case "scale", "scale-rollback":
+			inverse = "scale"
+		default:
+			irreversible = append(irreversible, entry)
+			continue
+		}
+
+		action := &undoAction{
+			installationID: entry.InstallationID,
+			action:         inverse,
+			original:       entry,
+			last:           entry,
+		}
+		actionsByID[entry.InstallationID] = action
+		actions = append(actions, action)
+	}
+
+	return actions, irreversible
+}
+
+// provisionerEntries returns the journal entries of actions taken on the
+// provisioner. Entries of a run spanning multiple provisioners can only be
+// undone with the provisioners config.
+func provisionerEntries(entries []*journal.Entry, provisioner string) ([]*journal.Entry, error) {
+	var filtered []*journal.Entry
+	for _, entry := range entries {
+		if len(provisioner) == 0 && len(entry.Provisioner) != 0 {
+			return nil, errors.New("run spans multiple provisioners; provisioners-config value must be defined")
+		}
+		if entry.Provisioner == provisioner {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered, nil
+}
+
+// checkUndo returns an error if the installation changed since the run in a
+// way that makes undoing the action unsafe.
+func checkUndo(action *undoAction, installation *cmodel.InstallationDTO, unlock bool) error {
+	if installation == nil {
+		return errors.New("installation not found")
+	}
+	if installation.APISecurityLock && !unlock {
+		return errors.New("installation is locked and fleet controller is not set to perform unlocks")
+	}
+
+	switch action.action {
+	case "wake-up":
+		if installation.State != cmodel.InstallationStateHibernating {
+			return errors.Errorf("expected a hibernating installation (%s)", installation.State)
+		}
+	case "hibernate":
+		if installation.State != cmodel.InstallationStateStable {
+			return errors.Errorf("expected a stable installation (%s)", installation.State)
+		}
+	case "scale":
+		if installation.State != cmodel.InstallationStateStable {
+			return errors.Errorf("expected a stable installation (%s)", installation.State)
+		}
+		if installation.Size != action.last.NewSize {
+			return errors.Errorf("installation size changed from %s to %s since the run", action.last.NewSize, installation.Size)
+		}
+		if installation.Size == action.original.PreviousSize {
+			return errors.Errorf("installation is already %s", installation.Size)
+		}
+	}
+
+	return nil
+}
+
+func (a *undoAction) describe() string {
+	return a.from() + " -> " + a.to()
+}
+
+func (a *undoAction) from() string {
+	if a.action == "scale" {
+		return a.last.NewSize
+	}
+	return a.installation.State
+}
+
+func (a *undoAction) to() string {
+	if a.action == "scale" {
+		return a.original.PreviousSize
+	}
+	return a.expectedState()
+}
+
+func (a *undoAction) expectedState() string {
+	if a.action == "hibernate" {
+		return cmodel.InstallationStateHibernating
+	}
+	return cmodel.InstallationStateStable
+}
+
+func (a *undoAction) expectedSize() string {
+	if a.action == "scale" {
+		return a.original.PreviousSize
+	}
+	return ""
+}
+
+// journalEntry returns the journal entry recording the undo action.
+func (a *undoAction) journalEntry(pricing *pricingTable, logger log.FieldLogger) *journal.Entry {
+	entry := &journal.Entry{
+		InstallationID:  a.installationID,
+		Action:          a.action,
+		PreviousSize:    a.installation.Size,
+		NewSize:         a.installation.Size,
+		PreviousState:   a.installation.State,
+		APISecurityLock: a.installation.APISecurityLock,
+	}
+
+	var err error
+	switch a.action {
+	case "wake-up":
+		entry.NewState = cmodel.InstallationStateWakeUpRequested
+		entry.MonthlyCostChange, err = pricing.monthlyCostChange(a.installation.Size, true, a.installation.Size, false)
+	case "hibernate":
+		entry.NewState = cmodel.InstallationStateHibernating
+		entry.MonthlyCostChange, err = pricing.monthlyCostChange(a.installation.Size, false, a.installation.Size, true)
+	case "scale":
+		entry.NewSize = a.original.PreviousSize
+		entry.NewState = cmodel.InstallationStateUpdateRequested
+		entry.MonthlyCostChange, err = pricing.monthlyCostChange(a.installation.Size, false, a.original.PreviousSize, false)
+	}
+	if err != nil {
+		logger.WithField("installation", a.installationID).WithError(err).Warn("Failed to estimate undo cost change")
+	}
+
+	return entry
+}
+
+// undoInstallation reverts the action and restores the API lock state the
+// installation had before the run.
+func undoInstallation(action *undoAction, client model.ProvisionerClient) error {
+	var err error
+	installation := action.installation
+
+	switch action.action {
+	case "wake-up":
+		err = wakeupInstallation(installation, client)
+	case "hibernate":
+		err = hibernateInstallation(installation, client)
+	case "scale":
+		err = scaleInstallation(action.original.PreviousSize, installation, client)
+	default:
+		err = errors.Errorf("unknown undo action %s", action.action)
+	}
+	if err != nil {
+		return err
+	}
+
+	if action.original.APISecurityLock && !installation.APISecurityLock {
+		err = client.LockAPIForInstallation(installation.ID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to restore lock of installation %s", installation.ID)
+		}
+	}
+	if !action.original.APISecurityLock && installation.APISecurityLock {
+		err = client.UnlockAPIForInstallation(installation.ID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to restore unlock of installation %s", installation.ID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"testing"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/fleet-controller/internal/journal"
+)
+
+func TestPlanUndo(t *testing.T) {
+	entries := []*journal.Entry{
+		{InstallationID: "a", Action: "hibernate", PreviousState: cmodel.InstallationStateStable, APISecurityLock: true},
+		{InstallationID: "b", Action: "scale", PreviousSize: "100users", NewSize: "1000users"},
+		{InstallationID: "c", Action: "delete"},
+		{InstallationID: "b", Action: "scale-rollback", PreviousSize: "1000users", NewSize: "100users"},
+		{InstallationID: "d", Action: "wake-up"},
+	}
+
+	actions, irreversible := planUndo(entries)
+	require.Len(t, actions, 3)
+	require.Len(t, irreversible, 1)
+	assert.Equal(t, "c", irreversible[0].InstallationID)
+
+	assert.Equal(t, "wake-up", actions[0].action)
+	assert.True(t, actions[0].original.APISecurityLock)
+	assert.Equal(t, "scale", actions[1].action)
+	assert.Equal(t, "100users", actions[1].original.PreviousSize)
+	assert.Equal(t, "100users", actions[1].last.NewSize)
+	assert.Equal(t, "hibernate", actions[2].action)
+
+	t.Run("check undo", func(t *testing.T) {
+		installation := &cmodel.InstallationDTO{
+			Installation: &cmodel.Installation{
+				ID:    "a",
+				State: cmodel.InstallationStateHibernating,
+				Size:  "100users",
+			},
+		}
+		assert.NoError(t, checkUndo(actions[0], installation, false))
+
+		installation.APISecurityLock = true
+		assert.Error(t, checkUndo(actions[0], installation, false))
+		assert.NoError(t, checkUndo(actions[0], installation, true))
+
+		installation.State = cmodel.InstallationStateStable
+		assert.Error(t, checkUndo(actions[0], installation, true))
+
+		// Scale was already rolled back to the original size.
+		assert.Error(t, checkUndo(actions[1], installation, true))
+		assert.Error(t, checkUndo(actions[1], nil, true))
+	})
+}
+
+func TestProvisionerEntries(t *testing.T) {
+	entries := []*journal.Entry{
+		{InstallationID: "a", Provisioner: "east"},
+		{InstallationID: "b", Provisioner: "west"},
+	}
+
+	filtered, err := provisionerEntries(entries, "west")
+	require.NoError(t, err)
+	require.Len(t, filtered, 1)
+	assert.Equal(t, "b", filtered[0].InstallationID)
+
+	_, err = provisionerEntries(entries, "")
+	assert.Error(t, err)
+
+	filtered, err = provisionerEntries([]*journal.Entry{{InstallationID: "a"}}, "")
+	require.NoError(t, err)
+	assert.Len(t, filtered, 1)
+}
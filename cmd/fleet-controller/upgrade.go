@@ -0,0 +1,484 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/internal/notify"
+	"github.com/mattermost/fleet-controller/model"
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+)
+
+func init() {
+	upgradeCmd.PersistentFlags().String("server", "http://localhost:8075", "The provisioning server whose API will be queried.")
+	upgradeCmd.PersistentFlags().Bool("dry-run", true, "Whether the fleet controller will perform actions or just print actions that would be taken.")
+	upgradeCmd.PersistentFlags().Bool("unlock", false, "Whether the fleet controller will unlock installations to upgrade them or not.")
+	upgradeCmd.PersistentFlags().Int64("max-updating", 10, "The maximum number of installations that can be currently updating before upgrading more.")
+	upgradeCmd.PersistentFlags().String("version", "", "The Mattermost version to upgrade installations to.")
+	upgradeCmd.PersistentFlags().String("image", "", "The Mattermost image to upgrade installations to.")
+	upgradeCmd.PersistentFlags().IntSlice("waves", []int{1, 10, 50, 100}, "The cumulative percentages of installations upgraded by each wave. Each wave must return to stable before the next one starts.")
+	upgradeCmd.PersistentFlags().Float64("max-failure-rate", 0.1, "The fraction of installations in a wave that may fail to upgrade or return to stable before the rollout is halted.")
+	addExecutorFlags(upgradeCmd, 15*time.Second, 0)
+	addVerificationFlags(upgradeCmd, 30*time.Minute)
+	addTargetFlags(upgradeCmd)
+	addSelectorFlag(upgradeCmd)
+
+	// Installation filters
+	upgradeCmd.PersistentFlags().String("owner", "", "The owner ID value to filter installations by.")
+	upgradeCmd.PersistentFlags().String("group", "", "The group ID value to filter installations by.")
+}
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Roll out a Mattermost version or image to installations in canary waves",
+	RunE: forEachProvisioner(func(command *cobra.Command, args []string, settings *provisionerSettings) error {
+		command.SilenceUsage = true
+		ctx, cancel := newRunContext(command)
+		defer cancel()
+
+		productionLogs, _ := command.Flags().GetBool("production-logs")
+		logger := setupLogger("upgrade", productionLogs, settings.name)
+
+		logger.Info("Starting installation upgrade")
+
+		start := time.Now()
+
+		serverAddress := settings.server
+		dryrun, _ := command.Flags().GetBool("dry-run")
+		unlock, _ := command.Flags().GetBool("unlock")
+		version, _ := command.Flags().GetString("version")
+		image, _ := command.Flags().GetString("image")
+		wavePercentages, _ := command.Flags().GetIntSlice("waves")
+		maxFailureRate, _ := command.Flags().GetFloat64("max-failure-rate")
+		owner, _ := command.Flags().GetString("owner")
+		group, _ := command.Flags().GetString("group")
+
+		if len(serverAddress) == 0 {
+			return errors.New("server value must be defined")
+		}
+		if len(version) == 0 && len(image) == 0 {
+			return errors.New("version or image value must be defined")
+		}
+		if maxFailureRate < 0 || maxFailureRate > 1 {
+			return errors.New("max-failure-rate must be between 0 and 1")
+		}
+		err := validateWaves(wavePercentages)
+		if err != nil {
+			return err
+		}
+
+		targets, err := newInstallationTargets(command)
+		if err != nil {
+			return err
+		}
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+		runJournal, err := newJournal(command, "upgrade", settings.name)
+		if err != nil {
+			return err
+		}
+
+		notifier, err := newProvisionerNotifier(command, settings)
+		if err != nil {
+			return err
+		}
+
+		summary := newRunSummary("Upgrade Report", "upgrade", dryrun)
+		summary.AddFilter("Version", version)
+		summary.AddFilter("Image", image)
+		summary.AddFilter("Waves", wavePercentages)
+		summary.AddFilter("Max Failure Rate", maxFailureRate)
+		summary.AddFilter("Group ID", group)
+		summary.AddFilter("Owner ID", owner)
+		summary.AddFilter("Selector", sel)
+		targets.addFilters(summary)
+
+		client := newProvisionerClient(settings)
+
+		var installations []*cmodel.InstallationDTO
+		if targets.enabled() {
+			logger.Infof("Obtaining %d selected installations", len(targets.ids))
+			var missing []string
+			installations, missing, err = targets.getInstallations(ctx, client)
+			if err != nil {
+				return err
+			}
+			for _, id := range missing {
+				logger.WithField("installation", id).Warn("Could not find installation")
+				summary.AddError(id, errors.New("installation not found"))
+			}
+		} else {
+			logger.WithFields(log.Fields{
+				"owner-filter": owner,
+				"group-filter": group,
+			}).Info("Obtaining current installations")
+			installations, err = client.GetInstallations(&cmodel.GetInstallationsRequest{
+				State:                       cmodel.InstallationStateStable,
+				OwnerID:                     owner,
+				GroupID:                     group,
+				IncludeGroupConfig:          false,
+				IncludeGroupConfigOverrides: false,
+				Paging: cmodel.Paging{
+					Page:           0,
+					PerPage:        cmodel.AllPerPage,
+					IncludeDeleted: false,
+				},
+			})
+			if err != nil {
+				return errors.Wrap(err, "failed to get installations")
+			}
+		}
+		installations = sel.Filter(installations)
+
+		logger.Infof("Calculating upgrade actions on %d installations", len(installations))
+		var errorSkipCount, upToDateCount int
+		var installationsToUpgrade []*cmodel.InstallationDTO
+		for _, installation := range installations {
+			logger := logger.WithField("installation", installation.ID)
+
+			if !needsUpgrade(installation, version, image) {
+				logger.Debug("Installation is already up to date")
+				upToDateCount++
+				continue
+			}
+			err = canUpdate(installation, unlock)
+			if err != nil {
+				logger.WithError(err).Warn("Skipping installation upgrade")
+				summary.AddError(installation.ID, err)
+				errorSkipCount++
+				continue
+			}
+
+			installationsToUpgrade = append(installationsToUpgrade, installation)
+			progress.planned(installation.ID, "upgrade", describeRelease(installation.Version, installation.Image), describeRelease(upgradedValue(installation.Version, version), upgradedValue(installation.Image, image)))
+		}
+
+		waves := planWaves(len(installationsToUpgrade), wavePercentages)
+		logger.WithFields(log.Fields{
+			"upgrade-count":       len(installationsToUpgrade),
+			"up-to-date-count":    upToDateCount,
+			"upgrade-skip-errors": errorSkipCount,
+			"waves":               waves,
+		}).Info("Upgrade calculations complete")
+
+		if len(installationsToUpgrade) == 0 {
+			logger.Info("No installations require upgrading; exiting...")
+			return nil
+		}
+		if dryrun {
+			next := 0
+			for i, size := range waves {
+				for _, installation := range installationsToUpgrade[next : next+size] {
+					logger.WithField("installation", installation.ID).Infof("Installation would be upgraded in wave %d", i+1)
+				}
+				next += size
+			}
+			logger.Info("Dry run complete")
+			return nil
+		}
+
+		leader, err := acquireRunLock(command, settings, cancel, logger)
+		if err != nil {
+			return err
+		}
+		defer leader.release(logger)
+
+		// Each wave has to return to stable before the next one starts.
+		verify := newVerification(command)
+		verify.enabled = true
+		exec, err := newExecutor(command, settings, client, logger)
+		if err != nil {
+			return err
+		}
+
+		var upgradedCount, failedCount, completedWaves int
+		var runErr, haltErr error
+		next := 0
+		for i, size := range waves {
+			runErr = runCancelled(ctx)
+			if runErr != nil {
+				break
+			}
+
+			// Earlier waves can take a long time, so the installations of
+			// each wave are checked again before they are upgraded.
+			planned := installationsToUpgrade[next : next+size]
+			next += size
+			logger := logger.WithField("wave", i+1)
+			wave, upToDate, skipped, err := refreshWave(ctx, planned, version, image, unlock, client)
+			if err != nil {
+				runErr = err
+				summary.AddError("", runErr)
+				break
+			}
+			upToDateCount += upToDate
+			for _, installation := range planned {
+				skipErr, ok := skipped[installation.ID]
+				if !ok {
+					continue
+				}
+				logger.WithField("installation", installation.ID).WithError(skipErr).Warn("Skipping installation upgrade")
+				summary.AddError(installation.ID, skipErr)
+				errorSkipCount++
+			}
+			if len(wave) == 0 {
+				logger.Infof("No installations of wave %d of %d require upgrading", i+1, len(waves))
+				completedWaves++
+				continue
+			}
+			logger.Infof("Upgrading wave %d of %d (%d installations)", i+1, len(waves), len(wave))
+
+			var tasks []*executor.Task
+			for _, installation := range wave {
+				installation := installation
+				tasks = append(tasks, &executor.Task{
+					InstallationID: installation.ID,
+					Run: func() error {
+						logger.WithField("installation", installation.ID).Info("Upgrading installation")
+
+						err := upgradeInstallation(installation, version, image, client)
+						if err != nil {
+							return err
+						}
+
+						recordJournalEntry(runJournal, &journal.Entry{
+							InstallationID:  installation.ID,
+							Action:          "upgrade",
+							PreviousSize:    installation.Size,
+							NewSize:         installation.Size,
+							PreviousState:   installation.State,
+							NewState:        cmodel.InstallationStateUpdateRequested,
+							PreviousVersion: installation.Version,
+							NewVersion:      upgradedValue(installation.Version, version),
+							PreviousImage:   installation.Image,
+							NewImage:        upgradedValue(installation.Image, image),
+							APISecurityLock: installation.APISecurityLock,
+						}, logger)
+
+						return nil
+					},
+				})
+			}
+
+			var results []*executor.Result
+			results, runErr = exec.Run(ctx, progress.trackTasks(leader.lockTasks(tasks)))
+
+			installationsByID := make(map[string]*cmodel.InstallationDTO, len(wave))
+			for _, installation := range wave {
+				installationsByID[installation.ID] = installation
+			}
+
+			var waveFailures int
+			var expectations []*model.Expectation
+			for _, result := range results {
+				if result.Err != nil {
+					logger.WithField("installation", result.InstallationID).WithError(result.Err).Error("Failed to upgrade installation")
+					summary.AddError(result.InstallationID, result.Err)
+					waveFailures++
+					continue
+				}
+
+				installation := installationsByID[result.InstallationID]
+				newVersion := upgradedValue(installation.Version, version)
+				newImage := upgradedValue(installation.Image, image)
+				summary.AddChange(installation.ID, describeRelease(installation.Version, installation.Image), describeRelease(newVersion, newImage))
+				expectation := verify.expect(installation.ID, result.FinishedAt, "", cmodel.InstallationStateStable)
+				expectation.Version = version
+				expectation.Image = image
+				expectations = append(expectations, expectation)
+				upgradedCount++
+			}
+			if runErr != nil {
+				failedCount += waveFailures
+				summary.AddError("", runErr)
+				break
+			}
+
+			verificationFailures := verify.failed
+			verify.run(ctx, client, expectations, summary, logger)
+			waveFailures += verify.failed - verificationFailures
+			failedCount += waveFailures
+
+			runErr = runCancelled(ctx)
+			if runErr != nil {
+				summary.AddError("", runErr)
+				break
+			}
+			completedWaves++
+
+			failureRate := float64(waveFailures) / float64(len(wave))
+			logger.WithField("failure-rate", failureRate).Infof("Wave %d complete", i+1)
+			if failureRate > maxFailureRate {
+				haltErr = errors.Errorf("upgrade halted after wave %d of %d: %d of %d installations failed (%.0f%% exceeds the %.0f%% limit)", i+1, len(waves), waveFailures, len(wave), failureRate*100, maxFailureRate*100)
+				logger.WithError(haltErr).Error("Halting upgrade")
+				summary.AddError("", haltErr)
+				break
+			}
+		}
+
+		if targets.enabled() {
+			summary.AddCount("Selected Installations", len(targets.ids))
+		} else {
+			summary.AddCount("Original Stable Installations", len(installations))
+		}
+		summary.AddCount("Installations Already Up To Date", upToDateCount)
+		summary.AddCount("Installations Upgraded", upgradedCount)
+		summary.AddCount("Installations Not Attempted", len(installationsToUpgrade)-next)
+		summary.AddCount("Upgrade Skip Errors", errorSkipCount)
+		summary.AddCount("Upgrade Failures", failedCount)
+		summary.AddCount("Waves Completed", completedWaves)
+		verify.addCounts(summary)
+		notifier.sendRunReport(ctx, summary, start, logger)
+		if haltErr != nil {
+			notifier.sendSummaryEvent(notify.EventAbort, summary, start, logger)
+		}
+
+		logger.WithField("runtime", summary.Runtime).Info("Upgrade complete")
+
+		if runErr != nil {
+			return runErr
+		}
+		if haltErr != nil {
+			return haltErr
+		}
+		if failedCount != 0 {
+			return errors.Errorf("failed to upgrade %d of %d installations", failedCount, len(installationsToUpgrade))
+		}
+
+		return nil
+	}),
+}
+
+// validateWaves checks that wave percentages increase and end at 100.
+func validateWaves(percentages []int) error {
+	if len(percentages) == 0 {
+		return errors.New("at least one wave must be defined")
+	}
+
+	previous := 0
+	for _, percentage := range percentages {
+		if percentage <= previous || percentage > 100 {
+			return errors.Errorf("waves must increase and be between 1 and 100 (%v)", percentages)
+		}
+		previous = percentage
+	}
+	if previous != 100 {
+		return errors.Errorf("the last wave must be 100 (%v)", percentages)
+	}
+
+	return nil
+}
+
+// planWaves returns the number of installations upgraded in each wave given
+// the cumulative wave percentages. Every wave upgrades at least one
+// installation and waves left empty are dropped.
+func planWaves(total int, percentages []int) []int {
+	var waves []int
+	planned := 0
+	for _, percentage := range percentages {
+		target := (total*percentage + 99) / 100
+		if target <= planned {
+			target = planned + 1
+		}
+		if target > total {
+			target = total
+		}
+		if target == planned {
+			continue
+		}
+		waves = append(waves, target-planned)
+		planned = target
+	}
+
+	return waves
+}
+
+func needsUpgrade(installation *cmodel.InstallationDTO, version, image string) bool {
+	return (len(version) != 0 && installation.Version != version) || (len(image) != 0 && installation.Image != image)
+}
+
+// canUpdate checks that an installation is in a state that can be patched.
+func canUpdate(installation *cmodel.InstallationDTO, unlock bool) error {
+	if installation.State != cmodel.InstallationStateStable {
+		return errors.Errorf("expected only stable installations (%s)", installation.State)
+	}
+	if installation.APISecurityLock && !unlock {
+		return errors.New("installation is locked and fleet controller is not set to perform unlocks")
+	}
+
+	return nil
+}
+
+// upgradedValue returns the value an installation field has after an upgrade
+// where an empty value leaves the field unchanged.
+func upgradedValue(current, upgraded string) string {
+	if len(upgraded) == 0 {
+		return current
+	}
+	return upgraded
+}
+
+func describeRelease(version, image string) string {
+	return fmt.Sprintf("%s:%s", image, version)
+}
+
+// refreshWave gets the current state of the installations planned for a wave
+// and returns the ones that still need upgrading and can be updated, the
+// number that are already up to date and why the others are skipped.
+func refreshWave(ctx context.Context, planned []*cmodel.InstallationDTO, version, image string, unlock bool, client model.ProvisionerClient) ([]*cmodel.InstallationDTO, int, map[string]error, error) {
+	var wave []*cmodel.InstallationDTO
+	var upToDate int
+	skipped := make(map[string]error)
+	for _, plannedInstallation := range planned {
+		err := runCancelled(ctx)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		installation, err := client.GetInstallation(plannedInstallation.ID, &cmodel.GetInstallationRequest{})
+		if err != nil {
+			return nil, 0, nil, errors.Wrapf(err, "failed to get installation %s", plannedInstallation.ID)
+		}
+		if installation == nil {
+			skipped[plannedInstallation.ID] = errors.New("installation not found")
+			continue
+		}
+		if !needsUpgrade(installation, version, image) {
+			upToDate++
+			continue
+		}
+		err = canUpdate(installation, unlock)
+		if err != nil {
+			skipped[installation.ID] = err
+			continue
+		}
+		wave = append(wave, installation)
+	}
+
+	return wave, upToDate, skipped, nil
+}
+
+func upgradeInstallation(installation *cmodel.InstallationDTO, version, image string, client model.ProvisionerClient) error {
+	patch := &cmodel.PatchInstallationRequest{}
+	if len(version) != 0 {
+		patch.Version = &version
+	}
+	if len(image) != 0 {
+		patch.Image = &image
+	}
+
+	return patchInstallation(installation, patch, client)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/fleet-controller/model"
+)
+
+func TestPlanWaves(t *testing.T) {
+	defaultWaves := []int{1, 10, 50, 100}
+
+	assert.Equal(t, []int{1, 1, 3, 5}, planWaves(10, defaultWaves))
+	assert.Equal(t, []int{2, 9, 40, 49}, planWaves(100, []int{2, 11, 51, 100}))
+	assert.Equal(t, []int{1, 9, 40, 50}, planWaves(100, defaultWaves))
+	assert.Equal(t, []int{1, 1}, planWaves(2, defaultWaves))
+	assert.Equal(t, []int{1}, planWaves(1, defaultWaves))
+	assert.Empty(t, planWaves(0, defaultWaves))
+}
+
+func TestValidateWaves(t *testing.T) {
+	assert.NoError(t, validateWaves([]int{1, 10, 50, 100}))
+	assert.NoError(t, validateWaves([]int{100}))
+	assert.Error(t, validateWaves(nil))
+	assert.Error(t, validateWaves([]int{10, 10, 100}))
+	assert.Error(t, validateWaves([]int{50, 10, 100}))
+	assert.Error(t, validateWaves([]int{0, 100}))
+	assert.Error(t, validateWaves([]int{10, 50}))
+	assert.Error(t, validateWaves([]int{10, 150}))
+}
+
+func TestNeedsUpgrade(t *testing.T) {
+	installation := &cmodel.InstallationDTO{
+		Installation: &cmodel.Installation{
+			Version: "5.36.0",
+			Image:   "mattermost/mattermost-enterprise-edition",
+		},
+	}
+
+	assert.True(t, needsUpgrade(installation, "5.37.0", ""))
+	assert.False(t, needsUpgrade(installation, "5.36.0", ""))
+	assert.False(t, needsUpgrade(installation, "", "mattermost/mattermost-enterprise-edition"))
+	assert.True(t, needsUpgrade(installation, "5.36.0", "mattermost/mattermost-team-edition"))
+}
+
+type mockUpgradeClient struct {
+	model.ProvisionerClient
+	installations map[string]*cmodel.InstallationDTO
+}
+
+func (c *mockUpgradeClient) GetInstallation(installationID string, request *cmodel.GetInstallationRequest) (*cmodel.InstallationDTO, error) {
+	return c.installations[installationID], nil
+}
+
+func TestRefreshWave(t *testing.T) {
+	newInstallation := func(id, state, version string) *cmodel.InstallationDTO {
+		return &cmodel.InstallationDTO{Installation: &cmodel.Installation{ID: id, State: state, Version: version}}
+	}
+	planned := []*cmodel.InstallationDTO{
+		newInstallation("ready", cmodel.InstallationStateStable, "5.36.0"),
+		newInstallation("upgraded", cmodel.InstallationStateStable, "5.36.0"),
+		newInstallation("updating", cmodel.InstallationStateStable, "5.36.0"),
+		newInstallation("deleted", cmodel.InstallationStateStable, "5.36.0"),
+	}
+	client := &mockUpgradeClient{installations: map[string]*cmodel.InstallationDTO{
+		"ready":    newInstallation("ready", cmodel.InstallationStateStable, "5.36.0"),
+		"upgraded": newInstallation("upgraded", cmodel.InstallationStateStable, "5.37.0"),
+		"updating": newInstallation("updating", cmodel.InstallationStateUpdateInProgress, "5.36.0"),
+	}}
+
+	wave, upToDate, skipped, err := refreshWave(context.Background(), planned, "5.37.0", "", false, client)
+	require.NoError(t, err)
+	require.Len(t, wave, 1)
+	assert.Equal(t, "ready", wave[0].ID)
+	assert.Equal(t, 1, upToDate)
+	assert.Len(t, skipped, 2)
+	assert.Contains(t, skipped, "updating")
+	assert.Contains(t, skipped, "deleted")
+}
+
+func TestRefreshInstallation(t *testing.T) {
+	client := &mockUpgradeClient{installations: map[string]*cmodel.InstallationDTO{
+		"hibernating": {Installation: &cmodel.Installation{ID: "hibernating", State: cmodel.InstallationStateHibernating}},
+	}}
+
+	installation, err := refreshInstallation("hibernating", client)
+	require.NoError(t, err)
+	assert.Equal(t, cmodel.InstallationStateHibernating, installation.State)
+
+	_, err = refreshInstallation("deleted", client)
+	assert.EqualError(t, err, "installation not found")
+}
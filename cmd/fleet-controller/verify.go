@@ -0,0 +1,90 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/mattermost/fleet-controller/internal/webhook"
+	"github.com/mattermost/fleet-controller/model"
+)
+
+// addVerificationFlags adds the flags controlling post-action verification.
+func addVerificationFlags(command *cobra.Command, defaultTimeout time.Duration) {
+	command.PersistentFlags().Bool("verify", false, "Whether to wait for each installation to reach its expected state after an action is taken.")
+	command.PersistentFlags().Duration("verify-timeout", defaultTimeout, "How long each installation is given to reach its expected state after an action is taken.")
+	command.PersistentFlags().Duration("verify-poll-interval", 30*time.Second, "How often installations are checked while verifying actions.")
+}
+
+type verification struct {
+	enabled      bool
+	timeout      time.Duration
+	pollInterval time.Duration
+
+	verified int
+	failed   int
+}
+
+func newVerification(command *cobra.Command) *verification {
+	enabled, _ := command.Flags().GetBool("verify")
+	timeout, _ := command.Flags().GetDuration("verify-timeout")
+	pollInterval, _ := command.Flags().GetDuration("verify-poll-interval")
+
+	return &verification{
+		enabled:      enabled,
+		timeout:      timeout,
+		pollInterval: pollInterval,
+	}
+}
+
+// expect returns an expectation for an action that finished at the provided
+// time.
+func (v *verification) expect(installationID string, finishedAt time.Time, size string, states ...string) *model.Expectation {
+	return &model.Expectation{
+		InstallationID: installationID,
+		States:         states,
+		Size:           size,
+		Deadline:       finishedAt.Add(v.timeout),
+	}
+}
+
+// run waits for the expectations to be met and records the outcome in the
+// run summary.
+func (v *verification) run(ctx context.Context, client model.ProvisionerClient, expectations []*model.Expectation, summary *webhook.RunSummary, logger log.FieldLogger) []*model.VerificationResult {
+	if !v.enabled || len(expectations) == 0 {
+		return nil
+	}
+
+	logger.Infof("Verifying actions taken on %d installations", len(expectations))
+	results, err := model.VerifyInstallations(ctx, client, expectations, v.pollInterval, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Verification stopped early")
+		summary.AddError("", err)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			summary.AddError(result.InstallationID, result.Err)
+			v.failed++
+			continue
+		}
+		v.verified++
+	}
+
+	return results
+}
+
+// addCounts adds the verification counts to the run summary.
+func (v *verification) addCounts(summary *webhook.RunSummary) {
+	if !v.enabled {
+		return
+	}
+
+	summary.AddCount("Actions Verified", v.verified)
+	summary.AddCount("Verification Failures", v.failed)
+}
@@ -5,13 +5,15 @@
 package main
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/mattermost/fleet-controller/internal/executor"
+	"github.com/mattermost/fleet-controller/internal/journal"
+	"github.com/mattermost/fleet-controller/model"
 	cmodel "github.com/mattermost/mattermost-cloud/model"
 )
 
@@ -19,6 +21,11 @@ func init() {
 	wakeupCmd.PersistentFlags().String("server", "http://localhost:8075", "The provisioning server whose API will be queried.")
 	wakeupCmd.PersistentFlags().Bool("dry-run", true, "Whether the fleet controller will perform actions or just print actions that would be taken.")
 	wakeupCmd.PersistentFlags().Bool("unlock", false, "Whether the fleet controller will unlock installations to wake them up or not.")
+	wakeupCmd.PersistentFlags().Int64("max-updating", 25, "The maximum number of installations that can be currently updating before waking up more.")
+	addExecutorFlags(wakeupCmd, 10*time.Second, 0)
+	addVerificationFlags(wakeupCmd, 30*time.Minute)
+	addTargetFlags(wakeupCmd)
+	addSelectorFlag(wakeupCmd)
 
 	// Installation filters
 	wakeupCmd.PersistentFlags().String("owner", "", "The owner ID value to filter installations by.")
@@ -28,17 +35,19 @@ func init() {
 var wakeupCmd = &cobra.Command{
 	Use:   "wake-up",
 	Short: "Wake up installations",
-	RunE: func(command *cobra.Command, args []string) error {
+	RunE: forEachProvisioner(func(command *cobra.Command, args []string, settings *provisionerSettings) error {
 		command.SilenceUsage = true
+		ctx, cancel := newRunContext(command)
+		defer cancel()
 
 		productionLogs, _ := command.Flags().GetBool("production-logs")
-		logger := setupLogger("wake-up", productionLogs)
+		logger := setupLogger("wake-up", productionLogs, settings.name)
 
 		logger.Info("Waking up installations")
 
 		start := time.Now()
 
-		serverAddress, _ := command.Flags().GetString("server")
+		serverAddress := settings.server
 		dryrun, _ := command.Flags().GetBool("dry-run")
 		unlock, _ := command.Flags().GetBool("unlock")
 		owner, _ := command.Flags().GetString("owner")
@@ -48,27 +57,70 @@ var wakeupCmd = &cobra.Command{
 			return errors.New("server value must be defined")
 		}
 
-		client := cmodel.NewClient(serverAddress)
+		targets, err := newInstallationTargets(command)
+		if err != nil {
+			return err
+		}
+		sel, err := newSelector(command)
+		if err != nil {
+			return err
+		}
+		pricing, err := getPricingTable(command)
+		if err != nil {
+			return err
+		}
+		runJournal, err := newJournal(command, "wake-up", settings.name)
+		if err != nil {
+			return err
+		}
 
-		logger.WithFields(log.Fields{
-			"owner-filter": owner,
-			"group-filter": group,
-		}).Info("Obtaining current installations")
-		installations, err := client.GetInstallations(&cmodel.GetInstallationsRequest{
-			State:                       cmodel.InstallationStateHibernating,
-			OwnerID:                     owner,
-			GroupID:                     group,
-			IncludeGroupConfig:          false,
-			IncludeGroupConfigOverrides: false,
-			Paging: cmodel.Paging{
-				Page:           0,
-				PerPage:        cmodel.AllPerPage,
-				IncludeDeleted: false,
-			},
-		})
+		notifier, err := newProvisionerNotifier(command, settings)
 		if err != nil {
-			return errors.Wrap(err, "failed to get installations")
+			return err
+		}
+
+		summary := newRunSummary("Wake Up Report", "wake-up", dryrun)
+		summary.AddFilter("Group ID", group)
+		summary.AddFilter("Owner ID", owner)
+		summary.AddFilter("Selector", sel)
+		targets.addFilters(summary)
+
+		client := newProvisionerClient(settings)
+
+		var installations []*cmodel.InstallationDTO
+		if targets.enabled() {
+			logger.Infof("Obtaining %d selected installations", len(targets.ids))
+			var missing []string
+			installations, missing, err = targets.getInstallations(ctx, client)
+			if err != nil {
+				return err
+			}
+			for _, id := range missing {
+				logger.WithField("installation", id).Warn("Could not find installation")
+				summary.AddError(id, errors.New("installation not found"))
+			}
+		} else {
+			logger.WithFields(log.Fields{
+				"owner-filter": owner,
+				"group-filter": group,
+			}).Info("Obtaining current installations")
+			installations, err = client.GetInstallations(&cmodel.GetInstallationsRequest{
+				State:                       cmodel.InstallationStateHibernating,
+				OwnerID:                     owner,
+				GroupID:                     group,
+				IncludeGroupConfig:          false,
+				IncludeGroupConfigOverrides: false,
+				Paging: cmodel.Paging{
+					Page:           0,
+					PerPage:        cmodel.AllPerPage,
+					IncludeDeleted: false,
+				},
+			})
+			if err != nil {
+				return errors.Wrap(err, "failed to get installations")
+			}
 		}
+		installations = sel.Filter(installations)
 
 		logger.Infof("Calculating wake up actions on %d hibernating installations", len(installations))
 		var errorSkipCount int
@@ -84,11 +136,13 @@ var wakeupCmd = &cobra.Command{
 			err := shouldWakeUp(installation, unlock)
 			if err != nil {
 				logger.WithError(err).Warn("Failed wake up determination")
+				summary.AddError(installation.ID, err)
 				errorSkipCount++
 				continue
 			}
 
 			installationsToWakeUp = append(installationsToWakeUp, installation)
+			progress.planned(installation.ID, "wake-up", installation.State, cmodel.InstallationStateStable)
 		}
 
 		logger.WithFields(log.Fields{
@@ -107,51 +161,126 @@ var wakeupCmd = &cobra.Command{
 			return nil
 		}
 
-		for _, installation := range installationsToWakeUp {
-			logger.WithField("installation", installation.ID).Info("Waking installation up")
+		leader, err := acquireRunLock(command, settings, cancel, logger)
+		if err != nil {
+			return err
+		}
+		defer leader.release(logger)
 
-			err = wakeupInstallation(installation, client)
-			if err != nil {
-				return errors.Wrap(err, "failed to wake up installation")
-			}
+		verify := newVerification(command)
+		exec, err := newExecutor(command, settings, client, logger)
+		if err != nil {
+			return err
+		}
 
-			// Another sleep to slow the API calls to the provisioner.
-			time.Sleep(500 * time.Millisecond)
+		var tasks []*executor.Task
+		for i, planned := range installationsToWakeUp {
+			i, planned := i, planned
+			tasks = append(tasks, &executor.Task{
+				InstallationID: planned.ID,
+				Run: func() error {
+					logger.WithField("installation", planned.ID).Infof("Waking installation up %d/%d", i+1, len(installationsToWakeUp))
+
+					installation, err := refreshInstallation(planned.ID, client)
+					if err != nil {
+						return err
+					}
+					err = shouldWakeUp(installation, unlock)
+					if err != nil {
+						return errors.Wrap(err, "installation changed since wake up was planned")
+					}
+
+					err = wakeupInstallation(installation, client)
+					if err != nil {
+						return err
+					}
+
+					change, _ := pricing.monthlyCostChange(installation.Size, true, installation.Size, false)
+					recordJournalEntry(runJournal, &journal.Entry{
+						InstallationID:    installation.ID,
+						Action:            "wake-up",
+						PreviousSize:      installation.Size,
+						NewSize:           installation.Size,
+						PreviousState:     installation.State,
+						NewState:          cmodel.InstallationStateWakeUpRequested,
+						MonthlyCostChange: change,
+						APISecurityLock:   installation.APISecurityLock,
+					}, logger)
+
+					return nil
+				},
+			})
 		}
 
-		runtime := fmt.Sprintf("%s", time.Now().Sub(start))
+		results, runErr := exec.Run(ctx, progress.trackTasks(leader.lockTasks(tasks)))
 
-		logger.WithField("runtime", runtime).Info("Wake up check complete")
+		installationsByID := make(map[string]*cmodel.InstallationDTO, len(installationsToWakeUp))
+		for _, installation := range installationsToWakeUp {
+			installationsByID[installation.ID] = installation
+		}
 
-		return nil
-	},
-}
+		var wokenUpCount, failedCount int
+		var estimatedMonthlyCostChange float64
+		var expectations []*model.Expectation
+		for _, result := range results {
+			if result.Err != nil {
+				logger.WithField("installation", result.InstallationID).WithError(result.Err).Error("Failed to wake up installation")
+				summary.AddError(result.InstallationID, result.Err)
+				failedCount++
+				continue
+			}
 
-func wakeupInstallation(installation *cmodel.InstallationDTO, client *cmodel.Client) error {
-	var relock bool
-	var err error
+			installation := installationsByID[result.InstallationID]
+			change, err := pricing.monthlyCostChange(installation.Size, true, installation.Size, false)
+			if err != nil {
+				logger.WithField("installation", installation.ID).WithError(err).Warn("Failed to estimate wake up cost")
+			}
+			estimatedMonthlyCostChange += change
+			summary.AddChange(installation.ID, installation.State, cmodel.InstallationStateWakeUpRequested)
+			expectations = append(expectations, verify.expect(installation.ID, result.FinishedAt, installation.Size, cmodel.InstallationStateStable))
+			wokenUpCount++
+		}
+		if runErr != nil {
+			summary.AddError("", runErr)
+		}
+		verify.run(ctx, client, expectations, summary, logger)
 
-	if installation.APISecurityLock {
-		err = client.UnlockAPIForInstallation(installation.ID)
-		if err != nil {
-			return errors.Wrapf(err, "failed to unlock installation %s", installation.ID)
+		summary.AddCount("Original Hibernating Installations", len(installations))
+		summary.AddCount("Installations Woken Up", wokenUpCount)
+		summary.AddCount("Wake Up Calculation Errors", errorSkipCount)
+		summary.AddCount("Wake Up Failures", failedCount)
+		verify.addCounts(summary)
+		summary.EstimatedMonthlyCostChange = estimatedMonthlyCostChange
+		notifier.sendRunReport(ctx, summary, start, logger)
+
+		logger.WithFields(log.Fields{
+			"runtime":                       summary.Runtime,
+			"estimated-monthly-cost-change": estimatedMonthlyCostChange,
+		}).Info("Wake up check complete")
+
+		if runErr != nil {
+			return runErr
+		}
+		if failedCount != 0 {
+			return errors.Errorf("failed to wake up %d of %d installations", failedCount, len(installationsToWakeUp))
+		}
+		if verify.failed != 0 {
+			return errors.Errorf("%d woken up installations failed verification", verify.failed)
 		}
-		relock = true
-	}
 
-	installation, err = client.WakeupInstallation(installation.ID)
-	if err != nil {
-		return errors.Wrap(err, "failed to wake up installation")
-	}
+		return nil
+	}),
+}
 
-	if relock {
-		err = client.LockAPIForInstallation(installation.ID)
+func wakeupInstallation(installation *cmodel.InstallationDTO, client model.ProvisionerClient) error {
+	return withUnlockedAPI(installation, client, func() error {
+		_, err := client.WakeupInstallation(installation.ID)
 		if err != nil {
-			return errors.Wrapf(err, "failed to relock installation %s", installation.ID)
+			return errors.Wrap(err, "failed to wake up installation")
 		}
-	}
 
-	return nil
+		return nil
+	})
 }
 
 func shouldWakeUp(installation *cmodel.InstallationDTO, unlock bool) error {
@@ -3,6 +3,8 @@ module github.com/mattermost/fleet-controller
 go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
+	github.com/go-redis/redis/v8 v8.11.5
 	github.com/gopherjs/gopherjs v0.0.0-20200217142428-fce0ec30dd00 // indirect
 	github.com/mailru/easyjson v0.7.6 // indirect
 	github.com/mattermost/mattermost-cloud v0.45.0
@@ -13,6 +15,11 @@ require (
 	github.com/prometheus/common v0.15.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.1.1
+	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
 	gopkg.in/ini.v1 v1.62.0 // indirect
+	k8s.io/api v0.20.6
+	k8s.io/apimachinery v0.20.6
+	k8s.io/client-go v0.20.6
 )
@@ -0,0 +1,468 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Run states.
+const (
+	RunStateRunning   = "running"
+	RunStateSucceeded = "succeeded"
+	RunStateFailed    = "failed"
+	RunStateCancelled = "cancelled"
+)
+
+// RunIDEnv is the environment variable used to pass the ID of a run to the
+// process running it.
+const RunIDEnv = "FC_RUN_ID"
+
+// StatusFileFlag is the flag used to pass the status file to the process
+// running a run.
+const StatusFileFlag = "status-file"
+
+// Config configures the server.
+type Config struct {
+	// Executable is the fleet controller binary runs are started with.
+	Executable string
+	// BaseArgs are added to the arguments of every run.
+	BaseArgs []string
+	// Actions are the commands that runs can be started for.
+	Actions []string
+	// Parameters are the command flags that requests may set. Every other
+	// flag is rejected.
+	Parameters []string
+	// DataDir stores the logs and status files of runs.
+	DataDir string
+	// Token is the bearer token required on every request.
+	Token string
+	// Insecure allows the server to run without a token, leaving the API
+	// unauthenticated.
+	Insecure bool
+	// CancelTimeout is how long a cancelled run has to stop before it is
+	// killed.
+	CancelTimeout time.Duration
+}
+
+// CreateRunRequest is the body of a request to start a run.
+type CreateRunRequest struct {
+	Action string
+	// Args are the positional arguments of the command.
+	Args []string
+	// Parameters are the command flags by name without the leading dashes.
+	Parameters map[string]string
+}
+
+// Progress is the number of planned actions of a run and how many of them
+// have finished.
+type Progress struct {
+	Planned   int
+	Completed int
+	Failed    int
+}
+
+// Run is a run started by the server.
+type Run struct {
+	ID         string
+	Action     string
+	Args       []string          `json:",omitempty"`
+	Parameters map[string]string `json:",omitempty"`
+	State      string
+	CreateAt   int64
+	EndAt      int64     `json:",omitempty"`
+	Error      string    `json:",omitempty"`
+	Progress   *Progress `json:",omitempty"`
+
+	cmd       *exec.Cmd
+	done      chan struct{}
+	cancelled bool
+}
+
+// Server is an HTTP API to start runs and query their status.
+type Server struct {
+	config Config
+	logger log.FieldLogger
+
+	lock sync.Mutex
+	runs map[string]*Run
+}
+
+// NewServer returns a new server.
+func NewServer(config Config, logger log.FieldLogger) (*Server, error) {
+	if len(config.Executable) == 0 {
+		return nil, errors.New("executable must be defined")
+	}
+	if len(config.DataDir) == 0 {
+		return nil, errors.New("data directory must be defined")
+	}
+	if len(config.Token) == 0 && !config.Insecure {
+		return nil, errors.New("token must be defined unless the server is insecure")
+	}
+	err := os.MkdirAll(config.DataDir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create data directory")
+	}
+
+	return &Server{
+		config: config,
+		logger: logger,
+		runs:   make(map[string]*Run),
+	}, nil
+}
+
+// Handler returns the HTTP handler of the API.
+//
+//	GET  /api/runs                 list runs
+//	POST /api/runs                 start a run
+//	GET  /api/runs/{id}            get a run and its progress
+//	GET  /api/runs/{id}/plan       get the actions planned by a run
+//	GET  /api/runs/{id}/results    get the per-installation results of a run
+//	GET  /api/runs/{id}/logs       get the logs of a run
+//	POST /api/runs/{id}/cancel     cancel a run
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/runs", s.handleRuns)
+	mux.HandleFunc("/api/runs/", s.handleRun)
+
+	return s.authenticate(mux)
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.config.Token) != 0 && r.Header.Get("Authorization") != "Bearer "+s.config.Token {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.listRuns())
+	case http.MethodPost:
+		var request CreateRunRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "failed to decode request"))
+			return
+		}
+		run, err := s.startRun(&request)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, s.runView(run))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/runs/"), "/")
+	if len(parts) > 2 {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	run := s.getRun(parts[0])
+	if run == nil {
+		writeError(w, http.StatusNotFound, errors.Errorf("run %s not found", parts[0]))
+		return
+	}
+
+	var resource string
+	if len(parts) == 2 {
+		resource = parts[1]
+	}
+	method := http.MethodGet
+	if resource == "cancel" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	switch resource {
+	case "":
+		writeJSON(w, http.StatusOK, s.runView(run))
+	case "plan":
+		status, err := ReadStatusFile(s.statusFile(run.ID))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status.Plan)
+	case "results":
+		status, err := ReadStatusFile(s.statusFile(run.ID))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Results []*InstallationResult
+			Summary interface{} `json:",omitempty"`
+		}{status.Results, status.Summary})
+	case "logs":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, s.logFile(run.ID))
+	case "cancel":
+		err := s.cancelRun(run)
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, s.runView(run))
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *Server) statusFile(id string) string {
+	return filepath.Join(s.config.DataDir, id+".status.json")
+}
+
+func (s *Server) logFile(id string) string {
+	return filepath.Join(s.config.DataDir, id+".log")
+}
+
+// commandArgs returns the arguments the fleet controller is run with.
+func (s *Server) commandArgs(id string, request *CreateRunRequest) ([]string, error) {
+	if !contains(s.config.Actions, request.Action) {
+		return nil, errors.Errorf("unsupported action %q", request.Action)
+	}
+
+	args := []string{request.Action}
+	args = append(args, s.config.BaseArgs...)
+
+	var names []string
+	for name := range request.Parameters {
+		if !contains(s.config.Parameters, name) {
+			return nil, errors.Errorf("unsupported parameter %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, fmt.Sprintf("--%s=%s", name, request.Parameters[name]))
+	}
+
+	args = append(args, fmt.Sprintf("--%s=%s", StatusFileFlag, s.statusFile(id)))
+
+	// Positional arguments follow the flag terminator so they can't be used
+	// to pass flags.
+	if len(request.Args) != 0 {
+		args = append(args, "--")
+		args = append(args, request.Args...)
+	}
+
+	return args, nil
+}
+
+func (s *Server) startRun(request *CreateRunRequest) (*Run, error) {
+	id := cmodel.NewID()
+	args, err := s.commandArgs(id, request)
+	if err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.Create(s.logFile(id))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create run log file")
+	}
+
+	cmd := exec.Command(s.config.Executable, args...)
+	cmd.Env = append(os.Environ(), RunIDEnv+"="+id)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	err = cmd.Start()
+	if err != nil {
+		logFile.Close()
+		return nil, errors.Wrap(err, "failed to start run")
+	}
+
+	run := &Run{
+		ID:         id,
+		Action:     request.Action,
+		Args:       request.Args,
+		Parameters: request.Parameters,
+		State:      RunStateRunning,
+		CreateAt:   getMillis(),
+		cmd:        cmd,
+		done:       make(chan struct{}),
+	}
+
+	s.lock.Lock()
+	s.runs[id] = run
+	s.lock.Unlock()
+
+	logger := s.logger.WithFields(log.Fields{"run": id, "action": request.Action})
+	logger.Info("Started run")
+
+	go func() {
+		defer close(run.done)
+		defer logFile.Close()
+
+		waitErr := cmd.Wait()
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		run.EndAt = getMillis()
+		switch {
+		case run.cancelled:
+			run.State = RunStateCancelled
+		case waitErr != nil:
+			run.State = RunStateFailed
+			run.Error = waitErr.Error()
+		default:
+			run.State = RunStateSucceeded
+		}
+		logger.WithField("state", run.State).Info("Run finished")
+	}()
+
+	return run, nil
+}
+
+// cancelRun interrupts a run so it can stop gracefully and kills it if it
+// doesn't stop in time.
+func (s *Server) cancelRun(run *Run) error {
+	s.lock.Lock()
+	if run.State != RunStateRunning {
+		s.lock.Unlock()
+		return errors.Errorf("run is %s", run.State)
+	}
+	run.cancelled = true
+	s.lock.Unlock()
+
+	s.logger.WithField("run", run.ID).Info("Cancelling run")
+	err := run.cmd.Process.Signal(os.Interrupt)
+	if err != nil {
+		return errors.Wrap(err, "failed to interrupt run")
+	}
+
+	go func() {
+		select {
+		case <-run.done:
+		case <-time.After(s.config.CancelTimeout):
+			s.logger.WithField("run", run.ID).Warn("Run didn't stop in time; killing it")
+			run.cmd.Process.Kill()
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) getRun(id string) *Run {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.runs[id]
+}
+
+// runView returns a copy of the run with its current progress.
+func (s *Server) runView(run *Run) *Run {
+	s.lock.Lock()
+	view := &Run{
+		ID:         run.ID,
+		Action:     run.Action,
+		Args:       run.Args,
+		Parameters: run.Parameters,
+		State:      run.State,
+		CreateAt:   run.CreateAt,
+		EndAt:      run.EndAt,
+		Error:      run.Error,
+	}
+	s.lock.Unlock()
+
+	status, err := ReadStatusFile(s.statusFile(run.ID))
+	if err != nil {
+		s.logger.WithField("run", run.ID).WithError(err).Warn("Failed to read run status")
+		return view
+	}
+	view.Progress = &Progress{Planned: len(status.Plan)}
+	for _, result := range status.Results {
+		view.Progress.Completed++
+		if len(result.Error) != 0 {
+			view.Progress.Failed++
+		}
+	}
+
+	return view
+}
+
+// listRuns returns all runs, most recent first.
+func (s *Server) listRuns() []*Run {
+	s.lock.Lock()
+	runs := make([]*Run, 0, len(s.runs))
+	for _, run := range s.runs {
+		runs = append(runs, run)
+	}
+	s.lock.Unlock()
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].CreateAt > runs[j].CreateAt
+	})
+	views := make([]*Run, 0, len(runs))
+	for _, run := range runs {
+		views = append(views, s.runView(run))
+	}
+
+	return views
+}
+
+// Wait waits for all runs to finish.
+func (s *Server) Wait() {
+	s.lock.Lock()
+	var runs []*Run
+	for _, run := range s.runs {
+		runs = append(runs, run)
+	}
+	s.lock.Unlock()
+
+	for _, run := range runs {
+		<-run.done
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct{ Error string }{err.Error()})
+}
+
+func getMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
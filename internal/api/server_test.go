@@ -0,0 +1,216 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const helperEnv = "FC_API_TEST_HELPER"
+
+// TestMain lets the test binary act as the fleet controller started by the
+// server.
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) == "1" {
+		os.Exit(runHelper(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+func runHelper(args []string) int {
+	fmt.Printf("running %s as %s\n", strings.Join(args, " "), os.Getenv(RunIDEnv))
+
+	var statusFile string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--"+StatusFileFlag+"=") {
+			statusFile = strings.TrimPrefix(arg, "--"+StatusFileFlag+"=")
+		}
+	}
+	WriteStatusFile(statusFile, &RunStatus{
+		Plan: []*PlannedAction{
+			{InstallationID: "a", Action: "hibernate"},
+			{InstallationID: "b", Action: "hibernate"},
+		},
+		Results: []*InstallationResult{{InstallationID: "a"}},
+	})
+
+	switch args[0] {
+	case "fail":
+		return 1
+	case "wait":
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+		return 1
+	}
+	return 0
+}
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	os.Setenv(helperEnv, "1")
+	dir, err := ioutil.TempDir("", "api")
+	require.NoError(t, err)
+
+	server, err := NewServer(Config{
+		Executable:    os.Args[0],
+		BaseArgs:      []string{"--journal-dir=/tmp/journal"},
+		Actions:       []string{"succeed", "fail", "wait"},
+		Parameters:    []string{"selector", "dry-run"},
+		DataDir:       dir,
+		Token:         "secret",
+		CancelTimeout: 5 * time.Second,
+	}, log.New())
+	require.NoError(t, err)
+	httpServer := httptest.NewServer(server.Handler())
+
+	t.Cleanup(func() {
+		httpServer.Close()
+		server.Wait()
+		os.RemoveAll(dir)
+		os.Unsetenv(helperEnv)
+	})
+
+	return server, httpServer
+}
+
+func doRequest(t *testing.T, method, url string, body interface{}, out interface{}) int {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	request, err := http.NewRequest(method, url, reader)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	if out != nil {
+		data, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		if text, ok := out.(*string); ok {
+			*text = string(data)
+		} else {
+			require.NoError(t, json.Unmarshal(data, out))
+		}
+	}
+
+	return response.StatusCode
+}
+
+func waitForState(t *testing.T, url, state string) *Run {
+	var run Run
+	require.Eventually(t, func() bool {
+		doRequest(t, http.MethodGet, url, nil, &run)
+		return run.State == state
+	}, 10*time.Second, 10*time.Millisecond)
+
+	return &run
+}
+
+func TestServer(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	runsURL := httpServer.URL + "/api/runs"
+
+	t.Run("requires token", func(t *testing.T) {
+		response, err := http.Get(runsURL)
+		require.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	})
+
+	t.Run("rejects invalid runs", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, doRequest(t, http.MethodPost, runsURL, &CreateRunRequest{Action: "unknown"}, nil))
+		assert.Equal(t, http.StatusBadRequest, doRequest(t, http.MethodPost, runsURL, &CreateRunRequest{Action: "succeed", Parameters: map[string]string{"--server": "x"}}, nil))
+		assert.Equal(t, http.StatusBadRequest, doRequest(t, http.MethodPost, runsURL, &CreateRunRequest{Action: "succeed", Parameters: map[string]string{"journal-dir": "x"}}, nil))
+		assert.Equal(t, http.StatusBadRequest, doRequest(t, http.MethodPost, runsURL, &CreateRunRequest{Action: "succeed", Parameters: map[string]string{StatusFileFlag: "x"}}, nil))
+	})
+
+	t.Run("runs to completion", func(t *testing.T) {
+		var run Run
+		status := doRequest(t, http.MethodPost, runsURL, &CreateRunRequest{
+			Action:     "succeed",
+			Args:       []string{"arg"},
+			Parameters: map[string]string{"selector": "owner = a", "dry-run": "false"},
+		}, &run)
+		require.Equal(t, http.StatusCreated, status)
+
+		finished := waitForState(t, runsURL+"/"+run.ID, RunStateSucceeded)
+		require.NotNil(t, finished.Progress)
+		assert.Equal(t, Progress{Planned: 2, Completed: 1}, *finished.Progress)
+
+		var plan []*PlannedAction
+		doRequest(t, http.MethodGet, runsURL+"/"+run.ID+"/plan", nil, &plan)
+		assert.Len(t, plan, 2)
+
+		var logs string
+		doRequest(t, http.MethodGet, runsURL+"/"+run.ID+"/logs", nil, &logs)
+		assert.Contains(t, logs, "running succeed --journal-dir=/tmp/journal --dry-run=false --selector=owner = a --status-file=")
+		assert.Contains(t, logs, "-- arg as "+run.ID)
+
+		var runs []*Run
+		doRequest(t, http.MethodGet, runsURL, nil, &runs)
+		assert.NotEmpty(t, runs)
+	})
+
+	t.Run("reports failures", func(t *testing.T) {
+		var run Run
+		doRequest(t, http.MethodPost, runsURL, &CreateRunRequest{Action: "fail"}, &run)
+		finished := waitForState(t, runsURL+"/"+run.ID, RunStateFailed)
+		assert.NotEmpty(t, finished.Error)
+	})
+
+	t.Run("cancels runs", func(t *testing.T) {
+		var run Run
+		doRequest(t, http.MethodPost, runsURL, &CreateRunRequest{Action: "wait"}, &run)
+		// Wait for the helper to be listening for interrupts.
+		waitForState(t, runsURL+"/"+run.ID, RunStateRunning)
+		require.Eventually(t, func() bool {
+			var logs string
+			doRequest(t, http.MethodGet, runsURL+"/"+run.ID+"/logs", nil, &logs)
+			return len(logs) != 0
+		}, 10*time.Second, 10*time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+
+		assert.Equal(t, http.StatusAccepted, doRequest(t, http.MethodPost, runsURL+"/"+run.ID+"/cancel", nil, nil))
+		waitForState(t, runsURL+"/"+run.ID, RunStateCancelled)
+		assert.Equal(t, http.StatusConflict, doRequest(t, http.MethodPost, runsURL+"/"+run.ID+"/cancel", nil, nil))
+	})
+
+	t.Run("unknown run", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, doRequest(t, http.MethodGet, runsURL+"/missing", nil, nil))
+	})
+
+	server.Wait()
+}
+
+func TestNewServerRequiresToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{Executable: os.Args[0], DataDir: dir}
+	_, err = NewServer(config, log.New())
+	assert.Error(t, err)
+
+	config.Insecure = true
+	_, err = NewServer(config, log.New())
+	assert.NoError(t, err)
+}
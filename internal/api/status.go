@@ -0,0 +1,87 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/fleet-controller/internal/webhook"
+)
+
+// RunStatus is the plan and progress of a run. Runs started by the server
+// keep it up to date in their status file.
+type RunStatus struct {
+	Plan      []*PlannedAction
+	Results   []*InstallationResult
+	Summary   *webhook.RunSummary `json:",omitempty"`
+	UpdatedAt int64
+}
+
+// PlannedAction is an action a run intends to take on an installation.
+type PlannedAction struct {
+	InstallationID string
+	Action         string
+	From           string `json:",omitempty"`
+	To             string `json:",omitempty"`
+}
+
+// InstallationResult is the outcome of the action taken on an installation.
+type InstallationResult struct {
+	InstallationID string
+	Error          string `json:",omitempty"`
+	FinishedAt     int64
+}
+
+// ReadStatusFile reads a run status file. A missing file is an empty status
+// as runs only write it once they have planned actions.
+func ReadStatusFile(filename string) (*RunStatus, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &RunStatus{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read run status file")
+	}
+
+	var status RunStatus
+	err = json.Unmarshal(data, &status)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse run status file")
+	}
+
+	return &status, nil
+}
+
+// WriteStatusFile replaces the run status file so readers never see a
+// partially written status.
+func WriteStatusFile(filename string, status *RunStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode run status")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create run status file")
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write run status file")
+	}
+	err = tmp.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to write run status file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), filename), "failed to replace run status file")
+}
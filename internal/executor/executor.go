@@ -0,0 +1,333 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package executor
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// errorWindowSize is the number of recent task results used to calculate the
+// error rate.
+const errorWindowSize = 10
+
+// Task is a single action taken on an installation.
+type Task struct {
+	InstallationID string
+	Run            func() error
+}
+
+// Result is the outcome of a task.
+type Result struct {
+	InstallationID string
+	Err            error
+	FinishedAt     time.Time
+}
+
+// Status describes the installations currently updating on the provisioning
+// server.
+type Status struct {
+	Updating int64
+	// The fields below are only needed when per-cluster or per-group limits
+	// are configured.
+	UpdatingByCluster    map[string]int64
+	UpdatingByGroup      map[string]int64
+	InstallationClusters map[string][]string
+	InstallationGroups   map[string]string
+}
+
+// StatusFunc returns the current status of the provisioning server.
+type StatusFunc func() (*Status, error)
+
+// Config configures an executor.
+type Config struct {
+	// MinWorkers and MaxWorkers bound the number of tasks run concurrently.
+	MinWorkers int
+	MaxWorkers int
+	// MaxUpdating is the maximum number of installations that may be updating
+	// on the provisioning server before new tasks are held back.
+	MaxUpdating int64
+	// MaxUpdatingPerCluster and MaxUpdatingPerGroup limit the number of
+	// installations updating on a single cluster or in a single installation
+	// group. A value of 0 disables the limit.
+	MaxUpdatingPerCluster int64
+	MaxUpdatingPerGroup   int64
+	// PollInterval is how often the provisioner status is checked.
+	PollInterval time.Duration
+	// ErrorRateThreshold is the fraction of recent task failures that causes
+	// concurrency to back off.
+	ErrorRateThreshold float64
+	// TaskTimeout is how long a single task may run before it is reported as
+	// timed out. A timed out task keeps its worker until it returns. A value
+	// of 0 disables the timeout.
+	TaskTimeout time.Duration
+}
+
+// Executor runs tasks with a bounded, adaptive number of workers. Concurrency
+// backs off when many installations are updating or tasks start failing and
+// speeds up again while the provisioner is idle.
+type Executor struct {
+	config Config
+	status StatusFunc
+	logger log.FieldLogger
+
+	workers        int
+	budget         int64
+	lastStatus     time.Time
+	current        *Status
+	clusterStarted map[string]int64
+	groupStarted   map[string]int64
+	recentFails    []bool
+}
+
+// New returns a new executor.
+func New(config Config, status StatusFunc, logger log.FieldLogger) *Executor {
+	if config.MinWorkers < 1 {
+		config.MinWorkers = 1
+	}
+	if config.MaxWorkers < config.MinWorkers {
+		config.MaxWorkers = config.MinWorkers
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = 10 * time.Second
+	}
+	if config.ErrorRateThreshold <= 0 {
+		config.ErrorRateThreshold = 0.5
+	}
+
+	return &Executor{
+		config:  config,
+		status:  status,
+		logger:  logger,
+		workers: config.MinWorkers,
+	}
+}
+
+// Workers returns the current number of workers.
+func (e *Executor) Workers() int {
+	return e.workers
+}
+
+// Run runs all tasks and returns their results in completion order. If the
+// context is cancelled, no new tasks are started and the results of the tasks
+// that were started are returned with an error once they finish.
+func (e *Executor) Run(ctx context.Context, tasks []*Task) ([]*Result, error) {
+	results := make([]*Result, 0, len(tasks))
+	done := make(chan *Result)
+	pending := append([]*Task(nil), tasks...)
+	var inFlight int
+
+	var cancelled bool
+	cancel := ctx.Done()
+
+	collect := func(result *Result) {
+		inFlight--
+		e.recordResult(result)
+		results = append(results, result)
+	}
+
+	for (len(pending) > 0 && !cancelled) || inFlight > 0 {
+		if !cancelled && ctx.Err() != nil {
+			cancelled = true
+			cancel = nil
+		}
+		if len(pending) == 0 || cancelled || inFlight >= e.workers {
+			select {
+			case result := <-done:
+				collect(result)
+			case <-cancel:
+				cancelled = true
+				cancel = nil
+			}
+			continue
+		}
+
+		index := -1
+		if e.hasCapacity() {
+			index = e.nextTask(pending)
+		}
+		if index < 0 {
+			select {
+			case result := <-done:
+				collect(result)
+			case <-cancel:
+				cancelled = true
+				cancel = nil
+			case <-time.After(time.Until(e.lastStatus.Add(e.config.PollInterval))):
+			}
+			continue
+		}
+
+		task := pending[index]
+		pending = append(pending[:index], pending[index+1:]...)
+		inFlight++
+		e.start(task)
+		go func() {
+			err := e.runTask(task)
+			done <- &Result{InstallationID: task.InstallationID, Err: err, FinishedAt: time.Now()}
+		}()
+	}
+
+	if len(pending) > 0 {
+		return results, errors.Wrapf(ctx.Err(), "run stopped with %d of %d tasks not started", len(pending), len(tasks))
+	}
+
+	return results, nil
+}
+
+// runTask runs a task and reports it once it runs longer than the task
+// timeout. Tasks can't be interrupted, so a task that times out keeps its
+// worker, and any installation lock it holds, until it returns.
+func (e *Executor) runTask(task *Task) error {
+	if e.config.TaskTimeout <= 0 {
+		return task.Run()
+	}
+
+	finished := make(chan error, 1)
+	go func() {
+		finished <- task.Run()
+	}()
+
+	timer := time.NewTimer(e.config.TaskTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-finished:
+		return err
+	case <-timer.C:
+	}
+
+	logger := e.logger.WithField("installation", task.InstallationID)
+	logger.Warnf("Action timed out after %s; waiting for it to return", e.config.TaskTimeout)
+	err := <-finished
+	if err != nil {
+		return errors.Wrapf(err, "action timed out after %s", e.config.TaskTimeout)
+	}
+	logger.Info("Timed out action completed")
+
+	return nil
+}
+
+// hasCapacity returns whether another task can be started. The provisioner
+// status is refreshed at most once per poll interval, and tasks started since
+// the last refresh count against the remaining update budget.
+func (e *Executor) hasCapacity() bool {
+	if time.Since(e.lastStatus) >= e.config.PollInterval {
+		e.refreshStatus()
+	}
+
+	return e.budget > 0
+}
+
+// nextTask returns the index of the first pending task whose clusters and
+// group are below their limits, or -1 if there is none.
+func (e *Executor) nextTask(pending []*Task) int {
+	for i, task := range pending {
+		if e.taskAllowed(task) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (e *Executor) taskAllowed(task *Task) bool {
+	if e.config.MaxUpdatingPerCluster > 0 {
+		for _, cluster := range e.current.InstallationClusters[task.InstallationID] {
+			if e.current.UpdatingByCluster[cluster]+e.clusterStarted[cluster] >= e.config.MaxUpdatingPerCluster {
+				return false
+			}
+		}
+	}
+	if e.config.MaxUpdatingPerGroup > 0 {
+		group := e.current.InstallationGroups[task.InstallationID]
+		if len(group) != 0 && e.current.UpdatingByGroup[group]+e.groupStarted[group] >= e.config.MaxUpdatingPerGroup {
+			return false
+		}
+	}
+
+	return true
+}
+
+// start counts a started task against the remaining update budgets.
+func (e *Executor) start(task *Task) {
+	e.budget--
+	for _, cluster := range e.current.InstallationClusters[task.InstallationID] {
+		e.clusterStarted[cluster]++
+	}
+	if group := e.current.InstallationGroups[task.InstallationID]; len(group) != 0 {
+		e.groupStarted[group]++
+	}
+}
+
+func (e *Executor) refreshStatus() {
+	e.lastStatus = time.Now()
+	e.clusterStarted = make(map[string]int64)
+	e.groupStarted = make(map[string]int64)
+
+	status, err := e.status()
+	if err != nil {
+		e.logger.WithError(err).Error("Failed to get updating installation count")
+		e.current = &Status{}
+		e.budget = 0
+		e.setWorkers(e.workers / 2)
+		return
+	}
+	e.current = status
+	updating := status.Updating
+
+	e.budget = e.config.MaxUpdating - updating
+	e.logger.Debugf("%d installations are currently updating (max %d, workers %d)", updating, e.config.MaxUpdating, e.workers)
+
+	switch {
+	case updating*4 >= e.config.MaxUpdating*3:
+		e.setWorkers(e.workers / 2)
+	case updating*4 <= e.config.MaxUpdating && e.errorRate() < e.config.ErrorRateThreshold:
+		e.setWorkers(e.workers + 1)
+	}
+}
+
+func (e *Executor) recordResult(result *Result) {
+	e.recentFails = append(e.recentFails, result.Err != nil)
+	if len(e.recentFails) > errorWindowSize {
+		e.recentFails = e.recentFails[1:]
+	}
+
+	if len(e.recentFails) >= errorWindowSize/2 && e.errorRate() >= e.config.ErrorRateThreshold {
+		e.logger.Warnf("Task error rate is %.0f%%; reducing concurrency", e.errorRate()*100)
+		e.setWorkers(e.workers / 2)
+		e.recentFails = nil
+	}
+}
+
+func (e *Executor) errorRate() float64 {
+	if len(e.recentFails) == 0 {
+		return 0
+	}
+
+	var failures int
+	for _, failed := range e.recentFails {
+		if failed {
+			failures++
+		}
+	}
+
+	return float64(failures) / float64(len(e.recentFails))
+}
+
+func (e *Executor) setWorkers(workers int) {
+	if workers < e.config.MinWorkers {
+		workers = e.config.MinWorkers
+	}
+	if workers > e.config.MaxWorkers {
+		workers = e.config.MaxWorkers
+	}
+	if workers != e.workers {
+		e.logger.Debugf("Adjusting workers from %d to %d", e.workers, workers)
+	}
+	e.workers = workers
+}
@@ -0,0 +1,163 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTasks(count int, run func() error) []*Task {
+	var tasks []*Task
+	for i := 0; i < count; i++ {
+		tasks = append(tasks, &Task{InstallationID: fmt.Sprintf("installation%d", i), Run: run})
+	}
+	return tasks
+}
+
+func TestExecutor(t *testing.T) {
+	logger := log.New()
+	idle := func() (*Status, error) { return &Status{}, nil }
+
+	t.Run("runs all tasks within worker bounds", func(t *testing.T) {
+		var running, maxRunning int32
+		tasks := newTestTasks(20, func() error {
+			current := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil
+		})
+
+		exec := New(Config{MinWorkers: 2, MaxWorkers: 4, MaxUpdating: 100, PollInterval: time.Millisecond}, idle, logger)
+		results, err := exec.Run(context.Background(), tasks)
+		require.NoError(t, err)
+		assert.Len(t, results, 20)
+		assert.True(t, atomic.LoadInt32(&maxRunning) <= 4)
+		assert.Equal(t, 4, exec.Workers())
+	})
+
+	t.Run("backs off on errors", func(t *testing.T) {
+		tasks := newTestTasks(10, func() error { return errors.New("failed") })
+
+		exec := New(Config{MinWorkers: 1, MaxWorkers: 8, MaxUpdating: 100, PollInterval: time.Hour}, idle, logger)
+		exec.setWorkers(8)
+		results, err := exec.Run(context.Background(), tasks)
+		require.NoError(t, err)
+		assert.Len(t, results, 10)
+		for _, result := range results {
+			assert.Error(t, result.Err)
+		}
+		assert.True(t, exec.Workers() < 8)
+	})
+
+	t.Run("backs off when provisioner is busy", func(t *testing.T) {
+		var updating int64 = 10
+		status := func() (*Status, error) {
+			current := atomic.LoadInt64(&updating)
+			if current > 0 {
+				atomic.AddInt64(&updating, -1)
+			}
+			return &Status{Updating: current}, nil
+		}
+		tasks := newTestTasks(5, func() error { return nil })
+
+		exec := New(Config{MinWorkers: 1, MaxWorkers: 8, MaxUpdating: 10, PollInterval: time.Millisecond}, status, logger)
+		exec.setWorkers(8)
+		assert.False(t, exec.hasCapacity())
+		assert.Equal(t, 4, exec.Workers())
+
+		results, err := exec.Run(context.Background(), tasks)
+		require.NoError(t, err)
+		assert.Len(t, results, 5)
+	})
+
+	t.Run("status errors hold back tasks", func(t *testing.T) {
+		status := func() (*Status, error) { return nil, errors.New("unavailable") }
+		tasks := newTestTasks(3, func() error { return nil })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		exec := New(Config{MaxUpdating: 10, PollInterval: time.Millisecond}, status, logger)
+		results, err := exec.Run(ctx, tasks)
+		require.Error(t, err)
+		assert.Empty(t, results)
+	})
+
+	t.Run("limits updating per cluster and group", func(t *testing.T) {
+		status := func() (*Status, error) {
+			return &Status{
+				UpdatingByCluster:    map[string]int64{"cluster1": 1},
+				UpdatingByGroup:      map[string]int64{},
+				InstallationClusters: map[string][]string{"installation0": {"cluster1"}, "installation1": {"cluster1"}, "installation2": {"cluster2"}, "installation3": {"cluster2"}},
+				InstallationGroups:   map[string]string{"installation2": "group1", "installation3": "group1"},
+			}, nil
+		}
+		tasks := newTestTasks(4, func() error { return nil })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		exec := New(Config{MinWorkers: 4, MaxWorkers: 4, MaxUpdating: 100, MaxUpdatingPerCluster: 1, MaxUpdatingPerGroup: 1, PollInterval: time.Hour}, status, logger)
+		results, err := exec.Run(ctx, tasks)
+		require.Error(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "installation2", results[0].InstallationID)
+	})
+
+	t.Run("stops starting tasks when cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var started int32
+		tasks := newTestTasks(10, func() error {
+			if atomic.AddInt32(&started, 1) == 2 {
+				cancel()
+			}
+			time.Sleep(5 * time.Millisecond)
+			return nil
+		})
+
+		exec := New(Config{MinWorkers: 1, MaxWorkers: 1, MaxUpdating: 100, PollInterval: time.Hour}, idle, logger)
+		results, err := exec.Run(ctx, tasks)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.Len(t, results, 2)
+	})
+
+	t.Run("keeps workers of tasks that time out", func(t *testing.T) {
+		var running, maxRunning int32
+		run := func(err error) func() error {
+			return func() error {
+				if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&maxRunning) {
+					atomic.StoreInt32(&maxRunning, n)
+				}
+				defer atomic.AddInt32(&running, -1)
+				time.Sleep(30 * time.Millisecond)
+				return err
+			}
+		}
+		tasks := []*Task{
+			{InstallationID: "slow", Run: run(nil)},
+			{InstallationID: "failed", Run: run(errors.New("failed"))},
+			{InstallationID: "next", Run: run(nil)},
+		}
+
+		exec := New(Config{MinWorkers: 1, MaxWorkers: 1, MaxUpdating: 100, PollInterval: time.Hour, TaskTimeout: 10 * time.Millisecond}, idle, logger)
+		results, err := exec.Run(context.Background(), tasks)
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		assert.EqualValues(t, 1, maxRunning)
+		assert.NoError(t, results[0].Err)
+		assert.Contains(t, results[1].Err.Error(), "timed out")
+		assert.NoError(t, results[2].Err)
+	})
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const fileExtension = ".jsonl"
+
+// Entry is a single action taken on an installation during a run.
+type Entry struct {
+	RunID             string
+	Command           string
+	Timestamp         int64
+	InstallationID    string
+	Action            string
+	PreviousSize      string `json:",omitempty"`
+	NewSize           string `json:",omitempty"`
+	PreviousState     string `json:",omitempty"`
+	NewState          string `json:",omitempty"`
+	PreviousVersion   string `json:",omitempty"`
+	NewVersion        string `json:",omitempty"`
+	PreviousImage     string `json:",omitempty"`
+	NewImage          string `json:",omitempty"`
+	MonthlyCostChange float64
+	// APISecurityLock is whether the installation API was locked before the
+	// action was taken.
+	APISecurityLock bool
+	// Provisioner is the name of the provisioning server the action was taken
+	// on when the run spans multiple provisioners.
+	Provisioner string `json:",omitempty"`
+	// AddedAnnotations and RemovedAnnotations are the annotations changed on
+	// the installation.
+	AddedAnnotations   []string `json:",omitempty"`
+	RemovedAnnotations []string `json:",omitempty"`
+}
+
+// Journal persists the actions taken during a single run. A nil Journal is
+// valid and discards all entries.
+type Journal struct {
+	path        string
+	runID       string
+	command     string
+	provisioner string
+	lock        sync.Mutex
+}
+
+// New returns a journal for the provided run against the named provisioner
+// stored in the provided directory. The provisioner is empty when the run
+// isn't fanned out. A nil journal is returned if the directory is empty.
+func New(dir, runID, command, provisioner string) (*Journal, error) {
+	if len(dir) == 0 {
+		return nil, nil
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create journal directory")
+	}
+
+	return &Journal{
+		path:        filepath.Join(dir, runID+fileExtension),
+		runID:       runID,
+		command:     command,
+		provisioner: provisioner,
+	}, nil
+}
+
+// Record appends an entry to the journal.
+func (j *Journal) Record(entry *Entry) error {
+	if j == nil {
+		return nil
+	}
+
+	entry.RunID = j.runID
+	entry.Command = j.command
+	entry.Provisioner = j.provisioner
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal journal entry")
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open journal")
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		return errors.Wrap(err, "failed to write journal entry")
+	}
+
+	return nil
+}
+
+// ValidateRunID returns an error if a run ID could refer to a file outside of
+// the journal directory.
+func ValidateRunID(runID string) error {
+	if len(runID) == 0 {
+		return errors.New("run ID must not be empty")
+	}
+	if strings.ContainsAny(runID, `/\`) || strings.Contains(runID, "..") {
+		return errors.Errorf("invalid run ID %q", runID)
+	}
+
+	return nil
+}
+
+// ReadRun returns all entries recorded for a run.
+func ReadRun(dir, runID string) ([]*Entry, error) {
+	err := ValidateRunID(runID)
+	if err != nil {
+		return nil, err
+	}
+
+	return readFile(filepath.Join(dir, runID+fileExtension))
+}
+
+// ReadAll returns all entries of all runs in the journal directory ordered by
+// timestamp.
+func ReadAll(dir string) ([]*Entry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read journal directory")
+	}
+
+	var entries []*Entry
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), fileExtension) {
+			continue
+		}
+		runEntries, err := readFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, runEntries...)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp < entries[j].Timestamp
+	})
+
+	return entries, nil
+}
+
+func readFile(path string) ([]*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open journal")
+	}
+	defer file.Close()
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry Entry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse journal entry in %s", path)
+		}
+		entries = append(entries, &entry)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read journal")
+	}
+
+	return entries, nil
+}
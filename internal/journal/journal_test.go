@@ -0,0 +1,102 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("disabled", func(t *testing.T) {
+		j, err := New("", "run1", "hibernate", "")
+		require.NoError(t, err)
+		assert.Nil(t, j)
+		assert.NoError(t, j.Record(&Entry{InstallationID: "abc"}))
+	})
+
+	run1, err := New(dir, "run1", "hibernate", "")
+	require.NoError(t, err)
+	run2, err := New(dir, "run2", "scale", "us-east")
+	require.NoError(t, err)
+
+	require.NoError(t, run1.Record(&Entry{Timestamp: 3, InstallationID: "a", Action: "hibernate"}))
+	require.NoError(t, run2.Record(&Entry{Timestamp: 2, InstallationID: "b", Action: "scale"}))
+	require.NoError(t, run1.Record(&Entry{Timestamp: 1, InstallationID: "c", Action: "hibernate"}))
+
+	t.Run("read run", func(t *testing.T) {
+		entries, err := ReadRun(dir, "run1")
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		assert.Equal(t, "a", entries[0].InstallationID)
+		assert.Equal(t, "run1", entries[0].RunID)
+		assert.Equal(t, "hibernate", entries[0].Command)
+		assert.Empty(t, entries[0].Provisioner)
+		assert.Equal(t, "c", entries[1].InstallationID)
+	})
+
+	t.Run("read missing run", func(t *testing.T) {
+		_, err := ReadRun(dir, "unknown")
+		assert.Error(t, err)
+	})
+
+	t.Run("read all", func(t *testing.T) {
+		entries, err := ReadAll(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+		assert.Equal(t, "c", entries[0].InstallationID)
+		assert.Equal(t, "b", entries[1].InstallationID)
+		assert.Equal(t, "scale", entries[1].Command)
+		assert.Equal(t, "a", entries[2].InstallationID)
+	})
+}
+
+func TestValidateRunID(t *testing.T) {
+	assert.NoError(t, ValidateRunID("fu8ma7stwfrbfmwpbqjgh3emgr"))
+	assert.Error(t, ValidateRunID(""))
+	assert.Error(t, ValidateRunID("../run1"))
+	assert.Error(t, ValidateRunID("runs/run1"))
+	assert.Error(t, ValidateRunID(`runs\run1`))
+	assert.Error(t, ValidateRunID(".."))
+
+	_, err := ReadRun(os.TempDir(), "../etc/passwd")
+	assert.Error(t, err)
+}
+
+func TestObservedStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	states, err := ReadObservedStates(dir)
+	require.NoError(t, err)
+	assert.Empty(t, states)
+
+	first := time.Unix(1600000000, 0)
+	later := first.Add(time.Hour)
+	assert.Equal(t, first, states.Observe("a", "update-failed", first))
+	assert.Equal(t, first, states.Observe("b", "stable", first))
+	assert.True(t, states.Escalate("a", "upgrade run1"))
+	assert.True(t, states.Escalate("b", "upgrade run1"))
+	require.NoError(t, WriteObservedStates(dir, states))
+
+	states, err = ReadObservedStates(dir)
+	require.NoError(t, err)
+	assert.Equal(t, first, states.Observe("a", "update-failed", later))
+	assert.Equal(t, later, states.Observe("b", "update-in-progress", later))
+	assert.False(t, states.Escalate("a", "upgrade run1"))
+	assert.True(t, states.Escalate("a", "scale run2"))
+	assert.True(t, states.Escalate("b", "upgrade run1"))
+
+	states, err = ReadObservedStates("")
+	require.NoError(t, err)
+	assert.Empty(t, states)
+	assert.NoError(t, WriteObservedStates("", states))
+}
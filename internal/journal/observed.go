@@ -0,0 +1,118 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package journal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// observedStatesFilename is the file in the journal directory that stores the
+// observed state of each installation.
+const observedStatesFilename = "observed-states.json"
+
+// ObservedState is the state an installation was last observed in and when it
+// was first observed in that state.
+type ObservedState struct {
+	State string `json:"state"`
+	Since int64  `json:"since"`
+	// Escalated identifies what the installation was last escalated for while
+	// in this state.
+	Escalated string `json:"escalated,omitempty"`
+}
+
+// ObservedStates are the observed states of installations by ID. The
+// provisioning server doesn't expose when an installation changed state, so
+// how long an installation has been in a state is measured from when it was
+// first observed in it.
+type ObservedStates map[string]*ObservedState
+
+// Observe records the state an installation is in and returns when it was
+// first observed in that state.
+func (o ObservedStates) Observe(installationID, state string, now time.Time) time.Time {
+	observed := o[installationID]
+	if observed == nil || observed.State != state {
+		observed = &ObservedState{State: state, Since: now.UnixNano() / int64(time.Millisecond)}
+		o[installationID] = observed
+	}
+
+	return time.Unix(0, observed.Since*int64(time.Millisecond))
+}
+
+// Escalate records that an installation is escalated for a reason in the state
+// it was last observed in. It returns false if the installation was already
+// escalated for the same reason in that state, so a stuck installation isn't
+// escalated again on every run.
+func (o ObservedStates) Escalate(installationID, reason string) bool {
+	observed := o[installationID]
+	if observed == nil {
+		return true
+	}
+	if observed.Escalated == reason {
+		return false
+	}
+	observed.Escalated = reason
+
+	return true
+}
+
+// ReadObservedStates returns the states observed by earlier runs. No states
+// are returned when there is no journal directory or nothing was observed.
+func ReadObservedStates(dir string) (ObservedStates, error) {
+	states := make(ObservedStates)
+	if len(dir) == 0 {
+		return states, nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, observedStatesFilename))
+	if os.IsNotExist(err) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read observed states")
+	}
+
+	err = json.Unmarshal(data, &states)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse observed states")
+	}
+
+	return states, nil
+}
+
+// WriteObservedStates saves the observed states in the journal directory. The
+// states are discarded when there is no journal directory.
+func WriteObservedStates(dir string, states ObservedStates) error {
+	if len(dir) == 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create journal directory")
+	}
+	data, err := json.Marshal(states)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal observed states")
+	}
+
+	// Write to a temporary file first so a reader never sees a partial file.
+	path := filepath.Join(dir, observedStatesFilename)
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to write observed states")
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return errors.Wrap(err, "failed to write observed states")
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package lock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileBackend stores leases as files in a directory. It is only safe for
+// controllers running on the same host.
+type FileBackend struct {
+	dir string
+}
+
+type fileLease struct {
+	Owner     string
+	ExpiresAt int64
+}
+
+// NewFileBackend returns a backend storing leases in the provided directory.
+func NewFileBackend(dir string) (*FileBackend, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create lock directory")
+	}
+
+	return &FileBackend{dir: dir}, nil
+}
+
+// TryAcquire acquires or extends a lease.
+func (b *FileBackend) TryAcquire(name, owner string, ttl time.Duration) (bool, error) {
+	acquired := false
+	err := b.withLeaseFile(name, func(current *fileLease) (*fileLease, error) {
+		if current != nil && current.Owner != owner && current.ExpiresAt > time.Now().UnixNano() {
+			return nil, nil
+		}
+		acquired = true
+		return &fileLease{Owner: owner, ExpiresAt: time.Now().Add(ttl).UnixNano()}, nil
+	})
+
+	return acquired, err
+}
+
+// Release releases a lease held by the owner.
+func (b *FileBackend) Release(name, owner string) error {
+	return b.withLeaseFile(name, func(current *fileLease) (*fileLease, error) {
+		if current == nil || current.Owner != owner {
+			return nil, nil
+		}
+		return &fileLease{}, nil
+	})
+}
+
+// withLeaseFile runs update while holding an exclusive lock on the lease file.
+// The lease returned by update is written to the file unless it is nil.
+func (b *FileBackend) withLeaseFile(name string, update func(*fileLease) (*fileLease, error)) error {
+	file, err := os.OpenFile(filepath.Join(b.dir, name+".lease"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open lease file")
+	}
+	defer file.Close()
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return errors.Wrap(err, "failed to lock lease file")
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read lease file")
+	}
+	var current *fileLease
+	if len(data) != 0 {
+		current = &fileLease{}
+		err = json.Unmarshal(data, current)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse lease file")
+		}
+		if len(current.Owner) == 0 {
+			current = nil
+		}
+	}
+
+	lease, err := update(current)
+	if err != nil || lease == nil {
+		return err
+	}
+
+	data, err = json.Marshal(lease)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal lease")
+	}
+	err = file.Truncate(0)
+	if err != nil {
+		return errors.Wrap(err, "failed to truncate lease file")
+	}
+	_, err = file.WriteAt(data, 0)
+	if err != nil {
+		return errors.Wrap(err, "failed to write lease file")
+	}
+
+	return nil
+}
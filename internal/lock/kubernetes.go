@@ -0,0 +1,180 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package lock
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	kubernetesLeasePrefix = "fleet-controller-"
+	kubernetesTimeout     = 10 * time.Second
+)
+
+var invalidLeaseNameCharacters = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// KubernetesBackend stores leases as coordination.k8s.io Lease objects. Lease
+// durations are stored in whole seconds, so TTLs are rounded up.
+type KubernetesBackend struct {
+	client    coordinationv1client.LeasesGetter
+	namespace string
+}
+
+// NewKubernetesBackend returns a backend storing leases in the namespace of
+// the cluster configured in the kubeconfig file. The in-cluster config is used
+// when no kubeconfig file is provided.
+func NewKubernetesBackend(kubeconfig, namespace string) (*KubernetesBackend, error) {
+	if len(namespace) == 0 {
+		return nil, errors.New("kubernetes lease namespace must be defined")
+	}
+
+	var config *rest.Config
+	var err error
+	if len(kubeconfig) != 0 {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load kubernetes config")
+	}
+
+	client, err := coordinationv1client.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create kubernetes client")
+	}
+
+	return NewKubernetesBackendForClient(client, namespace), nil
+}
+
+// NewKubernetesBackendForClient returns a backend storing leases with the
+// provided client.
+func NewKubernetesBackendForClient(client coordinationv1client.LeasesGetter, namespace string) *KubernetesBackend {
+	return &KubernetesBackend{client: client, namespace: namespace}
+}
+
+// TryAcquire acquires or extends a lease. A lease that changed since it was
+// read is treated as held by another owner.
+func (b *KubernetesBackend) TryAcquire(name, owner string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubernetesTimeout)
+	defer cancel()
+
+	leases := b.client.Leases(b.namespace)
+	leaseName := kubernetesLeaseName(name)
+	now := metav1.NewMicroTime(time.Now())
+	durationSeconds := int32(math.Ceil(ttl.Seconds()))
+	if durationSeconds < 1 {
+		durationSeconds = 1
+	}
+
+	lease, err := leases.Get(ctx, leaseName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: leaseName},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &owner,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "failed to create kubernetes lease")
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get kubernetes lease")
+	}
+
+	held := lease.Spec.HolderIdentity != nil && len(*lease.Spec.HolderIdentity) != 0
+	if held && *lease.Spec.HolderIdentity != owner && !leaseExpired(lease, now.Time) {
+		return false, nil
+	}
+
+	if !held || *lease.Spec.HolderIdentity != owner {
+		var transitions int32
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions
+		}
+		transitions++
+		lease.Spec.HolderIdentity = &owner
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions = &transitions
+	}
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.RenewTime = &now
+
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if k8serrors.IsConflict(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to update kubernetes lease")
+	}
+
+	return true, nil
+}
+
+// Release releases a lease held by the owner.
+func (b *KubernetesBackend) Release(name, owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kubernetesTimeout)
+	defer cancel()
+
+	leases := b.client.Leases(b.namespace)
+	lease, err := leases.Get(ctx, kubernetesLeaseName(name), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get kubernetes lease")
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != owner {
+		return nil
+	}
+
+	err = leases.Delete(ctx, lease.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+	if k8serrors.IsNotFound(err) || k8serrors.IsConflict(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to delete kubernetes lease")
+	}
+
+	return nil
+}
+
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expires := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+
+	return now.After(expires)
+}
+
+// kubernetesLeaseName returns a valid object name for a lease.
+func kubernetesLeaseName(name string) string {
+	name = invalidLeaseNameCharacters.ReplaceAllString(strings.ToLower(name), "-")
+
+	return strings.Trim(kubernetesLeasePrefix+name, "-.")
+}
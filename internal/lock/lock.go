@@ -0,0 +1,167 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+// Package lock provides leases that keep multiple fleet controllers from
+// acting at the same time or on the same installation.
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Backend stores leases.
+type Backend interface {
+	// TryAcquire acquires the named lease for the owner if it is free or
+	// expired, or extends it if it is already held by the owner. It returns
+	// whether the owner holds the lease.
+	TryAcquire(name, owner string, ttl time.Duration) (bool, error)
+	// Release releases the named lease if it is held by the owner.
+	Release(name, owner string) error
+}
+
+// Lease is a lease that is renewed in the background until released.
+type Lease struct {
+	backend Backend
+	name    string
+	owner   string
+	ttl     time.Duration
+	logger  log.FieldLogger
+
+	lost     chan struct{}
+	lostOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// Acquire acquires the named lease, retrying until it is acquired, the wait
+// time has passed or the context is cancelled. The lease is renewed every
+// third of its TTL.
+func Acquire(ctx context.Context, backend Backend, name, owner string, ttl, wait time.Duration, logger log.FieldLogger) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, errors.New("lease TTL must be greater than 0")
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		acquired, err := backend.TryAcquire(name, owner, ttl)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to acquire lease %s", name)
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("lease %s is held by another owner", name)
+		}
+		logger.Infof("Waiting for lease %s held by another owner", name)
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "stopped waiting for lease %s", name)
+		case <-time.After(minDuration(ttl/3, time.Until(deadline)+time.Millisecond)):
+		}
+	}
+
+	return newLease(backend, name, owner, ttl, logger), nil
+}
+
+// TryAcquire acquires the named lease without waiting. A nil lease is
+// returned if it is held by another owner. The lease is renewed every third
+// of its TTL.
+func TryAcquire(backend Backend, name, owner string, ttl time.Duration, logger log.FieldLogger) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, errors.New("lease TTL must be greater than 0")
+	}
+
+	acquired, err := backend.TryAcquire(name, owner, ttl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to acquire lease %s", name)
+	}
+	if !acquired {
+		return nil, nil
+	}
+
+	return newLease(backend, name, owner, ttl, logger), nil
+}
+
+// newLease returns a lease that has been acquired and starts renewing it.
+func newLease(backend Backend, name, owner string, ttl time.Duration, logger log.FieldLogger) *Lease {
+	lease := &Lease{
+		backend: backend,
+		name:    name,
+		owner:   owner,
+		ttl:     ttl,
+		logger:  logger,
+		lost:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go lease.renew()
+
+	return lease
+}
+
+func (l *Lease) renew() {
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	lastRenewal := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		acquired, err := l.backend.TryAcquire(l.name, l.owner, l.ttl)
+		if err == nil && acquired {
+			lastRenewal = time.Now()
+			continue
+		}
+		if err != nil && time.Since(lastRenewal) < l.ttl {
+			l.logger.WithError(err).Warnf("Failed to renew lease %s; retrying", l.name)
+			continue
+		}
+
+		l.logger.WithError(err).Errorf("Lost lease %s", l.name)
+		l.lostOnce.Do(func() { close(l.lost) })
+		return
+	}
+}
+
+// Lost returns a channel that is closed if the lease can't be renewed.
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// IsLost returns whether the lease has been lost.
+func (l *Lease) IsLost() bool {
+	select {
+	case <-l.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release stops renewing the lease and releases it.
+func (l *Lease) Release() error {
+	close(l.stop)
+	<-l.stopped
+
+	return l.backend.Release(l.name, l.owner)
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,118 @@
+package lock
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testBackend checks the behaviour of a backend. Expiry is checked with the
+// shortest TTL the backend supports.
+func testBackend(t *testing.T, backend Backend, shortTTL time.Duration, expire func()) {
+	acquired, err := backend.TryAcquire("leader", "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = backend.TryAcquire("leader", "b", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	acquired, err = backend.TryAcquire("leader", "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired, "owner can renew")
+
+	require.NoError(t, backend.Release("leader", "b"))
+	acquired, err = backend.TryAcquire("leader", "b", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired, "only the owner can release")
+
+	require.NoError(t, backend.Release("leader", "a"))
+	acquired, err = backend.TryAcquire("leader", "b", shortTTL)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	expire()
+	acquired, err = backend.TryAcquire("leader", "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired, "expired leases can be taken over")
+}
+
+func TestFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backend, err := NewFileBackend(dir)
+	require.NoError(t, err)
+	testBackend(t, backend, 20*time.Millisecond, func() { time.Sleep(30 * time.Millisecond) })
+}
+
+func TestRedisBackend(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+	server.RequireAuth("secret")
+
+	backend, err := NewRedisBackend("redis://:secret@" + server.Addr() + "/2")
+	require.NoError(t, err)
+	defer backend.Close()
+	testBackend(t, backend, 20*time.Millisecond, func() { server.FastForward(30 * time.Millisecond) })
+
+	_, err = NewRedisBackend("http://localhost")
+	assert.Error(t, err)
+}
+
+func TestKubernetesBackend(t *testing.T) {
+	backend := NewKubernetesBackendForClient(fake.NewSimpleClientset().CoordinationV1(), "fleet")
+	testBackend(t, backend, time.Second, func() { time.Sleep(1100 * time.Millisecond) })
+
+	assert.Equal(t, "fleet-controller-leader-us-east", kubernetesLeaseName("leader-US_East"))
+
+	_, err := NewKubernetesBackend("", "")
+	assert.Error(t, err)
+}
+
+func TestLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backend, err := NewFileBackend(dir)
+	require.NoError(t, err)
+	logger := log.New()
+
+	lease, err := Acquire(context.Background(), backend, "leader", "a", 30*time.Millisecond, 0, logger)
+	require.NoError(t, err)
+
+	// The lease is renewed beyond its original TTL.
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, lease.IsLost())
+	_, err = Acquire(context.Background(), backend, "leader", "b", 30*time.Millisecond, 20*time.Millisecond, logger)
+	assert.Error(t, err)
+
+	require.NoError(t, lease.Release())
+	other, err := Acquire(context.Background(), backend, "leader", "b", 30*time.Millisecond, 0, logger)
+	require.NoError(t, err)
+
+	// TryAcquire doesn't wait for a held lease, but renews the leases it
+	// acquires.
+	held, err := TryAcquire(backend, "leader", "a", 30*time.Millisecond, logger)
+	require.NoError(t, err)
+	assert.Nil(t, held)
+	require.NoError(t, other.Release())
+
+	held, err = TryAcquire(backend, "leader", "a", 30*time.Millisecond, logger)
+	require.NoError(t, err)
+	require.NotNil(t, held)
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, held.IsLost())
+	require.NoError(t, held.Release())
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package lock
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	redisKeyPrefix = "fleet-controller:lease:"
+	redisTimeout   = 10 * time.Second
+)
+
+var (
+	// renewScript extends a lease only if it is still held by the owner.
+	renewScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`)
+	// releaseScript deletes a lease only if it is held by the owner.
+	releaseScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`)
+)
+
+// RedisBackend stores leases in Redis.
+type RedisBackend struct {
+	client *redis.Client
+}
+
+// NewRedisBackend returns a backend for a server URL in the form
+// redis://[:password@]host:port[/database].
+func NewRedisBackend(serverURL string) (*RedisBackend, error) {
+	options, err := redis.ParseURL(serverURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse redis URL")
+	}
+	options.DialTimeout = redisTimeout
+	options.ReadTimeout = redisTimeout
+	options.WriteTimeout = redisTimeout
+
+	return &RedisBackend{client: redis.NewClient(options)}, nil
+}
+
+// TryAcquire acquires or extends a lease.
+func (b *RedisBackend) TryAcquire(name, owner string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	key := redisKeyPrefix + name
+
+	acquired, err := b.client.SetNX(ctx, key, owner, ttl).Result()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to acquire redis lease")
+	}
+	if acquired {
+		return true, nil
+	}
+
+	renewed, err := renewScript.Run(ctx, b.client, []string{key}, owner, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to renew redis lease")
+	}
+
+	return renewed == 1, nil
+}
+
+// Release releases a lease held by the owner.
+func (b *RedisBackend) Release(name, owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	err := releaseScript.Run(ctx, b.client, []string{redisKeyPrefix + name}, owner).Err()
+	if err != nil {
+		return errors.Wrap(err, "failed to release redis lease")
+	}
+
+	return nil
+}
+
+// Close closes the connections to the server.
+func (b *RedisBackend) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	pmodel "github.com/prometheus/common/model"
+)
+
+// Cache stores raw metrics query results keyed by query and evaluation time.
+type Cache interface {
+	Get(key string) (pmodel.Vector, bool)
+	Set(key string, value pmodel.Vector) error
+	TTL() time.Duration
+}
+
+func cacheKey(query string, queryTime time.Time) string {
+	return fmt.Sprintf("%s@%d", query, queryTime.Unix())
+}
+
+type memoryCacheEntry struct {
+	value     pmodel.Vector
+	expiresAt time.Time
+}
+
+// MemoryCache is an in-memory metrics cache intended for long-running
+// processes.
+type MemoryCache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+// NewMemoryCache returns a new in-memory metrics cache.
+func NewMemoryCache(ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		ttl:     ttl,
+		entries: make(map[string]memoryCacheEntry),
+	}
+}
+
+// Get returns the cached value for a key if it exists and has not expired.
+func (c *MemoryCache) Get(key string) (pmodel.Vector, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+// Set stores a value in the cache.
+func (c *MemoryCache) Set(key string, value pmodel.Vector) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[key] = memoryCacheEntry{
+		value:     value,
+		expiresAt: time.Now().Add(c.ttl),
+	}
+
+	return nil
+}
+
+// TTL returns how long cached values remain valid.
+func (c *MemoryCache) TTL() time.Duration {
+	return c.ttl
+}
+
+type fileCacheEntry struct {
+	Key       string
+	ExpiresAt time.Time
+	Value     pmodel.Vector
+}
+
+// FileCache is an on-disk metrics cache that allows results to be shared
+// between separate one-shot runs.
+type FileCache struct {
+	dir string
+	ttl time.Duration
+}
+
+// NewFileCache returns a new on-disk metrics cache stored in the provided
+// directory.
+func NewFileCache(dir string, ttl time.Duration) (*FileCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create metrics cache directory")
+	}
+
+	return &FileCache{dir: dir, ttl: ttl}, nil
+}
+
+func (c *FileCache) path(key string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
+
+// Get returns the cached value for a key if it exists and has not expired.
+// Unreadable or expired entries are treated as misses.
+func (c *FileCache) Get(key string) (pmodel.Vector, bool) {
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry fileCacheEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil || entry.Key != key {
+		return nil, false
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		os.Remove(c.path(key))
+		return nil, false
+	}
+
+	return entry.Value, true
+}
+
+// Set stores a value in the cache.
+func (c *FileCache) Set(key string, value pmodel.Vector) error {
+	data, err := json.Marshal(&fileCacheEntry{
+		Key:       key,
+		ExpiresAt: time.Now().Add(c.ttl),
+		Value:     value,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal cache entry")
+	}
+
+	// Write to a temporary file first so that concurrent runs never read a
+	// partially written entry.
+	tmp, err := ioutil.TempFile(c.dir, "entry-*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create cache entry file")
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to write cache entry")
+	}
+
+	err = os.Rename(tmp.Name(), c.path(key))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to save cache entry")
+	}
+
+	return nil
+}
+
+// TTL returns how long cached values remain valid.
+func (c *FileCache) TTL() time.Duration {
+	return c.ttl
+}
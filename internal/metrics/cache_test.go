@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fileCache, err := NewFileCache(dir, time.Minute)
+	require.NoError(t, err)
+
+	caches := map[string]Cache{
+		"memory": NewMemoryCache(time.Minute),
+		"file":   fileCache,
+	}
+
+	value := pmodel.Vector{{
+		Metric: pmodel.Metric{"installationId": "abc"},
+		Value:  12,
+	}}
+	queryTime := time.Unix(1600000000, 0)
+
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			_, ok := cache.Get(cacheKey("query", queryTime))
+			assert.False(t, ok)
+
+			require.NoError(t, cache.Set(cacheKey("query", queryTime), value))
+
+			cached, ok := cache.Get(cacheKey("query", queryTime))
+			require.True(t, ok)
+			require.Len(t, cached, 1)
+			assert.Equal(t, pmodel.LabelValue("abc"), cached[0].Metric["installationId"])
+			assert.Equal(t, pmodel.SampleValue(12), cached[0].Value)
+
+			_, ok = cache.Get(cacheKey("query", queryTime.Add(time.Second)))
+			assert.False(t, ok)
+			_, ok = cache.Get(cacheKey("other-query", queryTime))
+			assert.False(t, ok)
+		})
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		cache := NewMemoryCache(-time.Second)
+		require.NoError(t, cache.Set("key", value))
+		_, ok := cache.Get("key")
+		assert.False(t, ok)
+
+		expiredFileCache, err := NewFileCache(dir, -time.Second)
+		require.NoError(t, err)
+		require.NoError(t, expiredFileCache.Set("key", value))
+		_, ok = expiredFileCache.Get("key")
+		assert.False(t, ok)
+	})
+}
+
+func TestCachedCurrentQueries(t *testing.T) {
+	var queryTimes []float64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		queryTime, err := strconv.ParseFloat(r.Form.Get("time"), 64)
+		require.NoError(t, err)
+		queryTimes = append(queryTimes, queryTime)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"installationId":"abc"},"value":[0,"12"]}]}}`)
+	}))
+	defer server.Close()
+
+	tc := NewCachedThanosClient(server.URL, NewMemoryCache(time.Hour))
+
+	before := time.Now()
+	userCounts, err := tc.GetInstallationUserMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"abc": 12}, userCounts)
+
+	_, err = tc.GetInstallationUserMetrics(context.Background())
+	require.NoError(t, err)
+
+	require.Len(t, queryTimes, 1)
+	assert.InDelta(t, float64(before.Unix()), queryTimes[0], 5)
+	hits, misses := tc.CacheStats()
+	assert.EqualValues(t, 1, hits)
+	assert.EqualValues(t, 1, misses)
+}
@@ -15,14 +15,14 @@ import (
 	pmodel "github.com/prometheus/common/model"
 )
 
-func queryInstallationMetrics(url, queryValue string, queryTime time.Time) (pmodel.Vector, error) {
+func queryInstallationMetrics(ctx context.Context, url, queryValue string, queryTime time.Time) (pmodel.Vector, error) {
 	client, err := api.NewClient(api.Config{Address: url})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create prometheus client")
 	}
 
 	v1api := v1.NewAPI(client)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	result, warnings, err := v1api.Query(ctx, queryValue, queryTime)
 	if err != nil {
@@ -35,14 +35,14 @@ func queryInstallationMetrics(url, queryValue string, queryTime time.Time) (pmod
 	return result.(pmodel.Vector), nil
 }
 
-func queryRangeInstallationMetrics(url, queryValue string, queryRange v1.Range) (pmodel.Matrix, error) {
+func queryRangeInstallationMetrics(ctx context.Context, url, queryValue string, queryRange v1.Range) (pmodel.Matrix, error) {
 	client, err := api.NewClient(api.Config{Address: url})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create prometheus client")
 	}
 
 	v1api := v1.NewAPI(client)
-	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 25*time.Second)
 	defer cancel()
 	result, warnings, err := v1api.QueryRange(ctx, queryValue, queryRange)
 	if err != nil {
@@ -5,7 +5,9 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,7 +16,11 @@ import (
 
 // ThanosClient is a client for working with metrics from Thanos.
 type ThanosClient struct {
-	url string
+	url   string
+	cache Cache
+
+	cacheHits   int64
+	cacheMisses int64
 }
 
 // NewThanosClient returns a new Thanos client.
@@ -22,10 +28,74 @@ func NewThanosClient(url string) *ThanosClient {
 	return &ThanosClient{url: url}
 }
 
+// NewCachedThanosClient returns a new Thanos client that stores query results
+// in the provided cache.
+func NewCachedThanosClient(url string, cache Cache) *ThanosClient {
+	return &ThanosClient{url: url, cache: cache}
+}
+
+// CacheStats returns the number of cache hits and misses seen by the client.
+func (tc *ThanosClient) CacheStats() (int64, int64) {
+	return atomic.LoadInt64(&tc.cacheHits), atomic.LoadInt64(&tc.cacheMisses)
+}
+
+// queryCurrent evaluates a query at the current time. When caching is
+// enabled, the cache key uses the current time truncated to the cache TTL so
+// that queries made close together share results while uncached queries still
+// include the newest metrics.
+func (tc *ThanosClient) queryCurrent(ctx context.Context, queryValue string) (pmodel.Vector, error) {
+	now := time.Now()
+	if tc.cache == nil {
+		return queryInstallationMetrics(ctx, tc.url, queryValue, now)
+	}
+
+	return tc.cachedQuery(ctx, queryValue, now, now.Truncate(tc.cache.TTL()))
+}
+
+func (tc *ThanosClient) query(ctx context.Context, queryValue string, queryTime time.Time) (pmodel.Vector, error) {
+	if tc.cache == nil {
+		return queryInstallationMetrics(ctx, tc.url, queryValue, queryTime)
+	}
+
+	return tc.cachedQuery(ctx, queryValue, queryTime, queryTime)
+}
+
+// cachedQuery evaluates a query at the query time and caches the result under
+// the key time.
+func (tc *ThanosClient) cachedQuery(ctx context.Context, queryValue string, queryTime, keyTime time.Time) (pmodel.Vector, error) {
+	key := cacheKey(queryValue, keyTime)
+	if result, ok := tc.cache.Get(key); ok {
+		atomic.AddInt64(&tc.cacheHits, 1)
+		return result, nil
+	}
+	atomic.AddInt64(&tc.cacheMisses, 1)
+
+	result, err := queryInstallationMetrics(ctx, tc.url, queryValue, queryTime)
+	if err != nil {
+		return nil, err
+	}
+
+	// A failure to cache shouldn't fail the query itself.
+	tc.cache.Set(key, result)
+
+	return result, nil
+}
+
 // GetInstallationUserMetrics returns a current snapshot of user metrics for
 // all installations.
-func (tc *ThanosClient) GetInstallationUserMetrics() (map[string]int64, error) {
-	rawMetrics, err := queryInstallationMetrics(tc.url, "mattermost_db_active_users", time.Now())
+func (tc *ThanosClient) GetInstallationUserMetrics(ctx context.Context) (map[string]int64, error) {
+	rawMetrics, err := tc.queryCurrent(ctx, "mattermost_db_active_users")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query thanos")
+	}
+
+	return buildFinalInstallationUserCountMetrics(rawMetrics), nil
+}
+
+// GetInstallationUserMetricsAt returns a snapshot of user metrics for all
+// installations at the given point in time.
+func (tc *ThanosClient) GetInstallationUserMetricsAt(ctx context.Context, queryTime time.Time) (map[string]int64, error) {
+	rawMetrics, err := tc.query(ctx, "mattermost_db_active_users", queryTime)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to query thanos")
 	}
@@ -35,9 +105,9 @@ func (tc *ThanosClient) GetInstallationUserMetrics() (map[string]int64, error) {
 
 // GetInstallationNewPostCount returns the number of new posts an installation
 // in the given number of days.
-func (tc *ThanosClient) GetInstallationNewPostCount(installationID string, days int) (float64, error) {
+func (tc *ThanosClient) GetInstallationNewPostCount(ctx context.Context, installationID string, days int) (float64, error) {
 	query := fmt.Sprintf("sum(increase(mattermost_post_total{installationId=\"%s\"}[%dd]))", installationID, days)
-	rawMetrics, err := queryInstallationMetrics(tc.url, query, time.Now())
+	rawMetrics, err := tc.queryCurrent(ctx, query)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to query thanos")
 	}
@@ -49,6 +119,59 @@ func (tc *ThanosClient) GetInstallationNewPostCount(installationID string, days
 	return float64(rawMetrics[0].Value), nil
 }
 
+// GetInstallationsNewPostCountsAt returns the number of new posts for all
+// installations in the given number of days before the provided point in time.
+func (tc *ThanosClient) GetInstallationsNewPostCountsAt(ctx context.Context, days int, queryTime time.Time) (map[string]float64, error) {
+	query := fmt.Sprintf("sum by (installationId) (increase(mattermost_post_total[%dd]))", days)
+	rawMetrics, err := tc.query(ctx, query, queryTime)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query thanos")
+	}
+
+	postCounts := make(map[string]float64)
+	for _, rawMetric := range rawMetrics {
+		id, ok := rawMetric.Metric["installationId"]
+		if !ok {
+			continue
+		}
+		postCounts[string(id)] = float64(rawMetric.Value)
+	}
+
+	return postCounts, nil
+}
+
+// GetInstallationHealthMetrics returns the current value of a health query for
+// all installations. Results are never cached so values taken before and after
+// an action can be compared. When an installation has multiple results, the
+// highest value is used.
+func (tc *ThanosClient) GetInstallationHealthMetrics(ctx context.Context, query string) (map[string]float64, error) {
+	return tc.GetCurrentValuesByLabel(ctx, query, "installationId")
+}
+
+// GetCurrentValuesByLabel returns the current value of a query for each value
+// of the provided label. Results are never cached. When a label value has
+// multiple results, the highest value is used.
+func (tc *ThanosClient) GetCurrentValuesByLabel(ctx context.Context, query, label string) (map[string]float64, error) {
+	rawMetrics, err := queryInstallationMetrics(ctx, tc.url, query, time.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query thanos")
+	}
+
+	values := make(map[string]float64)
+	for _, rawMetric := range rawMetrics {
+		id, ok := rawMetric.Metric[pmodel.LabelName(label)]
+		if !ok {
+			continue
+		}
+		value := float64(rawMetric.Value)
+		if original, ok := values[string(id)]; !ok || value > original {
+			values[string(id)] = value
+		}
+	}
+
+	return values, nil
+}
+
 func buildFinalInstallationUserCountMetrics(rawMetrics pmodel.Vector) map[string]int64 {
 	installationMetrics := make(map[string]int64)
 
@@ -0,0 +1,276 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy controls how delivery to a sink is retried.
+type RetryPolicy struct {
+	// Deadline is the total time allowed to deliver an event to a sink.
+	Deadline time.Duration
+	// AttemptTimeout is the time allowed for a single delivery attempt.
+	AttemptTimeout time.Duration
+	// InitialBackoff is the wait after the first failed attempt. It doubles
+	// after each failure up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy returns the default retry policy.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Deadline:       2 * time.Minute,
+		AttemptTimeout: 15 * time.Second,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// PermanentError is a delivery failure that retrying won't fix, such as a
+// webhook rejecting the request or a mail server refusing a recipient.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// deliver sends an event to a sink, retrying with backoff until it succeeds,
+// fails permanently or the policy deadline is reached.
+func deliver(ctx context.Context, notifier Notifier, event *Event, policy RetryPolicy) error {
+	ctx, cancel := context.WithTimeout(ctx, policy.Deadline)
+	defer cancel()
+
+	backoff := policy.InitialBackoff
+	for {
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, policy.AttemptTimeout)
+		err := notifier.Notify(attemptCtx, event)
+		attemptCancel()
+		if err == nil {
+			return nil
+		}
+		var permanentErr *PermanentError
+		if errors.As(err, &permanentErr) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(err, "delivery deadline reached")
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// DeadLetter is an event that could not be delivered to a sink.
+type DeadLetter struct {
+	Sink     string
+	Error    string
+	FailedAt int64
+	Event    *Event
+}
+
+// AppendDeadLetter appends an undeliverable event to the dead-letter file.
+func AppendDeadLetter(path string, letter *DeadLetter) error {
+	return withDeadLetterLock(path, func() error {
+		return appendDeadLetters(path, []*DeadLetter{letter})
+	})
+}
+
+// ReadDeadLetters returns all events in the dead-letter file. A missing file
+// contains no events.
+func ReadDeadLetters(path string) ([]*DeadLetter, error) {
+	var letters []*DeadLetter
+	err := withDeadLetterLock(path, func() error {
+		var err error
+		letters, err = readDeadLetters(path)
+		return err
+	})
+
+	return letters, err
+}
+
+// TakeDeadLetters removes all events from the dead-letter file so they can be
+// replayed while other processes keep appending to it. The taken events are
+// kept in a replay file until ReturnDeadLetters is called, and a replay that
+// was interrupted before then has its events taken again by the next one.
+func TakeDeadLetters(path string) ([]*DeadLetter, error) {
+	var letters []*DeadLetter
+	err := withDeadLetterLock(path, func() error {
+		interrupted, err := readDeadLetters(replayPath(path))
+		if err != nil {
+			return err
+		}
+		pending, err := readDeadLetters(path)
+		if err != nil {
+			return err
+		}
+		letters = append(interrupted, pending...)
+		if len(pending) == 0 {
+			return nil
+		}
+
+		err = writeDeadLetters(replayPath(path), letters)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove dead-letter file")
+		}
+
+		return nil
+	})
+
+	return letters, err
+}
+
+// ReturnDeadLetters appends the events that still couldn't be delivered after
+// a replay back to the dead-letter file and removes the replay file.
+func ReturnDeadLetters(path string, letters []*DeadLetter) error {
+	return withDeadLetterLock(path, func() error {
+		err := appendDeadLetters(path, letters)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(replayPath(path))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove dead-letter replay file")
+		}
+
+		return nil
+	})
+}
+
+// replayPath is the file holding dead letters that are being replayed.
+func replayPath(path string) string {
+	return path + ".replay"
+}
+
+// withDeadLetterLock runs fn while holding an exclusive lock on the
+// dead-letter file. The lock is taken on a separate lock file so it is held
+// across the file being replaced, and excludes other processes as well as
+// other goroutines.
+func withDeadLetterLock(path string, fn func() error) error {
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open dead-letter lock file")
+	}
+	defer file.Close()
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return errors.Wrap(err, "failed to lock dead-letter file")
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+func appendDeadLetters(path string, letters []*DeadLetter) error {
+	if len(letters) == 0 {
+		return nil
+	}
+	data, err := marshalDeadLetters(letters)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open dead-letter file")
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	if err != nil {
+		return errors.Wrap(err, "failed to write dead letter")
+	}
+
+	return nil
+}
+
+func writeDeadLetters(path string, letters []*DeadLetter) error {
+	data, err := marshalDeadLetters(letters)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to write dead-letter file")
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func marshalDeadLetters(letters []*DeadLetter) ([]byte, error) {
+	var data []byte
+	for _, letter := range letters {
+		line, err := json.Marshal(letter)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal dead letter")
+		}
+		data = append(data, append(line, '\n')...)
+	}
+
+	return data, nil
+}
+
+func readDeadLetters(path string) ([]*DeadLetter, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open dead-letter file")
+	}
+	defer file.Close()
+
+	var letters []*DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		err = json.Unmarshal(scanner.Bytes(), &letter)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse dead letter")
+		}
+		letters = append(letters, &letter)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read dead-letter file")
+	}
+
+	return letters, nil
+}
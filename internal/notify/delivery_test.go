@@ -0,0 +1,157 @@
+package notify
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delivery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var requests, failUntil int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= atomic.LoadInt32(&failUntil) {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	deadLetterFile := filepath.Join(dir, "dead-letters.jsonl")
+	router, err := NewRouter(&Config{
+		Sinks:  []SinkConfig{{Name: "partners", Type: "json-webhook", URL: server.URL}},
+		Routes: map[EventType][]string{EventRunSummary: {"partners"}},
+	})
+	require.NoError(t, err)
+	router.SetRetryPolicy(RetryPolicy{
+		Deadline:       200 * time.Millisecond,
+		AttemptTimeout: 100 * time.Millisecond,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+	})
+	router.SetDeadLetterFile(deadLetterFile)
+
+	event := &Event{Type: EventRunSummary, RunID: "run1", Text: "summary"}
+
+	t.Run("retries until delivered", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&failUntil, 2)
+		require.NoError(t, router.Notify(context.Background(), event))
+		assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+		letters, err := ReadDeadLetters(deadLetterFile)
+		require.NoError(t, err)
+		assert.Empty(t, letters)
+	})
+
+	t.Run("dead letter after deadline", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&failUntil, 1000)
+		require.Error(t, router.Notify(context.Background(), event))
+		assert.True(t, atomic.LoadInt32(&requests) > 1)
+
+		letters, err := ReadDeadLetters(deadLetterFile)
+		require.NoError(t, err)
+		require.Len(t, letters, 1)
+		assert.Equal(t, "partners", letters[0].Sink)
+		assert.Equal(t, "run1", letters[0].Event.RunID)
+	})
+
+	t.Run("replay still failing", func(t *testing.T) {
+		letters, err := ReadDeadLetters(deadLetterFile)
+		require.NoError(t, err)
+
+		remaining, err := router.Replay(context.Background(), letters)
+		require.Error(t, err)
+		assert.Len(t, remaining, 1)
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&failUntil, 0)
+		require.NoError(t, AppendDeadLetter(deadLetterFile, &DeadLetter{Sink: "removed", Event: event}))
+		letters, err := TakeDeadLetters(deadLetterFile)
+		require.NoError(t, err)
+		require.Len(t, letters, 2)
+
+		// Letters appended during the replay are kept.
+		require.NoError(t, AppendDeadLetter(deadLetterFile, &DeadLetter{Sink: "partners", Event: event}))
+
+		remaining, err := router.Replay(context.Background(), letters)
+		require.Error(t, err)
+		require.Len(t, remaining, 1)
+		assert.Equal(t, "removed", remaining[0].Sink)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+		require.NoError(t, ReturnDeadLetters(deadLetterFile, remaining))
+		letters, err = ReadDeadLetters(deadLetterFile)
+		require.NoError(t, err)
+		require.Len(t, letters, 2)
+		assert.Equal(t, "partners", letters[0].Sink)
+		assert.Equal(t, "removed", letters[1].Sink)
+		_, err = os.Stat(deadLetterFile + ".replay")
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("interrupted replay", func(t *testing.T) {
+		letters, err := TakeDeadLetters(deadLetterFile)
+		require.NoError(t, err)
+		require.Len(t, letters, 2)
+
+		letters, err = TakeDeadLetters(deadLetterFile)
+		require.NoError(t, err)
+		assert.Len(t, letters, 2)
+
+		require.NoError(t, ReturnDeadLetters(deadLetterFile, nil))
+		letters, err = TakeDeadLetters(deadLetterFile)
+		require.NoError(t, err)
+		assert.Empty(t, letters)
+	})
+}
+
+func TestDeliverPermanentFailure(t *testing.T) {
+	var requests int32
+	status := http.StatusBadRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	policy := RetryPolicy{
+		Deadline:       time.Minute,
+		AttemptTimeout: time.Second,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	}
+	event := &Event{Type: EventRunSummary, RunID: "run1", Text: "summary"}
+
+	t.Run("client error", func(t *testing.T) {
+		err := deliver(context.Background(), &JSONWebhookNotifier{URL: server.URL}, event, policy)
+		require.Error(t, err)
+		assert.IsType(t, &PermanentError{}, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("rate limited is retried", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+		status = http.StatusTooManyRequests
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err := deliver(ctx, &JSONWebhookNotifier{URL: server.URL}, event, policy)
+		require.Error(t, err)
+		assert.True(t, atomic.LoadInt32(&requests) > 1)
+	})
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package notify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ory/viper"
+	"github.com/pkg/errors"
+)
+
+// EventType is the type of a notification event.
+type EventType string
+
+const (
+	// EventRunSummary is sent when a run completes.
+	EventRunSummary EventType = "run-summary"
+	// EventError is sent when a run fails.
+	EventError EventType = "error"
+	// EventAbort is sent when a run halts early because a safety limit such
+	// as a deadline or failure threshold was reached.
+	EventAbort EventType = "abort"
+	// EventEscalation is sent when installations need attention that the
+	// fleet controller can't remediate itself.
+	EventEscalation EventType = "escalation"
+)
+
+// Event is a notification sent to one or more sinks.
+type Event struct {
+	Type      EventType   `json:"type"`
+	RunID     string      `json:"runID"`
+	Title     string      `json:"title"`
+	Text      string      `json:"text"`
+	Data      interface{} `json:"data,omitempty"`
+	Timestamp int64       `json:"timestamp"`
+}
+
+// Notifier sends events to a notification sink.
+type Notifier interface {
+	Notify(ctx context.Context, event *Event) error
+}
+
+// SinkConfig is the configuration of a single notification sink. Only the
+// values relevant to the sink type need to be set.
+type SinkConfig struct {
+	Name string `mapstructure:"name"`
+	Type string `mapstructure:"type"`
+
+	// Webhook sinks
+	URL      string `mapstructure:"url"`
+	Username string `mapstructure:"username"`
+	IconURL  string `mapstructure:"iconURL"`
+	Channel  string `mapstructure:"channel"`
+	Secret   string `mapstructure:"secret"`
+
+	// SMTP sinks
+	Host     string   `mapstructure:"host"`
+	Port     int      `mapstructure:"port"`
+	Password string   `mapstructure:"password"`
+	From     string   `mapstructure:"from"`
+	To       []string `mapstructure:"to"`
+
+	// File sinks
+	Path string `mapstructure:"path"`
+}
+
+// Config is the configuration of all notification sinks and the sinks each
+// event type is routed to.
+type Config struct {
+	Sinks  []SinkConfig           `mapstructure:"sinks"`
+	Routes map[EventType][]string `mapstructure:"routes"`
+}
+
+// LoadConfig reads a notification config from a JSON or YAML file.
+func LoadConfig(filename string) (*Config, error) {
+	v := viper.New()
+	v.SetConfigFile(filename)
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read notification config")
+	}
+
+	var config Config
+	err = v.Unmarshal(&config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse notification config")
+	}
+
+	return &config, nil
+}
+
+// DefaultUsername is the username used by chat sinks without one configured.
+const DefaultUsername = "Fleet Controller"
+
+// NewNotifier returns the notifier for a sink config.
+func NewNotifier(config SinkConfig) (Notifier, error) {
+	if len(config.Username) == 0 {
+		config.Username = DefaultUsername
+	}
+
+	switch config.Type {
+	case "mattermost":
+		if len(config.URL) == 0 {
+			return nil, errors.New("mattermost sink requires a url")
+		}
+		return &MattermostNotifier{URL: config.URL, Username: config.Username, IconURL: config.IconURL, Channel: config.Channel}, nil
+	case "slack":
+		if len(config.URL) == 0 {
+			return nil, errors.New("slack sink requires a url")
+		}
+		return &SlackNotifier{URL: config.URL, Username: config.Username, IconURL: config.IconURL, Channel: config.Channel}, nil
+	case "json-webhook":
+		if len(config.URL) == 0 {
+			return nil, errors.New("json-webhook sink requires a url")
+		}
+		return &JSONWebhookNotifier{URL: config.URL, Secret: config.Secret}, nil
+	case "smtp":
+		if len(config.Host) == 0 || len(config.From) == 0 || len(config.To) == 0 {
+			return nil, errors.New("smtp sink requires a host, from and to values")
+		}
+		return &SMTPNotifier{Host: config.Host, Port: config.Port, Username: config.Username, Password: config.Password, From: config.From, To: config.To}, nil
+	case "file":
+		if len(config.Path) == 0 {
+			return nil, errors.New("file sink requires a path")
+		}
+		return &FileNotifier{Path: config.Path}, nil
+	default:
+		return nil, errors.Errorf("unknown sink type %q", config.Type)
+	}
+}
+
+// Router sends events to the sinks configured for their event type. Delivery
+// to each sink is retried and events that still can't be delivered are
+// written to the dead-letter file when one is set.
+type Router struct {
+	sinks          map[string]Notifier
+	routes         map[EventType][]string
+	retryPolicy    RetryPolicy
+	deadLetterFile string
+}
+
+// NewRouter returns a router for the provided config.
+func NewRouter(config *Config) (*Router, error) {
+	router := &Router{
+		sinks:       make(map[string]Notifier),
+		routes:      config.Routes,
+		retryPolicy: DefaultRetryPolicy(),
+	}
+
+	for _, sinkConfig := range config.Sinks {
+		if len(sinkConfig.Name) == 0 {
+			return nil, errors.New("all sinks require a name")
+		}
+		if _, ok := router.sinks[sinkConfig.Name]; ok {
+			return nil, errors.Errorf("duplicate sink name %s", sinkConfig.Name)
+		}
+		notifier, err := NewNotifier(sinkConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid sink %s", sinkConfig.Name)
+		}
+		router.sinks[sinkConfig.Name] = notifier
+	}
+
+	for eventType, names := range config.Routes {
+		for _, name := range names {
+			if _, ok := router.sinks[name]; !ok {
+				return nil, errors.Errorf("%s events are routed to unknown sink %s", eventType, name)
+			}
+		}
+	}
+
+	return router, nil
+}
+
+// AddSink adds a sink to the router and routes the provided event types to it.
+func (r *Router) AddSink(name string, notifier Notifier, eventTypes ...EventType) {
+	r.sinks[name] = notifier
+	if r.routes == nil {
+		r.routes = make(map[EventType][]string)
+	}
+	for _, eventType := range eventTypes {
+		r.routes[eventType] = append(r.routes[eventType], name)
+	}
+}
+
+// SetRetryPolicy sets the policy used when delivering to sinks.
+func (r *Router) SetRetryPolicy(policy RetryPolicy) {
+	r.retryPolicy = policy
+}
+
+// SetDeadLetterFile sets the file that undeliverable events are written to.
+func (r *Router) SetDeadLetterFile(path string) {
+	r.deadLetterFile = path
+}
+
+// HasRoutes returns whether any sinks are routed for the event type.
+func (r *Router) HasRoutes(eventType EventType) bool {
+	return len(r.routes[eventType]) != 0
+}
+
+// Notify sends the event to every sink routed for its type. Every sink is
+// attempted even if an earlier sink fails.
+func (r *Router) Notify(ctx context.Context, event *Event) error {
+	var failures []string
+	for _, name := range r.routes[event.Type] {
+		err := deliver(ctx, r.sinks[name], event, r.retryPolicy)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+			if len(r.deadLetterFile) != 0 {
+				deadLetterErr := AppendDeadLetter(r.deadLetterFile, &DeadLetter{
+					Sink:     name,
+					Error:    err.Error(),
+					FailedAt: time.Now().UnixNano() / int64(time.Millisecond),
+					Event:    event,
+				})
+				if deadLetterErr != nil {
+					failures = append(failures, deadLetterErr.Error())
+				}
+			}
+		}
+	}
+
+	if len(failures) != 0 {
+		return errors.Errorf("failed to notify sinks (%s)", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// Replay attempts to deliver dead letters to their original sinks. Letters
+// that still can't be delivered are returned.
+func (r *Router) Replay(ctx context.Context, letters []*DeadLetter) ([]*DeadLetter, error) {
+	var remaining []*DeadLetter
+	var failures []string
+	for _, letter := range letters {
+		notifier, ok := r.sinks[letter.Sink]
+		if !ok {
+			remaining = append(remaining, letter)
+			failures = append(failures, fmt.Sprintf("%s: sink is not configured", letter.Sink))
+			continue
+		}
+
+		err := deliver(ctx, notifier, letter.Event, r.retryPolicy)
+		if err != nil {
+			letter.Error = err.Error()
+			letter.FailedAt = time.Now().UnixNano() / int64(time.Millisecond)
+			remaining = append(remaining, letter)
+			failures = append(failures, fmt.Sprintf("%s: %s", letter.Sink, err.Error()))
+		}
+	}
+
+	if len(failures) != 0 {
+		return remaining, errors.Errorf("failed to replay %d notifications (%s)", len(remaining), strings.Join(failures, "; "))
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,157 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var received []*Event
+	var signatures []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var event Event
+		json.Unmarshal(body, &event)
+		received = append(received, &event)
+		signatures = append(signatures, r.Header.Get(SignatureHeader))
+		assert.Equal(t, Sign("secret", body), r.Header.Get(SignatureHeader))
+	}))
+	defer server.Close()
+
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	configPath := filepath.Join(dir, "notifications.yaml")
+	config := `
+sinks:
+  - name: partners
+    type: json-webhook
+    url: ` + server.URL + `
+    secret: secret
+  - name: audit
+    type: file
+    path: ` + auditPath + `
+routes:
+  run-summary: [partners, audit]
+  error: [audit]
+`
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(config), 0644))
+
+	loaded, err := LoadConfig(configPath)
+	require.NoError(t, err)
+	router, err := NewRouter(loaded)
+	require.NoError(t, err)
+
+	assert.True(t, router.HasRoutes(EventRunSummary))
+	assert.True(t, router.HasRoutes(EventError))
+	assert.False(t, router.HasRoutes(EventAbort))
+
+	require.NoError(t, router.Notify(context.Background(), &Event{Type: EventRunSummary, RunID: "run1", Text: "summary"}))
+	require.NoError(t, router.Notify(context.Background(), &Event{Type: EventError, RunID: "run1", Text: "error"}))
+	require.NoError(t, router.Notify(context.Background(), &Event{Type: EventAbort, RunID: "run1", Text: "abort"}))
+
+	require.Len(t, received, 1)
+	assert.Equal(t, EventRunSummary, received[0].Type)
+	assert.Equal(t, "summary", received[0].Text)
+	assert.True(t, strings.HasPrefix(signatures[0], "sha256="))
+
+	audit, err := ioutil.ReadFile(auditPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(audit)), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"type":"run-summary"`)
+	assert.Contains(t, lines[1], `"type":"error"`)
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Config      *Config
+	}{
+		{
+			"unknown sink type",
+			&Config{Sinks: []SinkConfig{{Name: "a", Type: "pager"}}},
+		},
+		{
+			"missing name",
+			&Config{Sinks: []SinkConfig{{Type: "file", Path: "a"}}},
+		},
+		{
+			"duplicate name",
+			&Config{Sinks: []SinkConfig{{Name: "a", Type: "file", Path: "a"}, {Name: "a", Type: "file", Path: "b"}}},
+		},
+		{
+			"missing url",
+			&Config{Sinks: []SinkConfig{{Name: "a", Type: "mattermost"}}},
+		},
+		{
+			"route to unknown sink",
+			&Config{Routes: map[EventType][]string{EventError: {"a"}}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Description, func(t *testing.T) {
+			_, err := NewRouter(testCase.Config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestToSlackMarkdown(t *testing.T) {
+	assert.Equal(t, "*Hibernation Report*\n\nRun ID: `abc`\n*Results*", toSlackMarkdown("### Hibernation Report\n\nRun ID: `abc`\n#### Results"))
+}
+
+func TestSMTPNotifierHonoursContext(t *testing.T) {
+	// A mail server that accepts connections but never greets the client.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	notifier := &SMTPNotifier{Host: "127.0.0.1", Port: addr.Port, From: "fleet@example.com", To: []string{"ops@example.com"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = notifier.Notify(ctx, &Event{Type: EventError, Title: "title", Text: "text"})
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestEmailMessage(t *testing.T) {
+	date := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	message := string(emailMessage("fleet@example.com", []string{"a@example.com", "b@example.com"}, "Réveil run", "text", date))
+
+	assert.Contains(t, message, "To: a@example.com, b@example.com\r\n")
+	assert.Contains(t, message, "Date: Tue, 01 Jun 2021 12:00:00 +0000\r\n")
+	assert.Contains(t, message, "MIME-Version: 1.0\r\n")
+	assert.Contains(t, message, "Subject: =?utf-8?q?R=C3=A9veil_run?=\r\n")
+	assert.True(t, strings.HasSuffix(message, "\r\n\r\ntext"))
+
+	message = string(emailMessage("fleet@example.com", []string{"a@example.com"}, "Scaling Report", "text", date))
+	assert.Contains(t, message, "Subject: Scaling Report\r\n")
+}
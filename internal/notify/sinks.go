@@ -0,0 +1,288 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/fleet-controller/internal/webhook"
+)
+
+// SignatureHeader is the header containing the HMAC-SHA256 signature of JSON
+// webhook bodies.
+const SignatureHeader = "X-Fleet-Controller-Signature"
+
+// MattermostNotifier posts events to a Mattermost incoming webhook.
+type MattermostNotifier struct {
+	URL      string
+	Username string
+	IconURL  string
+	Channel  string
+}
+
+// Notify sends the event text to Mattermost.
+func (n *MattermostNotifier) Notify(ctx context.Context, event *Event) error {
+	return webhookError(webhook.Send(ctx, n.URL, &webhook.Payload{
+		Username: n.Username,
+		IconURL:  n.IconURL,
+		Channel:  n.Channel,
+		Text:     event.Text,
+	}))
+}
+
+type slackPayload struct {
+	Username string `json:"username,omitempty"`
+	IconURL  string `json:"icon_url,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+	Text     string `json:"text"`
+	Mrkdwn   bool   `json:"mrkdwn"`
+}
+
+// SlackNotifier posts events to a Slack-compatible incoming webhook.
+type SlackNotifier struct {
+	URL      string
+	Username string
+	IconURL  string
+	Channel  string
+}
+
+// Notify sends the event text to Slack.
+func (n *SlackNotifier) Notify(ctx context.Context, event *Event) error {
+	body, err := json.Marshal(&slackPayload{
+		Username: n.Username,
+		IconURL:  n.IconURL,
+		Channel:  n.Channel,
+		Text:     toSlackMarkdown(event.Text),
+		Mrkdwn:   true,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal slack payload")
+	}
+
+	return webhookError(webhook.Post(ctx, n.URL, body, nil))
+}
+
+// toSlackMarkdown converts markdown headers, which Slack doesn't render, to
+// bold text.
+func toSlackMarkdown(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			lines[i] = fmt.Sprintf("*%s*", strings.TrimSpace(strings.TrimLeft(line, "#")))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// JSONWebhookNotifier posts the full event as JSON. When a secret is set, the
+// body is signed with HMAC-SHA256 and the signature sent in SignatureHeader.
+type JSONWebhookNotifier struct {
+	URL    string
+	Secret string
+}
+
+// Notify sends the event to the JSON webhook.
+func (n *JSONWebhookNotifier) Notify(ctx context.Context, event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+
+	var headers map[string]string
+	if len(n.Secret) != 0 {
+		headers = map[string]string{SignatureHeader: Sign(n.Secret, body)}
+	}
+
+	return webhookError(webhook.Post(ctx, n.URL, body, headers))
+}
+
+// webhookError marks client errors as permanent. Timeouts and rate limiting
+// are worth retrying; any other 4xx means the request itself was rejected.
+func webhookError(err error) error {
+	var statusErr *webhook.StatusError
+	if !errors.As(err, &statusErr) {
+		return err
+	}
+	if statusErr.StatusCode < 400 || statusErr.StatusCode > 499 ||
+		statusErr.StatusCode == http.StatusRequestTimeout ||
+		statusErr.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+
+	return &PermanentError{Err: err}
+}
+
+// Sign returns the signature of a body for the provided secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SMTPNotifier emails events.
+type SMTPNotifier struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// Notify emails the event text.
+func (n *SMTPNotifier) Notify(ctx context.Context, event *Event) error {
+	port := n.Port
+	if port == 0 {
+		port = 25
+	}
+
+	var auth smtp.Auth
+	if len(n.Username) != 0 {
+		auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+	}
+
+	message := emailMessage(n.From, n.To, event.Title, event.Text, time.Now())
+
+	err := sendMail(ctx, n.Host, port, auth, n.From, n.To, message)
+	if err != nil {
+		// A 5xx reply is a permanent rejection, such as an unknown recipient.
+		var replyErr *textproto.Error
+		if errors.As(err, &replyErr) && replyErr.Code >= 500 {
+			return &PermanentError{Err: errors.Wrap(err, "failed to send email")}
+		}
+		return errors.Wrap(err, "failed to send email")
+	}
+
+	return nil
+}
+
+// emailMessage returns a plain text email. The subject is encoded so titles
+// with non-ASCII characters don't corrupt the header.
+func emailMessage(from string, to []string, subject, text string, date time.Time) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nDate: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		from, strings.Join(to, ", "), date.Format(time.RFC1123Z), mime.QEncoding.Encode("utf-8", subject), text))
+}
+
+// sendMail is smtp.SendMail with the connection bound to the context so a
+// slow or unresponsive mail server can't block delivery past its deadline.
+func sendMail(ctx context.Context, host string, port int, auth smtp.Auth, from string, to []string, message []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp server doesn't support AUTH")
+		}
+		err = client.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		err = client.Rcpt(recipient)
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(message)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// FileNotifier appends events as JSON lines to a file.
+type FileNotifier struct {
+	Path string
+	lock sync.Mutex
+}
+
+// Notify appends the event to the file.
+func (n *FileNotifier) Notify(ctx context.Context, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	file, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open notification file")
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		return errors.Wrap(err, "failed to write notification")
+	}
+
+	return nil
+}
@@ -0,0 +1,340 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+package selector
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOperator
+	tokenOpen
+	tokenClose
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// isKeyword returns whether the token is the provided unquoted keyword.
+func (t token) isKeyword(keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+func isSpecial(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("(),=!<>~\"'", r)
+}
+
+func tokenize(expression string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenOpen, "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenClose, ")"})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokenComma, ","})
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.New("unterminated quoted value")
+			}
+			tokens = append(tokens, token{tokenString, string(runes[i+1 : end])})
+			i = end + 1
+		case strings.ContainsRune("=!<>~", r):
+			operator, width := string(r), 1
+			if i+1 < len(runes) && runes[i+1] == '=' && r != '~' {
+				operator, width = operator+"=", 2
+			}
+			switch operator {
+			case "!":
+				return nil, errors.New("unexpected \"!\"; use != or not")
+			case "==":
+				operator = "="
+			}
+			tokens = append(tokens, token{tokenOperator, operator})
+			i += width
+		default:
+			end := i
+			for end < len(runes) && !isSpecial(runes[end]) {
+				end++
+			}
+			tokens = append(tokens, token{tokenWord, string(runes[i:end])})
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() (token, error) {
+	if p.done() {
+		return token{}, errors.New("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for !p.done() && p.peek().isKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for !p.done() && p.peek().isKeyword("and") {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if !p.done() && p.peek().isKeyword("not") {
+		p.pos++
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind == tokenOpen {
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		t, err = p.next()
+		if err != nil {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		if t.kind != tokenClose {
+			return nil, errors.Errorf("expected \")\" but found %q", t.text)
+		}
+		return n, nil
+	}
+	if t.kind != tokenWord {
+		return nil, errors.Errorf("expected a field but found %q", t.text)
+	}
+
+	return p.parseComparison(t.text)
+}
+
+func (p *parser) parseComparison(name string) (node, error) {
+	f, ok := fields[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.Errorf("unknown field %q; expected one of %s", name, strings.Join(Fields(), ", "))
+	}
+
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	negate := false
+	if t.isKeyword("not") {
+		negate = true
+		t, err = p.next()
+		if err != nil {
+			return nil, err
+		}
+		if !t.isKeyword("in") {
+			return nil, errors.Errorf("expected \"in\" after \"not\" but found %q", t.text)
+		}
+	}
+
+	comparison := &comparisonNode{field: f}
+	switch {
+	case t.isKeyword("in"):
+		comparison.operator = "in"
+		comparison.values, err = p.parseList(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "field %s", name)
+		}
+	case t.kind == tokenOperator:
+		comparison.operator = t.text
+		value, err := p.parseValueToken()
+		if err != nil {
+			return nil, err
+		}
+		err = comparison.setValue(f, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "field %s", name)
+		}
+	default:
+		return nil, errors.Errorf("expected an operator after %s but found %q", name, t.text)
+	}
+
+	if negate {
+		return &notNode{comparison}, nil
+	}
+
+	return comparison, nil
+}
+
+func (p *parser) parseValueToken() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if t.kind != tokenWord && t.kind != tokenString {
+		return "", errors.Errorf("expected a value but found %q", t.text)
+	}
+
+	return t.text, nil
+}
+
+func (p *parser) parseList(f field) ([]interface{}, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind != tokenOpen {
+		return nil, errors.Errorf("expected \"(\" but found %q", t.text)
+	}
+
+	var values []interface{}
+	for {
+		raw, err := p.parseValueToken()
+		if err != nil {
+			return nil, err
+		}
+		value, err := parseValue(f, raw)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		t, err = p.next()
+		if err != nil {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		if t.kind == tokenClose {
+			return values, nil
+		}
+		if t.kind != tokenComma {
+			return nil, errors.Errorf("expected \",\" or \")\" but found %q", t.text)
+		}
+	}
+}
+
+func (n *comparisonNode) setValue(f field, raw string) error {
+	switch n.operator {
+	case "~":
+		if f.kind == kindDuration || f.kind == kindBool {
+			return errors.New("~ is only supported on text fields")
+		}
+		pattern, err := regexp.Compile(raw)
+		if err != nil {
+			return errors.Wrapf(err, "invalid pattern %q", raw)
+		}
+		n.pattern = pattern
+		return nil
+	}
+
+	value, err := parseValue(f, raw)
+	if err != nil {
+		return err
+	}
+	switch n.operator {
+	case "<", "<=", ">", ">=":
+		if f.kind != kindVersion && f.kind != kindDuration {
+			return errors.Errorf("%s is only supported on version and age fields", n.operator)
+		}
+		if v, ok := value.(*version); ok && len(v.segments) == 0 {
+			return errors.Errorf("%s requires a numeric version but found %q", n.operator, raw)
+		}
+	}
+	n.values = []interface{}{value}
+
+	return nil
+}
+
+func parseValue(f field, raw string) (interface{}, error) {
+	switch f.kind {
+	case kindVersion:
+		v, ok := parseVersion(raw)
+		if !ok {
+			// Versions that aren't numeric, such as image tags, can still be
+			// matched exactly.
+			return &version{raw: raw}, nil
+		}
+		return v, nil
+	case kindDuration:
+		return parseDuration(raw)
+	case kindBool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, errors.Errorf("invalid boolean %q", raw)
+		}
+		return value, nil
+	}
+
+	return raw, nil
+}
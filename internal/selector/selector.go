@@ -0,0 +1,357 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+//
+
+// Package selector provides an expression language for selecting
+// installations by their fields, for example:
+//
+//	size in (cloud10users,cloud100users) and version < 5.37 and age > 30d
+//
+// Comparisons can be combined with and, or, not and parentheses. Expressions
+// are evaluated client-side against installations returned by the
+// provisioning server.
+package selector
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+)
+
+// fieldKind determines which operators a field supports and how values are
+// compared.
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindVersion
+	kindDuration
+	kindBool
+	// kindList fields have several values. = and != check whether a value is
+	// one of them, in whether any listed value is and ~ whether any matches.
+	kindList
+)
+
+type field struct {
+	kind  fieldKind
+	value func(installation *cmodel.InstallationDTO, now time.Time) interface{}
+}
+
+// fields are the installation fields that can be used in expressions.
+var fields = map[string]field{
+	"id":        stringField(func(i *cmodel.InstallationDTO) string { return i.ID }),
+	"owner":     stringField(func(i *cmodel.InstallationDTO) string { return i.OwnerID }),
+	"group":     stringField(installationGroup),
+	"dns":       stringField(func(i *cmodel.InstallationDTO) string { return i.DNS }),
+	"image":     stringField(func(i *cmodel.InstallationDTO) string { return i.Image }),
+	"database":  stringField(func(i *cmodel.InstallationDTO) string { return i.Database }),
+	"filestore": stringField(func(i *cmodel.InstallationDTO) string { return i.Filestore }),
+	"license":   stringField(func(i *cmodel.InstallationDTO) string { return i.License }),
+	"size":      stringField(func(i *cmodel.InstallationDTO) string { return i.Size }),
+	"affinity":  stringField(func(i *cmodel.InstallationDTO) string { return i.Affinity }),
+	"state":     stringField(func(i *cmodel.InstallationDTO) string { return i.State }),
+	"version": {kindVersion, func(i *cmodel.InstallationDTO, now time.Time) interface{} {
+		return i.Version
+	}},
+	"crversion": {kindVersion, func(i *cmodel.InstallationDTO, now time.Time) interface{} {
+		return i.CRVersion
+	}},
+	"age": {kindDuration, func(i *cmodel.InstallationDTO, now time.Time) interface{} {
+		return now.Sub(time.Unix(0, i.CreateAt*int64(time.Millisecond)))
+	}},
+	"locked": {kindBool, func(i *cmodel.InstallationDTO, now time.Time) interface{} {
+		return i.APISecurityLock
+	}},
+	"annotation": {kindList, func(i *cmodel.InstallationDTO, now time.Time) interface{} {
+		var names []string
+		for _, annotation := range i.Annotations {
+			names = append(names, annotation.Name)
+		}
+		return names
+	}},
+}
+
+func stringField(value func(*cmodel.InstallationDTO) string) field {
+	return field{kindString, func(i *cmodel.InstallationDTO, now time.Time) interface{} {
+		return value(i)
+	}}
+}
+
+func installationGroup(installation *cmodel.InstallationDTO) string {
+	if installation.GroupID == nil {
+		return ""
+	}
+	return *installation.GroupID
+}
+
+// Fields returns the names of the fields that can be used in expressions.
+func Fields() []string {
+	return []string{"id", "owner", "group", "dns", "image", "version", "crversion", "database", "filestore", "license", "size", "affinity", "state", "age", "locked", "annotation"}
+}
+
+// Selector is a parsed selector expression. A nil selector selects every
+// installation.
+type Selector struct {
+	expression string
+	root       node
+}
+
+// Parse parses a selector expression.
+func Parse(expression string) (*Selector, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid selector")
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("invalid selector: expression is empty")
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid selector")
+	}
+	if !p.done() {
+		return nil, errors.Errorf("invalid selector: unexpected %q", p.peek().text)
+	}
+
+	return &Selector{expression: expression, root: root}, nil
+}
+
+// String returns the expression the selector was parsed from.
+func (s *Selector) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.expression
+}
+
+// Match returns whether the installation is selected.
+func (s *Selector) Match(installation *cmodel.InstallationDTO) bool {
+	return s.MatchAt(installation, time.Now())
+}
+
+// MatchAt returns whether the installation is selected with ages calculated
+// relative to the provided time.
+func (s *Selector) MatchAt(installation *cmodel.InstallationDTO, now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	return s.root.match(installation, now)
+}
+
+// Filter returns the installations that are selected.
+func (s *Selector) Filter(installations []*cmodel.InstallationDTO) []*cmodel.InstallationDTO {
+	if s == nil {
+		return installations
+	}
+	now := time.Now()
+	var selected []*cmodel.InstallationDTO
+	for _, installation := range installations {
+		if s.MatchAt(installation, now) {
+			selected = append(selected, installation)
+		}
+	}
+
+	return selected
+}
+
+type node interface {
+	match(installation *cmodel.InstallationDTO, now time.Time) bool
+}
+
+type andNode struct{ left, right node }
+
+func (n *andNode) match(installation *cmodel.InstallationDTO, now time.Time) bool {
+	return n.left.match(installation, now) && n.right.match(installation, now)
+}
+
+type orNode struct{ left, right node }
+
+func (n *orNode) match(installation *cmodel.InstallationDTO, now time.Time) bool {
+	return n.left.match(installation, now) || n.right.match(installation, now)
+}
+
+type notNode struct{ node node }
+
+func (n *notNode) match(installation *cmodel.InstallationDTO, now time.Time) bool {
+	return !n.node.match(installation, now)
+}
+
+// comparisonNode compares a field against one or more values. Values are
+// parsed according to the field kind when the expression is parsed.
+type comparisonNode struct {
+	field    field
+	operator string
+	values   []interface{}
+	pattern  *regexp.Regexp
+}
+
+func (n *comparisonNode) match(installation *cmodel.InstallationDTO, now time.Time) bool {
+	actual := n.field.value(installation, now)
+	if n.field.kind == kindList {
+		return n.matchList(actual.([]string))
+	}
+
+	switch n.operator {
+	case "in":
+		for _, value := range n.values {
+			if compare(n.field.kind, actual, value) == 0 {
+				return true
+			}
+		}
+		return false
+	case "~":
+		return n.pattern.MatchString(actual.(string))
+	}
+
+	result := compare(n.field.kind, actual, n.values[0])
+	switch n.operator {
+	case "=":
+		return result == 0
+	case "!=":
+		return result != 0
+	case "<":
+		return result == -1
+	case "<=":
+		return result == -1 || result == 0
+	case ">":
+		return result == 1
+	case ">=":
+		return result == 1 || result == 0
+	}
+
+	return false
+}
+
+func (n *comparisonNode) matchList(actual []string) bool {
+	for _, value := range actual {
+		switch n.operator {
+		case "~":
+			if n.pattern.MatchString(value) {
+				return true
+			}
+		case "=", "in", "!=":
+			for _, expected := range n.values {
+				if value == expected.(string) {
+					return n.operator != "!="
+				}
+			}
+		}
+	}
+
+	return n.operator == "!="
+}
+
+// incomparable is returned by compare when a value can't be ordered, such as
+// an installation version that isn't numeric. It never satisfies a
+// comparison other than !=.
+const incomparable = 2
+
+func compare(kind fieldKind, actual, expected interface{}) int {
+	switch kind {
+	case kindVersion:
+		expectedVersion := expected.(*version)
+		actualVersion, ok := parseVersion(actual.(string))
+		if !ok || len(expectedVersion.segments) == 0 {
+			if actual.(string) == expectedVersion.raw {
+				return 0
+			}
+			return incomparable
+		}
+		return actualVersion.compare(expectedVersion)
+	case kindDuration:
+		a, e := actual.(time.Duration), expected.(time.Duration)
+		switch {
+		case a < e:
+			return -1
+		case a > e:
+			return 1
+		}
+		return 0
+	case kindBool:
+		if actual.(bool) == expected.(bool) {
+			return 0
+		}
+		return incomparable
+	}
+
+	if actual.(string) == expected.(string) {
+		return 0
+	}
+	return incomparable
+}
+
+// version is a dotted numeric version such as 5.37.1. Pre-release and build
+// suffixes are ignored.
+type version struct {
+	raw      string
+	segments []int
+}
+
+func parseVersion(value string) (*version, bool) {
+	trimmed := strings.TrimPrefix(strings.TrimSpace(value), "v")
+	if i := strings.IndexAny(trimmed, "-+"); i != -1 {
+		trimmed = trimmed[:i]
+	}
+	if len(trimmed) == 0 {
+		return nil, false
+	}
+
+	v := &version{raw: value}
+	for _, segment := range strings.Split(trimmed, ".") {
+		number, err := strconv.Atoi(segment)
+		if err != nil || number < 0 {
+			return nil, false
+		}
+		v.segments = append(v.segments, number)
+	}
+
+	return v, true
+}
+
+func (v *version) compare(other *version) int {
+	for i := 0; i < len(v.segments) || i < len(other.segments); i++ {
+		var a, b int
+		if i < len(v.segments) {
+			a = v.segments[i]
+		}
+		if i < len(other.segments) {
+			b = other.segments[i]
+		}
+		if a < b {
+			return -1
+		}
+		if a > b {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// parseDuration parses durations such as 30d, 2w or 12h.
+func parseDuration(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if !strings.HasSuffix(value, suffix) {
+			continue
+		}
+		number, err := strconv.ParseFloat(strings.TrimSuffix(value, suffix), 64)
+		if err != nil {
+			return 0, errors.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(number * float64(unit)), nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Errorf("invalid duration %q", value)
+	}
+
+	return duration, nil
+}
@@ -0,0 +1,104 @@
+package selector
+
+import (
+	"testing"
+	"time"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelector(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	millis := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+	group := "group1"
+
+	installation := &cmodel.InstallationDTO{Installation: &cmodel.Installation{
+		ID:        "id1",
+		OwnerID:   "owner1",
+		GroupID:   &group,
+		Version:   "5.36.1",
+		Image:     "mattermost/mattermost-enterprise-edition",
+		DNS:       "test.cloud.mattermost.com",
+		Database:  "aws-multitenant-rds-postgres",
+		Size:      "cloud100users",
+		State:     cmodel.InstallationStateStable,
+		CreateAt:  millis(now.Add(-45 * 24 * time.Hour)),
+		CRVersion: "installation.mattermost.com/v1beta1",
+	}, Annotations: []*cmodel.Annotation{{Name: "tier-trial"}, {Name: "owner-sales"}}}
+
+	testCases := []struct {
+		expression string
+		match      bool
+	}{
+		{"size in (cloud10users,cloud100users) and version < 5.37 and database=aws-multitenant-rds-postgres and age > 30d", true},
+		{"size in (cloud10users, cloud1000users)", false},
+		{"size not in (cloud10users)", true},
+		{"version < 5.36", false},
+		{"version >= 5.36.1", true},
+		{"version = v5.36.1", true},
+		{"version > 5", true},
+		{"age > 7w", false},
+		{"age <= 1080h", true},
+		{"dns ~ '\\.cloud\\.mattermost\\.com$'", true},
+		{"group = group1 and owner != owner1", false},
+		{"not (state = stable) or locked = false", true},
+		{"state = hibernating or (id == id1 and locked = true)", false},
+		{"SIZE = \"cloud100users\" AND NOT age < 30d", true},
+		{"crversion = installation.mattermost.com/v1beta1", true},
+		{"annotation = tier-trial", true},
+		{"annotation != tier-trial", false},
+		{"annotation != tier-paid", true},
+		{"annotation in (tier-paid, owner-sales)", true},
+		{"annotation not in (tier-paid, owner-support)", true},
+		{"annotation ~ ^owner-", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expression, func(t *testing.T) {
+			s, err := Parse(tc.expression)
+			require.NoError(t, err)
+			assert.Equal(t, tc.match, s.MatchAt(installation, now))
+		})
+	}
+
+	t.Run("filter", func(t *testing.T) {
+		s, err := Parse("size = cloud10users")
+		require.NoError(t, err)
+		small := &cmodel.InstallationDTO{Installation: &cmodel.Installation{ID: "id2", Size: "cloud10users"}}
+		assert.Equal(t, []*cmodel.InstallationDTO{small}, s.Filter([]*cmodel.InstallationDTO{installation, small}))
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var s *Selector
+		assert.True(t, s.Match(installation))
+		assert.Len(t, s.Filter([]*cmodel.InstallationDTO{installation}), 1)
+	})
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"size",
+		"unknown = value",
+		"size < cloud10users",
+		"annotation > tier-trial",
+		"version > latest",
+		"age > thirty",
+		"locked = maybe",
+		"size in (cloud10users",
+		"size in cloud10users",
+		"(size = cloud10users",
+		"size = cloud10users and",
+		"size = cloud10users extra",
+		"size ! cloud10users",
+		"dns ~ '('",
+		"dns = 'unterminated",
+	} {
+		t.Run(expression, func(t *testing.T) {
+			_, err := Parse(expression)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxSummaryChanges and maxSummaryErrors limit how much detail is included in
+// a rendered summary to prevent message bloat.
+const (
+	maxSummaryChanges = 25
+	maxSummaryErrors  = 10
+)
+
+// RunSummary is a structured summary of a single fleet controller run.
+type RunSummary struct {
+	Title                      string
+	Action                     string
+	RunID                      string
+	Runtime                    string
+	DryRun                     bool
+	Filters                    []Field
+	Counts                     []Count
+	Changes                    []InstallationChange
+	Errors                     []string
+	EstimatedMonthlyCostChange float64
+	// Provisioners breaks down the results of runs spanning multiple
+	// provisioning servers.
+	Provisioners []ProvisionerResults
+}
+
+// ProvisionerResults are the results of a run against a single provisioning
+// server.
+type ProvisionerResults struct {
+	Name                       string
+	Counts                     []Count
+	EstimatedMonthlyCostChange float64
+}
+
+// Field is a named value included in a summary.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Count is a named count included in a summary.
+type Count struct {
+	Name  string
+	Value int
+}
+
+// InstallationChange describes a change made to a single installation.
+type InstallationChange struct {
+	InstallationID string
+	Provisioner    string `json:",omitempty"`
+	From           string
+	To             string
+}
+
+// AddFilter adds a filter value to the summary.
+func (s *RunSummary) AddFilter(name string, value interface{}) {
+	s.Filters = append(s.Filters, Field{Name: name, Value: fmt.Sprintf("%v", value)})
+}
+
+// AddCount adds a result count to the summary.
+func (s *RunSummary) AddCount(name string, value int) {
+	s.Counts = append(s.Counts, Count{Name: name, Value: value})
+}
+
+// AddChange adds an installation change to the summary.
+func (s *RunSummary) AddChange(installationID, from, to string) {
+	s.Changes = append(s.Changes, InstallationChange{InstallationID: installationID, From: from, To: to})
+}
+
+// AddError adds an error to the summary. Errors that don't relate to a single
+// installation are added with an empty installation ID.
+func (s *RunSummary) AddError(installationID string, err error) {
+	if len(installationID) == 0 {
+		s.Errors = append(s.Errors, fmt.Sprintf(" - %s", err.Error()))
+		return
+	}
+	s.Errors = append(s.Errors, fmt.Sprintf(" - `%s`: %s", installationID, err.Error()))
+}
+
+// Merge adds the results of a run against a single provisioning server to a
+// combined summary. Counts with the same name are summed.
+func (s *RunSummary) Merge(provisioner string, other *RunSummary) {
+	if len(s.Filters) == 0 {
+		s.Filters = other.Filters
+	}
+
+	for _, count := range other.Counts {
+		merged := false
+		for i := range s.Counts {
+			if s.Counts[i].Name == count.Name {
+				s.Counts[i].Value += count.Value
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			s.Counts = append(s.Counts, count)
+		}
+	}
+
+	for _, change := range other.Changes {
+		change.Provisioner = provisioner
+		s.Changes = append(s.Changes, change)
+	}
+	for _, err := range other.Errors {
+		s.Errors = append(s.Errors, strings.Replace(err, " - ", fmt.Sprintf(" - [%s] ", provisioner), 1))
+	}
+
+	s.EstimatedMonthlyCostChange += other.EstimatedMonthlyCostChange
+	s.Provisioners = append(s.Provisioners, ProvisionerResults{
+		Name:                       provisioner,
+		Counts:                     other.Counts,
+		EstimatedMonthlyCostChange: other.EstimatedMonthlyCostChange,
+	})
+}
+
+// DisplayedChanges returns the changes to include in a rendered summary.
+func (s *RunSummary) DisplayedChanges() []InstallationChange {
+	if len(s.Changes) > maxSummaryChanges {
+		return s.Changes[0:maxSummaryChanges]
+	}
+
+	return s.Changes
+}
+
+// HiddenChangeCount returns the number of changes left out of a rendered
+// summary.
+func (s *RunSummary) HiddenChangeCount() int {
+	if len(s.Changes) > maxSummaryChanges {
+		return len(s.Changes) - maxSummaryChanges
+	}
+
+	return 0
+}
+
+// DisplayedErrors returns the errors to include in a rendered summary.
+func (s *RunSummary) DisplayedErrors() []string {
+	if len(s.Errors) > maxSummaryErrors {
+		return append(s.Errors[0:maxSummaryErrors-1:maxSummaryErrors-1], "Review logs for additional error details")
+	}
+
+	return s.Errors
+}
+
+// FormatCost returns a cost formatted in dollars.
+func FormatCost(cost float64) string {
+	if cost < 0 {
+		return fmt.Sprintf("-$%.2f", -cost)
+	}
+
+	return fmt.Sprintf("$%.2f", cost)
+}
@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRunSummaryTemplate is the built-in template used to render run
+// summaries.
+const DefaultRunSummaryTemplate = `### {{.Title}}
+
+Run ID: {{inlineCode .RunID}}
+Runtime: {{.Runtime}}
+{{- if .DryRun}}
+Dry Run: true
+{{- end}}
+{{- if .Filters}}
+Filters:
+{{- range .Filters}}
+ - {{.Name}}: {{inlineCode .Value}}
+{{- end}}
+{{- end}}
+
+#### Results
+| Type | Count |
+| -- | -- |
+{{- range .Counts}}
+| {{.Name}} | {{.Value}} |
+{{- end}}
+{{- if lt .EstimatedMonthlyCostChange 0.0}}
+
+Estimated Monthly Savings: {{cost (abs .EstimatedMonthlyCostChange)}}
+{{- else if gt .EstimatedMonthlyCostChange 0.0}}
+
+Estimated Monthly Cost Increase: {{cost .EstimatedMonthlyCostChange}}
+{{- end}}
+{{- if .Provisioners}}
+
+#### Provisioners
+| Provisioner | Type | Count |
+| -- | -- | -- |
+{{- range .Provisioners}}
+{{- $name := .Name}}
+{{- range .Counts}}
+| {{$name}} | {{.Name}} | {{.Value}} |
+{{- end}}
+{{- end}}
+{{- end}}
+{{- if .Changes}}
+
+#### Changes
+| Installation | From | To |
+| -- | -- | -- |
+{{- range .DisplayedChanges}}
+| {{inlineCode .InstallationID}}{{if .Provisioner}} ({{.Provisioner}}){{end}} | {{.From}} | {{.To}} |
+{{- end}}
+{{- if .HiddenChangeCount}}
+
+{{.HiddenChangeCount}} additional changes not shown
+{{- end}}
+{{- end}}
+{{- if .Errors}}
+
+#### Errors
+{{- range .DisplayedErrors}}
+{{.}}
+{{- end}}
+{{- end}}
+`
+
+// DefaultErrorTemplate is the built-in template used to render errors.
+const DefaultErrorTemplate = `### Fleet Controller Encountered an Error
+
+Run ID: {{inlineCode .RunID}}
+
+Error: {{codeBlock .Error}}
+`
+
+// ErrorReport contains the details of a failed run.
+type ErrorReport struct {
+	RunID string
+	Error string
+}
+
+var templateFuncs = template.FuncMap{
+	"inlineCode": func(s string) string { return fmt.Sprintf("`%s`", s) },
+	"codeBlock":  func(s string) string { return fmt.Sprintf("\n```\n%s\n```\n", s) },
+	"cost":       FormatCost,
+	"abs":        math.Abs,
+}
+
+// Renderer renders webhook messages from templates.
+type Renderer struct {
+	runSummary *template.Template
+	error      *template.Template
+}
+
+// NewRenderer returns a renderer using the templates in the provided files.
+// The built-in templates are used for any empty filename.
+func NewRenderer(runSummaryFile, errorFile string) (*Renderer, error) {
+	runSummary, err := loadTemplate("run-summary", runSummaryFile, DefaultRunSummaryTemplate)
+	if err != nil {
+		return nil, err
+	}
+	errorTemplate, err := loadTemplate("error", errorFile, DefaultErrorTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Renderer{
+		runSummary: runSummary,
+		error:      errorTemplate,
+	}, nil
+}
+
+func loadTemplate(name, filename, defaultText string) (*template.Template, error) {
+	text := defaultText
+	if len(filename) != 0 {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s template", name)
+		}
+		text = string(data)
+	}
+
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s template", name)
+	}
+
+	return tmpl, nil
+}
+
+// RenderRunSummary renders a run summary message.
+func (r *Renderer) RenderRunSummary(summary *RunSummary) (string, error) {
+	return execute(r.runSummary, summary)
+}
+
+// RenderError renders an error message.
+func (r *Renderer) RenderError(report *ErrorReport) (string, error) {
+	return execute(r.error, report)
+}
+
+func execute(tmpl *template.Template, data interface{}) (string, error) {
+	var b bytes.Buffer
+	err := tmpl.Execute(&b, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to render %s template", tmpl.Name())
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderRunSummary(t *testing.T) {
+	renderer, err := NewRenderer("", "")
+	require.NoError(t, err)
+
+	summary := &RunSummary{
+		Title:   "Hibernation Report",
+		Action:  "hibernate",
+		RunID:   "run1",
+		Runtime: "5s",
+	}
+	summary.AddFilter("Days", 7)
+	summary.AddCount("Installations Hibernated", 2)
+	summary.AddChange("installation1", "stable", "hibernating")
+	summary.AddError("installation2", errors.New("no user metrics found"))
+	summary.EstimatedMonthlyCostChange = -12.5
+
+	text, err := renderer.RenderRunSummary(summary)
+	require.NoError(t, err)
+	assert.Contains(t, text, "### Hibernation Report")
+	assert.Contains(t, text, "Run ID: `run1`")
+	assert.Contains(t, text, " - Days: `7`")
+	assert.Contains(t, text, "| Installations Hibernated | 2 |")
+	assert.Contains(t, text, "| `installation1` | stable | hibernating |")
+	assert.Contains(t, text, " - `installation2`: no user metrics found")
+	assert.Contains(t, text, "Estimated Monthly Savings: $12.50")
+	assert.NotContains(t, text, "Dry Run")
+
+	t.Run("trimmed details", func(t *testing.T) {
+		for i := 0; i < 30; i++ {
+			summary.AddChange(fmt.Sprintf("change%d", i), "a", "b")
+			summary.AddError(fmt.Sprintf("error%d", i), errors.New("failed"))
+		}
+
+		text, err := renderer.RenderRunSummary(summary)
+		require.NoError(t, err)
+		assert.Contains(t, text, "6 additional changes not shown")
+		assert.Contains(t, text, "Review logs for additional error details")
+		assert.Equal(t, maxSummaryChanges, strings.Count(text, "| a | b |")+1)
+		assert.Len(t, summary.Errors, 31)
+	})
+}
+
+func TestRenderMergedRunSummary(t *testing.T) {
+	renderer, err := NewRenderer("", "")
+	require.NoError(t, err)
+
+	east := &RunSummary{}
+	east.AddCount("Installations Hibernated", 2)
+	east.AddChange("installation1", "stable", "hibernating")
+	east.AddError("installation2", errors.New("no user metrics found"))
+	east.EstimatedMonthlyCostChange = -10
+	west := &RunSummary{}
+	west.AddCount("Installations Hibernated", 1)
+	west.EstimatedMonthlyCostChange = -5
+
+	summary := &RunSummary{Title: "Hibernation Report", RunID: "run1"}
+	summary.Merge("us-east", east)
+	summary.Merge("us-west", west)
+
+	assert.Equal(t, 3, summary.Counts[0].Value)
+	assert.Equal(t, -15.0, summary.EstimatedMonthlyCostChange)
+
+	text, err := renderer.RenderRunSummary(summary)
+	require.NoError(t, err)
+	assert.Contains(t, text, "| Installations Hibernated | 3 |")
+	assert.Contains(t, text, "| us-east | Installations Hibernated | 2 |")
+	assert.Contains(t, text, "| us-west | Installations Hibernated | 1 |")
+	assert.Contains(t, text, "| `installation1` (us-east) | stable | hibernating |")
+	assert.Contains(t, text, " - [us-east] `installation2`: no user metrics found")
+}
+
+func TestRenderError(t *testing.T) {
+	renderer, err := NewRenderer("", "")
+	require.NoError(t, err)
+
+	text, err := renderer.RenderError(&ErrorReport{RunID: "run1", Error: "failed to get installations"})
+	require.NoError(t, err)
+	assert.Equal(t, "### Fleet Controller Encountered an Error\n\nRun ID: `run1`\n\nError: \n```\nfailed to get installations\n```\n\n", text)
+}
+
+func TestCustomTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "summary.tmpl")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("{{.Title}} {{range .Counts}}{{.Name}}={{.Value}}{{end}}"), 0644))
+
+	renderer, err := NewRenderer(filename, "")
+	require.NoError(t, err)
+
+	summary := &RunSummary{Title: "Report"}
+	summary.AddCount("Scaled", 3)
+	text, err := renderer.RenderRunSummary(summary)
+	require.NoError(t, err)
+	assert.Equal(t, "Report Scaled=3", text)
+
+	t.Run("invalid template", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(filename, []byte("{{.Title"), 0644))
+		_, err := NewRenderer(filename, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := NewRenderer("", filepath.Join(dir, "missing.tmpl"))
+		assert.Error(t, err)
+	})
+}
+
+func TestFormatCost(t *testing.T) {
+	assert.Equal(t, "$1.50", FormatCost(1.5))
+	assert.Equal(t, "-$20.00", FormatCost(-20))
+}
@@ -4,15 +4,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+// httpClient is used for all webhook requests. The timeout is a backstop for
+// callers that don't set a context deadline.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
 // Payload is a webhook payload.
 type Payload struct {
 	Username string `json:"username"`
 	IconURL  string `json:"icon_url"`
+	Channel  string `json:"channel,omitempty"`
 	Text     string `json:"text"`
 }
 
@@ -29,18 +38,43 @@ func Send(ctx context.Context, webhookURL string, payload *Payload) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal payload")
 	}
-	body := bytes.NewReader(payloadBytes)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, body)
+	return Post(ctx, webhookURL, payloadBytes, nil)
+}
+
+// StatusError is returned when a webhook responds with a status other than 2xx.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook failed with status code %d", e.StatusCode)
+}
+
+// Post sends a JSON body to the provided URL with any additional headers. Any
+// response status other than 2xx is treated as a failure.
+func Post(ctx context.Context, webhookURL string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
 
-	_, err = http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return errors.Wrap(err, "failed to send webhook")
 	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
 
 	return nil
 }
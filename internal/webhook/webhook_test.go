@@ -0,0 +1,37 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSend(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	payload := &Payload{Username: "Fleet Controller", Text: "text"}
+
+	t.Run("success", func(t *testing.T) {
+		assert.NoError(t, Send(context.Background(), server.URL, payload))
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		status = http.StatusServiceUnavailable
+		err := Send(context.Background(), server.URL, payload)
+		require.IsType(t, &StatusError{}, err)
+		assert.Equal(t, http.StatusServiceUnavailable, err.(*StatusError).StatusCode)
+		status = http.StatusOK
+	})
+
+	t.Run("missing text", func(t *testing.T) {
+		assert.Error(t, Send(context.Background(), server.URL, &Payload{Username: "Fleet Controller"}))
+	})
+}
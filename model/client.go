@@ -0,0 +1,160 @@
+package model
+
+import (
+	"context"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"golang.org/x/time/rate"
+)
+
+// ProvisionerClient is the subset of the provisioning server API used by the
+// fleet controller.
+type ProvisionerClient interface {
+	GetInstallation(installationID string, request *cmodel.GetInstallationRequest) (*cmodel.InstallationDTO, error)
+	GetInstallations(request *cmodel.GetInstallationsRequest) ([]*cmodel.InstallationDTO, error)
+	GetInstallationsStatus() (*cmodel.InstallationsStatus, error)
+	GetClusterInstallations(request *cmodel.GetClusterInstallationsRequest) ([]*cmodel.ClusterInstallation, error)
+	UpdateInstallation(installationID string, request *cmodel.PatchInstallationRequest) (*cmodel.InstallationDTO, error)
+	HibernateInstallation(installationID string) (*cmodel.InstallationDTO, error)
+	WakeupInstallation(installationID string) (*cmodel.InstallationDTO, error)
+	DeleteInstallation(installationID string) error
+	RetryCreateInstallation(installationID string) error
+	LockAPIForInstallation(installationID string) error
+	UnlockAPIForInstallation(installationID string) error
+	AddInstallationAnnotations(installationID string, annotationsRequest *cmodel.AddAnnotationsRequest) (*cmodel.InstallationDTO, error)
+	DeleteInstallationAnnotation(installationID string, annotationName string) error
+}
+
+// RateLimitedClient is a provisioner client that waits on a token-bucket rate
+// limiter before every call to the provisioning server.
+type RateLimitedClient struct {
+	client  ProvisionerClient
+	limiter *rate.Limiter
+}
+
+// NewRateLimitedClient returns a provisioner client limited to the provided
+// number of calls per second. A limit of 0 or less disables rate limiting.
+func NewRateLimitedClient(client ProvisionerClient, callsPerSecond float64, burst int) *RateLimitedClient {
+	limit := rate.Limit(callsPerSecond)
+	if callsPerSecond <= 0 {
+		limit = rate.Inf
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimitedClient{
+		client:  client,
+		limiter: rate.NewLimiter(limit, burst),
+	}
+}
+
+// wait waits for the rate limiter. It deliberately ignores run cancellation so
+// actions in flight when a run is cancelled can still lock installations again.
+func (c *RateLimitedClient) wait() error {
+	return c.limiter.Wait(context.Background())
+}
+
+// GetInstallation fetches an installation.
+func (c *RateLimitedClient) GetInstallation(installationID string, request *cmodel.GetInstallationRequest) (*cmodel.InstallationDTO, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.client.GetInstallation(installationID, request)
+}
+
+// GetInstallations fetches a list of installations.
+func (c *RateLimitedClient) GetInstallations(request *cmodel.GetInstallationsRequest) ([]*cmodel.InstallationDTO, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.client.GetInstallations(request)
+}
+
+// GetInstallationsStatus fetches the status of all installations.
+func (c *RateLimitedClient) GetInstallationsStatus() (*cmodel.InstallationsStatus, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.client.GetInstallationsStatus()
+}
+
+// GetClusterInstallations fetches a list of cluster installations.
+func (c *RateLimitedClient) GetClusterInstallations(request *cmodel.GetClusterInstallationsRequest) ([]*cmodel.ClusterInstallation, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.client.GetClusterInstallations(request)
+}
+
+// UpdateInstallation patches an installation.
+func (c *RateLimitedClient) UpdateInstallation(installationID string, request *cmodel.PatchInstallationRequest) (*cmodel.InstallationDTO, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.client.UpdateInstallation(installationID, request)
+}
+
+// HibernateInstallation hibernates an installation.
+func (c *RateLimitedClient) HibernateInstallation(installationID string) (*cmodel.InstallationDTO, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.client.HibernateInstallation(installationID)
+}
+
+// WakeupInstallation wakes up an installation.
+func (c *RateLimitedClient) WakeupInstallation(installationID string) (*cmodel.InstallationDTO, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.client.WakeupInstallation(installationID)
+}
+
+// DeleteInstallation deletes an installation.
+func (c *RateLimitedClient) DeleteInstallation(installationID string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.client.DeleteInstallation(installationID)
+}
+
+// RetryCreateInstallation retries the creation of an installation.
+func (c *RateLimitedClient) RetryCreateInstallation(installationID string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.client.RetryCreateInstallation(installationID)
+}
+
+// LockAPIForInstallation locks the API of an installation.
+func (c *RateLimitedClient) LockAPIForInstallation(installationID string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.client.LockAPIForInstallation(installationID)
+}
+
+// UnlockAPIForInstallation unlocks the API of an installation.
+func (c *RateLimitedClient) UnlockAPIForInstallation(installationID string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.client.UnlockAPIForInstallation(installationID)
+}
+
+// AddInstallationAnnotations adds annotations to an installation.
+func (c *RateLimitedClient) AddInstallationAnnotations(installationID string, annotationsRequest *cmodel.AddAnnotationsRequest) (*cmodel.InstallationDTO, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.client.AddInstallationAnnotations(installationID, annotationsRequest)
+}
+
+// DeleteInstallationAnnotation removes an annotation from an installation.
+func (c *RateLimitedClient) DeleteInstallationAnnotation(installationID string, annotationName string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.client.DeleteInstallationAnnotation(installationID, annotationName)
+}
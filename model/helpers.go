@@ -2,12 +2,13 @@ package model
 
 import (
 	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 // InstallationsUpdatingIsBelowMax whether the number of installations updating
 // on a given cloud server is below a maximum value or not.
-func InstallationsUpdatingIsBelowMax(max int64, client *cmodel.Client, logger log.FieldLogger) bool {
+func InstallationsUpdatingIsBelowMax(max int64, client ProvisionerClient, logger log.FieldLogger) bool {
 	status, err := client.GetInstallationsStatus()
 	if err != nil {
 		logger.WithError(err).Error("Failed to get updating installation count")
@@ -18,3 +19,36 @@ func InstallationsUpdatingIsBelowMax(max int64, client *cmodel.Client, logger lo
 
 	return status.InstallationsUpdating < max
 }
+
+// GetInstallationClusters returns the IDs of the clusters each installation
+// runs on.
+func GetInstallationClusters(client ProvisionerClient) (map[string][]string, error) {
+	clusterInstallations, err := client.GetClusterInstallations(&cmodel.GetClusterInstallationsRequest{
+		Paging: cmodel.Paging{
+			Page:           0,
+			PerPage:        cmodel.AllPerPage,
+			IncludeDeleted: false,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get cluster installations")
+	}
+
+	installationClusters := make(map[string][]string)
+	for _, clusterInstallation := range clusterInstallations {
+		installationClusters[clusterInstallation.InstallationID] = append(installationClusters[clusterInstallation.InstallationID], clusterInstallation.ClusterID)
+	}
+
+	return installationClusters, nil
+}
+
+// IsUpdatingState returns whether an installation state means the provisioner
+// is currently working on the installation.
+func IsUpdatingState(state string) bool {
+	switch state {
+	case cmodel.InstallationStateStable, cmodel.InstallationStateHibernating, cmodel.InstallationStateDeleted:
+		return false
+	}
+
+	return !IsFailedState(state)
+}
@@ -0,0 +1,135 @@
+package model
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Expectation is the outcome expected from an action taken on an installation.
+type Expectation struct {
+	InstallationID string
+	// States are the states the installation is expected to reach.
+	States []string
+	// Size is the expected installation size. It is not checked when empty.
+	Size string
+	// Version is the expected Mattermost version. It is not checked when empty.
+	Version string
+	// Image is the expected Mattermost image. It is not checked when empty.
+	Image string
+	// Deadline is when the installation must have reached an expected state.
+	Deadline time.Time
+}
+
+// VerificationResult is the outcome of verifying an expectation.
+type VerificationResult struct {
+	InstallationID string
+	State          string
+	Err            error
+}
+
+// IsFailedState returns whether an installation state means an action on the
+// installation failed.
+func IsFailedState(state string) bool {
+	return strings.HasSuffix(state, "-failed") || state == cmodel.InstallationStateCreationNoCompatibleClusters
+}
+
+// VerifyInstallations polls installations until each of them reaches an
+// expected state, enters a failed state, or passes its deadline. If the
+// context is cancelled, the results so far are returned with an error.
+func VerifyInstallations(ctx context.Context, client ProvisionerClient, expectations []*Expectation, pollInterval time.Duration, logger log.FieldLogger) ([]*VerificationResult, error) {
+	var results []*VerificationResult
+	pending := expectations
+
+	for {
+		var stillPending []*Expectation
+		for _, expectation := range pending {
+			result := verifyInstallation(client, expectation)
+			if result == nil {
+				stillPending = append(stillPending, expectation)
+				continue
+			}
+			if result.Err != nil {
+				logger.WithField("installation", expectation.InstallationID).WithError(result.Err).Warn("Installation verification failed")
+			} else {
+				logger.WithField("installation", expectation.InstallationID).Debugf("Installation verified as %s", result.State)
+			}
+			results = append(results, result)
+		}
+
+		pending = stillPending
+		if len(pending) == 0 {
+			return results, nil
+		}
+
+		logger.Infof("Waiting for %d installations to reach their expected state", len(pending))
+		select {
+		case <-ctx.Done():
+			return results, errors.Wrapf(ctx.Err(), "verification cancelled with %d installations unverified", len(pending))
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// verifyInstallation checks an installation once. A nil result is returned
+// when the installation hasn't reached a final state yet.
+func verifyInstallation(client ProvisionerClient, expectation *Expectation) *VerificationResult {
+	result := &VerificationResult{InstallationID: expectation.InstallationID}
+	expired := time.Now().After(expectation.Deadline)
+
+	installation, err := client.GetInstallation(expectation.InstallationID, &cmodel.GetInstallationRequest{})
+	if err != nil {
+		if expired {
+			result.Err = errors.Wrap(err, "failed to get installation before verification deadline")
+			return result
+		}
+		return nil
+	}
+
+	if installation == nil {
+		if containsState(expectation.States, cmodel.InstallationStateDeleted) {
+			result.State = cmodel.InstallationStateDeleted
+			return result
+		}
+		result.Err = errors.New("installation not found")
+		return result
+	}
+
+	result.State = installation.State
+	if IsFailedState(installation.State) {
+		result.Err = errors.Errorf("installation entered failed state %s", installation.State)
+		return result
+	}
+	if containsState(expectation.States, installation.State) {
+		if len(expectation.Size) != 0 && installation.Size != expectation.Size {
+			result.Err = errors.Errorf("installation is %s with size %s instead of %s", installation.State, installation.Size, expectation.Size)
+		}
+		if len(expectation.Version) != 0 && installation.Version != expectation.Version {
+			result.Err = errors.Errorf("installation is %s with version %s instead of %s", installation.State, installation.Version, expectation.Version)
+		}
+		if len(expectation.Image) != 0 && installation.Image != expectation.Image {
+			result.Err = errors.Errorf("installation is %s with image %s instead of %s", installation.State, installation.Image, expectation.Image)
+		}
+		return result
+	}
+	if expired {
+		result.Err = errors.Errorf("installation was still %s at verification deadline", installation.State)
+		return result
+	}
+
+	return nil
+}
+
+func containsState(states []string, state string) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cmodel "github.com/mattermost/mattermost-cloud/model"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockClient returns installations in the states queued for them, repeating
+// the last state once the queue is exhausted.
+type mockClient struct {
+	ProvisionerClient
+	states  map[string][]string
+	size    string
+	version string
+}
+
+func (c *mockClient) GetInstallation(installationID string, request *cmodel.GetInstallationRequest) (*cmodel.InstallationDTO, error) {
+	states, ok := c.states[installationID]
+	if !ok {
+		return nil, nil
+	}
+	state := states[0]
+	if len(states) > 1 {
+		c.states[installationID] = states[1:]
+	}
+
+	return &cmodel.InstallationDTO{
+		Installation: &cmodel.Installation{ID: installationID, State: state, Size: c.size, Version: c.version},
+	}, nil
+}
+
+func TestVerifyInstallations(t *testing.T) {
+	client := &mockClient{
+		size:    "1000users",
+		version: "5.37.0",
+		states: map[string][]string{
+			"hibernated":   {cmodel.InstallationStateHibernationRequested, cmodel.InstallationStateHibernationInProgress, cmodel.InstallationStateHibernating},
+			"failed":       {cmodel.InstallationStateUpdateInProgress, cmodel.InstallationStateUpdateFailed},
+			"stuck":        {cmodel.InstallationStateHibernationInProgress},
+			"wrong-size":   {cmodel.InstallationStateStable},
+			"upgraded":     {cmodel.InstallationStateUpdateInProgress, cmodel.InstallationStateStable},
+			"not-upgraded": {cmodel.InstallationStateStable},
+		},
+	}
+
+	deadline := time.Now().Add(50 * time.Millisecond)
+	expectations := []*Expectation{
+		{InstallationID: "hibernated", States: []string{cmodel.InstallationStateHibernating}, Deadline: deadline},
+		{InstallationID: "failed", States: []string{cmodel.InstallationStateStable}, Deadline: deadline},
+		{InstallationID: "stuck", States: []string{cmodel.InstallationStateHibernating}, Deadline: deadline},
+		{InstallationID: "wrong-size", States: []string{cmodel.InstallationStateStable}, Size: "5000users", Deadline: deadline},
+		{InstallationID: "deleted", States: []string{cmodel.InstallationStateDeleted}, Deadline: deadline},
+		{InstallationID: "upgraded", States: []string{cmodel.InstallationStateStable}, Version: "5.37.0", Deadline: deadline},
+		{InstallationID: "not-upgraded", States: []string{cmodel.InstallationStateStable}, Version: "5.38.0", Deadline: deadline},
+	}
+
+	results, err := VerifyInstallations(context.Background(), client, expectations, 5*time.Millisecond, log.New())
+	require.NoError(t, err)
+	require.Len(t, results, 7)
+
+	byID := make(map[string]*VerificationResult)
+	for _, result := range results {
+		byID[result.InstallationID] = result
+	}
+
+	assert.NoError(t, byID["hibernated"].Err)
+	assert.Equal(t, cmodel.InstallationStateHibernating, byID["hibernated"].State)
+	assert.NoError(t, byID["deleted"].Err)
+	assert.Error(t, byID["failed"].Err)
+	assert.Equal(t, cmodel.InstallationStateUpdateFailed, byID["failed"].State)
+	assert.Error(t, byID["stuck"].Err)
+	assert.Error(t, byID["wrong-size"].Err)
+	assert.NoError(t, byID["upgraded"].Err)
+	assert.Error(t, byID["not-upgraded"].Err)
+}